@@ -1,5 +1,11 @@
 package transparent
 
+import (
+	"context"
+	"errors"
+	"time"
+)
+
 // BackendReceiver is interface from another system
 // Callback function will executed with received Message.
 type BackendReceiver interface {
@@ -19,9 +25,186 @@ type BackendTransmitter interface {
 	SetCallback(func(m *Message) (*Message, error)) error
 }
 
+// BackendTransmitterContext is BackendTransmitter which can cancel Request.
+// Layers use RequestContext instead of Request if it is implemented.
+type BackendTransmitterContext interface {
+	BackendTransmitter
+	RequestContext(ctx context.Context, operation *Message) (*Message, error)
+}
+
+// BackendTransmitterPrepare is BackendTransmitter which asks every receiver to prepare
+// the operation before commit. If the prepare callback returns error, the operation is aborted.
+// Resources held by prepare are released by commit callback, or abort callback
+// if the operation is aborted after it is prepared successfully.
+// Request of the aborted operation returns error.
+type BackendTransmitterPrepare interface {
+	BackendTransmitter
+	SetPrepareCallback(func(m *Message) error) error
+	SetAbortCallback(func(m *Message)) error
+}
+
+// BackendTransmitterRead is BackendTransmitter which supports linearizable read.
+// ReadIndex waits until the operations committed before it are applied to this node.
+// ReadLease is ReadIndex, but it may return without asking the cluster while the node holds a lease.
+type BackendTransmitterRead interface {
+	BackendTransmitter
+	ReadIndex(ctx context.Context) error
+	ReadLease(ctx context.Context) error
+}
+
 // BackendStorage defines the interface that backend data storage.
 type BackendStorage interface {
 	Get(key interface{}) (value interface{}, err error)
 	Add(key interface{}, value interface{}) error
 	Remove(key interface{}) error
 }
+
+// BackendStorageContext is BackendStorage which can cancel operations.
+// Layers use the Context variants if they are implemented.
+type BackendStorageContext interface {
+	BackendStorage
+	GetContext(ctx context.Context, key interface{}) (value interface{}, err error)
+	AddContext(ctx context.Context, key interface{}, value interface{}) error
+	RemoveContext(ctx context.Context, key interface{}) error
+}
+
+// BackendStorageTTL is BackendStorage which expires the key-value after ttl.
+// Get returns KeyNotFoundError for expired key.
+type BackendStorageTTL interface {
+	BackendStorage
+	AddWithTTL(ctx context.Context, key interface{}, value interface{}, ttl time.Duration) error
+}
+
+// BackendTransmitterBatch is BackendTransmitter which can Request MessageBatch.
+// Layers send multiple operations at once if it is implemented.
+type BackendTransmitterBatch interface {
+	BackendTransmitter
+	RequestBatch(ctx context.Context, operations []*Message) ([]*Message, error)
+}
+
+// BackendStorageMulti is BackendStorage which can operate multiple keys at once.
+// GetMulti doesn't include keys not found in the result.
+type BackendStorageMulti interface {
+	BackendStorage
+	GetMulti(ctx context.Context, keys []interface{}) (map[interface{}]interface{}, error)
+	AddMulti(ctx context.Context, values map[interface{}]interface{}) error
+	RemoveMulti(ctx context.Context, keys []interface{}) error
+}
+
+// NewBackendStorageMulti returns storage itself if it implements BackendStorageMulti,
+// or returns the adapter which operates each key of the storage.
+func NewBackendStorageMulti(storage BackendStorage) BackendStorageMulti {
+	if sm, ok := storage.(BackendStorageMulti); ok {
+		return sm
+	}
+	return &storageMulti{storage}
+}
+
+type storageMulti struct {
+	BackendStorage
+}
+
+func (s *storageMulti) GetMulti(ctx context.Context, keys []interface{}) (map[interface{}]interface{}, error) {
+	values := make(map[interface{}]interface{}, len(keys))
+	for _, key := range keys {
+		value, err := get(ctx, s.BackendStorage, key)
+		if err != nil {
+			if _, ok := err.(*KeyNotFoundError); ok {
+				continue
+			}
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+func (s *storageMulti) AddMulti(ctx context.Context, values map[interface{}]interface{}) error {
+	for key, value := range values {
+		err := add(ctx, s.BackendStorage, key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *storageMulti) RemoveMulti(ctx context.Context, keys []interface{}) error {
+	for _, key := range keys {
+		err := remove(ctx, s.BackendStorage, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func request(ctx context.Context, t BackendTransmitter, operation *Message) (*Message, error) {
+	if tc, ok := t.(BackendTransmitterContext); ok {
+		return tc.RequestContext(ctx, operation)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return t.Request(operation)
+}
+
+// requestBatch requests operations at once if t is BackendTransmitterBatch,
+// otherwise requests each operation. Get of the key not found has no reply.
+func requestBatch(ctx context.Context, t BackendTransmitter, operations []*Message) ([]*Message, error) {
+	if tb, ok := t.(BackendTransmitterBatch); ok {
+		return tb.RequestBatch(ctx, operations)
+	}
+	replies := []*Message{}
+	for _, operation := range operations {
+		reply, err := request(ctx, t, operation)
+		if err != nil {
+			if _, ok := err.(*KeyNotFoundError); ok && operation.Message == MessageGet {
+				continue
+			}
+			return nil, err
+		}
+		if operation.Message == MessageGet {
+			reply.Key = operation.Key
+			replies = append(replies, reply)
+		}
+	}
+	return replies, nil
+}
+
+func get(ctx context.Context, s BackendStorage, key interface{}) (interface{}, error) {
+	if sc, ok := s.(BackendStorageContext); ok {
+		return sc.GetContext(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Get(key)
+}
+
+func add(ctx context.Context, s BackendStorage, key interface{}, value interface{}) error {
+	if sc, ok := s.(BackendStorageContext); ok {
+		return sc.AddContext(ctx, key, value)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Add(key, value)
+}
+
+func remove(ctx context.Context, s BackendStorage, key interface{}) error {
+	if sc, ok := s.(BackendStorageContext); ok {
+		return sc.RemoveContext(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Remove(key)
+}
+
+func addWithTTL(ctx context.Context, s BackendStorage, key interface{}, value interface{}, ttl time.Duration) error {
+	if st, ok := s.(BackendStorageTTL); ok {
+		return st.AddWithTTL(ctx, key, value, ttl)
+	}
+	return errors.New("storage doesn't support TTL")
+}
@@ -1,45 +1,138 @@
 package transparent
 
 import (
-	"errors"
+	"context"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 type layerCache struct {
-	Storage BackendStorage // Target cache
-	log     chan log       // Channel buffer
-	sync    chan bool      // Control for flush buffer
-	synced  chan bool
+	Storage BackendStorage   // Target cache
+	log     chan log         // Channel buffer
+	sync    chan syncRequest // Control for flush buffer
 	done    chan bool
 	next    Layer
+
+	policy       WritePolicy
+	batchSize    int                   // Flush if buffered more than this
+	interval     time.Duration         // Flush if silent for this duration
+	retry        int                   // Max retry count of failed flush
+	backoff      time.Duration         // Wait before first retry, doubled for each retry
+	errorHandler func(err *FlushError) // Called when flush is finally failed
+	walFilename  string
+	wal          *writeAheadLog
+	refreshAhead time.Duration // Refresh hot value this duration before hard TTL
+	refreshHits  int           // Value read at least this times is hot
+
+	flight     flightGroup    // Deduplicate Get of next layer
+	negative   *negativeCache // Keys not found in next layer, nil if disabled
+	fresh      *freshness     // Age of values from next layer, nil if disabled
+	hub        *watchHub
+	refresh    chan interface{} // Keys to refresh in background
+	refreshing sync.WaitGroup
+	stats      CacheStats
+}
+
+// CacheStats is counters of LayerCache
+type CacheStats struct {
+	Miss      uint64 // Get which is not found in Storage
+	Coalesced uint64 // Get which shared the result of another Get in flight
+	Negative  uint64 // Get which is answered by negative cache
+	Stale     uint64 // Get which returned stale value
+	Refresh   uint64 // Refresh of value in background
+}
+
+// GetCacheStats returns current counters of LayerCache
+func GetCacheStats(l Layer) (CacheStats, error) {
+	c, ok := l.(*layerCache)
+	if !ok {
+		return CacheStats{}, errors.New("not LayerCache")
+	}
+	return CacheStats{
+		Miss:      atomic.LoadUint64(&c.stats.Miss),
+		Coalesced: atomic.LoadUint64(&c.stats.Coalesced),
+		Negative:  atomic.LoadUint64(&c.stats.Negative),
+		Stale:     atomic.LoadUint64(&c.stats.Stale),
+		Refresh:   atomic.LoadUint64(&c.stats.Refresh),
+	}, nil
 }
 
 // Flush buffer use this struct in its log channel
 type log struct {
 	key interface{}
+	seq uint64 // Sequence number in write-ahead log
 	*Message
 }
 
+// Sync request to flusher, result of the Sync is returned to done
+type syncRequest struct {
+	ctx  context.Context
+	keys []interface{} // Return FlushErrors of the keys only, all if nil
+	done chan error
+}
+
 // NewLayerCache returns LayerCache.
 // LayerCache wraps BackendStorage.
 // It Get/Set key-value to BackendStorage,
-// and asynchronously apply same operation to Next Layer.
+// and apply same operation to Next Layer by WritePolicy, default is WriteBack.
+// If the operation is failed to apply, it is retried and reported
+// to error handler, and returned by next Sync.
 // It must be Stacked on a Layer.
-func NewLayerCache(bufferSize int, storage BackendStorage) (Layer, error) {
+func NewLayerCache(bufferSize int, storage BackendStorage, options ...CacheOption) (Layer, error) {
 	if storage == nil {
 		return nil, errors.New("empty storage")
 	}
 	c := &layerCache{
-		log:     make(chan log, bufferSize),
-		done:    make(chan bool, 1),
-		sync:    make(chan bool, 1),
-		synced:  make(chan bool, 1),
-		Storage: storage,
+		log:       make(chan log, bufferSize),
+		refresh:   make(chan interface{}, bufferSize),
+		done:      make(chan bool, 1),
+		sync:      make(chan syncRequest, 1),
+		Storage:   storage,
+		policy:    WriteBack,
+		batchSize: 5,
+		interval:  time.Second,
+		retry:     3,
+		backoff:   100 * time.Millisecond,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	if c.batchSize <= 0 {
+		return nil, errors.New("batch size must be positive")
+	}
+	if c.interval <= 0 {
+		return nil, errors.New("flush interval must be positive")
+	}
+	if c.fresh != nil {
+		if c.fresh.soft <= 0 || c.fresh.hard < c.fresh.soft {
+			return nil, errors.New("soft TTL must be positive and hard TTL must not be less than it")
+		}
+		if _, ok := storage.(BackendStorageTTL); !ok {
+			return nil, errors.New("storage doesn't support TTL")
+		}
+		c.fresh.ahead = c.refreshAhead
+		c.fresh.hits = c.refreshHits
+	} else if c.refreshHits > 0 {
+		return nil, errors.New("refresh-ahead requires stale-while-revalidate")
+	}
+	if c.walFilename != "" {
+		wal, err := openWriteAheadLog(c.walFilename)
+		if err != nil {
+			return nil, err
+		}
+		c.wal = wal
 	}
 	return c, nil
 }
 
 func (c *layerCache) start() error {
+	err := c.replay()
+	if err != nil {
+		return err
+	}
 	go c.flusher()
 	return nil
 }
@@ -47,21 +140,53 @@ func (c *layerCache) start() error {
 func (c *layerCache) stop() error {
 	close(c.log)
 	<-c.done
+	c.refreshing.Wait()
+	if c.wal != nil {
+		return c.wal.close()
+	}
 	return nil
 }
 
+// replay applies operations left in write-ahead log to next layer
+func (c *layerCache) replay() error {
+	if c.wal == nil || c.next == nil {
+		return nil
+	}
+	ctx := context.Background()
+	seqs := make(map[uint64]bool)
+	for _, r := range c.wal.records() {
+		err := apply(ctx, c.next, r.Key, &Message{
+			Value:   r.Value,
+			Message: r.Message,
+			Expire:  r.Expire,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to replay write-ahead log. key = %v", r.Key)
+		}
+		seqs[r.Seq] = true
+	}
+	return c.wal.commit(seqs)
+}
+
 type buffer struct {
-	queue map[interface{}]*Message
-	c     *layerCache
-	limit int
+	queue  map[interface{}]*log
+	seqs   map[uint64]bool // Sequence numbers of write-ahead log in the queue
+	c      *layerCache
+	limit  int
+	errors FlushErrors // Failed flush since the last Sync, up to maxFlushErrors
 }
 
+// maxFlushErrors is the number of FlushErrors kept until Sync, older ones are dropped
+const maxFlushErrors = 1000
+
 func (b *buffer) reset() {
-	b.queue = make(map[interface{}]*Message)
+	b.queue = make(map[interface{}]*log)
+	b.seqs = make(map[uint64]bool)
 }
 
 func (b *buffer) add(l *log) {
-	b.queue[l.key] = l.Message
+	b.queue[l.key] = l
+	b.seqs[l.seq] = true
 }
 func (b *buffer) checkLimit() {
 	if len(b.queue) > b.limit {
@@ -69,22 +194,137 @@ func (b *buffer) checkLimit() {
 	}
 }
 
+// drain moves all values in channel buffer to the queue
+func (b *buffer) drain() {
+	for {
+		select {
+		case l, ok := <-b.c.log:
+			if !ok {
+				return
+			}
+			b.add(&l)
+		default:
+			return
+		}
+	}
+}
+
+// flush applies queued operations to next layer.
+// Set without expiration and Remove are applied by SetMulti and RemoveMulti at once.
 func (b *buffer) flush() {
-	for k, o := range b.queue {
-		switch o.Message {
-		case MessageRemove:
-			b.c.next.Remove(k)
-		case MessageSet:
-			b.c.next.Set(k, o.Value)
+	ctx := context.Background()
+	values := make(map[interface{}]interface{})
+	removes := []interface{}{}
+	for k, l := range b.queue {
+		switch {
+		case l.Message.Message == MessageSet && l.Message.Expire.IsZero():
+			values[k] = l.Message.Value
+		case l.Message.Message == MessageRemove:
+			removes = append(removes, k)
+		default:
+			err := b.retry(func() error { return apply(ctx, b.c.next, k, l.Message) })
+			if err != nil {
+				b.failed(k, err)
+			}
+		}
+	}
+	if len(values) > 0 {
+		err := b.retry(func() error { return b.c.next.SetMulti(ctx, values) })
+		if err != nil {
+			for k := range values {
+				b.failed(k, err)
+			}
+		}
+	}
+	if len(removes) > 0 {
+		err := b.retry(func() error { return b.c.next.RemoveMulti(ctx, removes) })
+		if err != nil {
+			for _, k := range removes {
+				b.failed(k, err)
+			}
+		}
+	}
+	if b.c.wal != nil {
+		err := b.c.wal.commit(b.seqs)
+		if err != nil {
+			b.report(&FlushError{Err: err})
 		}
 	}
 	b.reset()
 }
 
+// failed reports the operation of the key is failed to flush
+func (b *buffer) failed(k interface{}, err error) {
+	l := b.queue[k]
+	// Keep it in write-ahead log to replay
+	delete(b.seqs, l.seq)
+	b.report(&FlushError{Key: k, Message: l.Message.Message, Err: err})
+}
+
+func (b *buffer) report(flushErr *FlushError) {
+	b.errors = append(b.errors, flushErr)
+	if len(b.errors) > maxFlushErrors {
+		b.errors = b.errors[len(b.errors)-maxFlushErrors:]
+	}
+	if b.c.errorHandler != nil {
+		b.c.errorHandler(flushErr)
+	}
+}
+
+// retry the operation to next layer with backoff if failed
+func (b *buffer) retry(operation func() error) (err error) {
+	backoff := b.c.backoff
+	for i := 0; ; i++ {
+		err = operation()
+		if err == nil || i >= b.c.retry {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// takeErrors returns failed flush and clear them
+func (b *buffer) takeErrors() error {
+	if len(b.errors) == 0 {
+		return nil
+	}
+	errs := b.errors
+	b.errors = nil
+	return errs
+}
+
+// takeKeyErrors returns failed flush of the keys and clear them, others are kept
+func (b *buffer) takeKeyErrors(keys []interface{}) error {
+	target := make(map[interface{}]bool, len(keys))
+	for _, key := range keys {
+		target[key] = true
+	}
+	var errs FlushErrors
+	rest := b.errors[:0]
+	for _, e := range b.errors {
+		if e.Key != nil && target[e.Key] {
+			errs = append(errs, e)
+		} else {
+			rest = append(rest, e)
+		}
+	}
+	b.errors = rest
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
 // Flusher
 func (c *layerCache) flusher() {
-	b := buffer{c: c, limit: 5}
+	b := buffer{c: c, limit: c.batchSize}
 	b.reset()
+	// Flush if silent for the interval, sweep periodically regardless of writes
+	silent := time.NewTimer(c.interval)
+	defer silent.Stop()
+	sweep := time.NewTicker(c.interval)
+	defer sweep.Stop()
 done:
 	for { // main loop
 		select {
@@ -95,28 +335,42 @@ done:
 			}
 			b.add(&l)
 			b.checkLimit()
-		case <-c.sync:
-			// Flush current buffer
+			if !silent.Stop() {
+				<-silent.C
+			}
+			silent.Reset(c.interval)
+		case r := <-c.sync:
+			// Flush current buffer and value in channel buffer
+			b.drain()
 			b.flush()
-
-			// Flush value in channel buffer
-			// Switch to new channel for current writer
-			old := *c
-			c.log = make(chan log, len(c.log))
-
-			// Close old log for flushing
-			close(old.log)
-			old.flusher()
-			<-old.done
+			if r.keys != nil {
+				// The operations are already applied to next layer by flush
+				r.done <- b.takeKeyErrors(r.keys)
+				break
+			}
 
 			// Next, recursively
-			if old.next != nil {
-				old.next.Sync()
+			err := b.takeErrors()
+			if c.next != nil {
+				nextErr := c.next.SyncContext(r.ctx)
+				if err == nil {
+					err = nextErr
+				}
 			}
-			c.synced <- true
-		case <-time.After(time.Second * 1):
-			// Flush if silent for one sec
+			r.done <- err
+		case key := <-c.refresh:
+			c.refreshing.Add(1)
+			go c.revalidate(key)
+		case <-silent.C:
 			b.flush()
+			silent.Reset(c.interval)
+		case <-sweep.C:
+			if c.negative != nil {
+				c.negative.sweep()
+			}
+			if c.fresh != nil {
+				c.fresh.sweep()
+			}
 		}
 	}
 	// Flush bufferd value
@@ -127,50 +381,624 @@ done:
 
 // Get value from cache, or if not found, recursively get.
 func (c *layerCache) Get(key interface{}) (value interface{}, err error) {
+	return c.GetContext(context.Background(), key)
+}
+
+// GetContext value from cache, or if not found, recursively get.
+// Errors of Storage other than KeyNotFoundError are returned.
+func (c *layerCache) GetContext(ctx context.Context, key interface{}) (value interface{}, err error) {
 	// Try to get backend cache
-	value, err = c.Storage.Get(key)
+	value, err = get(ctx, c.Storage, key)
 	if err != nil {
+		if _, ok := err.(*KeyNotFoundError); !ok {
+			// Failure of Storage is not a miss
+			return nil, err
+		}
 		if c.next == nil {
 			return nil, errors.New("value not found")
 		}
-		// Recursively get value from list.
-		value, err = c.next.Get(key)
-		if err != nil {
-			return nil, err
+		atomic.AddUint64(&c.stats.Miss, 1)
+		if c.negative != nil && c.negative.found(key) {
+			atomic.AddUint64(&c.stats.Negative, 1)
+			return nil, &KeyNotFoundError{Key: key}
 		}
-		err = c.Storage.Add(key, value)
-		if err != nil {
-			return nil, err
+		return c.fetch(ctx, key)
+	}
+	c.hit(key)
+	return value, nil
+}
+
+// hit requests refresh of the key if it is stale or hot
+func (c *layerCache) hit(key interface{}) {
+	if c.fresh == nil || c.next == nil {
+		return
+	}
+	e, stale, refresh := c.fresh.hit(key)
+	if stale {
+		atomic.AddUint64(&c.stats.Stale, 1)
+	}
+	if refresh {
+		select {
+		case c.refresh <- key:
+		default:
+			// Too many refresh, try again by next Get
+			c.fresh.failed(key, e)
+		}
+	}
+}
+
+// GetMulti values from cache, and get values not found recursively at once.
+// Unlike GetContext, it is not coalesced with concurrent Get.
+func (c *layerCache) GetMulti(ctx context.Context, keys []interface{}) (map[interface{}]interface{}, error) {
+	storage := NewBackendStorageMulti(c.Storage)
+	values, err := storage.GetMulti(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	if c.next == nil {
+		return values, nil
+	}
+	missing := []interface{}{}
+	for _, key := range keys {
+		if _, ok := values[key]; ok {
+			c.hit(key)
+			continue
+		}
+		atomic.AddUint64(&c.stats.Miss, 1)
+		if c.negative != nil && c.negative.found(key) {
+			atomic.AddUint64(&c.stats.Negative, 1)
+			continue
 		}
+		missing = append(missing, key)
+	}
+	if len(missing) == 0 {
+		return values, nil
+	}
+
+	var gen uint64
+	if c.negative != nil {
+		gen = c.negative.generation()
+	}
+	found, err := c.next.GetMulti(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range missing {
+		value, ok := found[key]
+		if !ok {
+			if c.negative != nil {
+				c.negative.add(key, gen)
+			}
+			continue
+		}
+		values[key] = value
+	}
+	if c.fresh != nil {
+		// Stored with hard TTL one by one
+		for key, value := range found {
+			key, value := key, value
+			err = c.fresh.fill(key, c.fresh.get(key), func() error {
+				return addWithTTL(ctx, c.Storage, key, value, c.fresh.hard)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	err = storage.AddMulti(ctx, found)
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// revalidate refreshes the value from next layer, called by flusher
+func (c *layerCache) revalidate(key interface{}) {
+	defer c.refreshing.Done()
+	atomic.AddUint64(&c.stats.Refresh, 1)
+	ctx := context.Background()
+	e := c.fresh.get(key)
+	_, err, _ := c.flight.do(ctx, key, func() (interface{}, error) {
+		return c.fill(ctx, key)
+	})
+	if err == nil {
+		return
+	}
+	if _, ok := err.(*KeyNotFoundError); ok {
+		// Removed from next layer, drop stale value
+		err = c.fresh.fill(key, e, func() error {
+			return remove(ctx, c.Storage, key)
+		})
+		if err == nil {
+			c.fresh.forget(key)
+			return
+		}
+	}
+	c.fresh.failed(key, e)
+}
+
+// fetch the value from next layer and store it.
+// Concurrent fetch of the same key is coalesced into one.
+func (c *layerCache) fetch(ctx context.Context, key interface{}) (value interface{}, err error) {
+	for {
+		var shared bool
+		value, err, shared = c.flight.do(ctx, key, func() (interface{}, error) {
+			return c.fill(ctx, key)
+		})
+		if !shared {
+			return value, err
+		}
+		atomic.AddUint64(&c.stats.Coalesced, 1)
+		if (err == context.Canceled || err == context.DeadlineExceeded) && ctx.Err() == nil {
+			// Shared call is canceled by its caller, try again
+			continue
+		}
+		return value, err
+	}
+}
+
+// fill gets the value from next layer and store it to Storage
+func (c *layerCache) fill(ctx context.Context, key interface{}) (interface{}, error) {
+	var gen uint64
+	if c.negative != nil {
+		gen = c.negative.generation()
+	}
+	var prev *freshEntry
+	if c.fresh != nil {
+		prev = c.fresh.get(key)
+	}
+	// Recursively get value from list.
+	value, err := c.next.GetContext(ctx, key)
+	if err != nil {
+		if _, ok := err.(*KeyNotFoundError); ok && c.negative != nil {
+			c.negative.add(key, gen)
+		}
+		return nil, err
+	}
+	err = c.store(ctx, key, value, prev)
+	if err != nil {
+		return nil, err
 	}
 	return value, nil
 }
 
+// store adds the value got from next layer to Storage, with hard TTL if stale-while-revalidate is enabled.
+// prev is the freshness of the key before it is got.
+func (c *layerCache) store(ctx context.Context, key interface{}, value interface{}, prev *freshEntry) error {
+	if c.fresh != nil {
+		return c.fresh.fill(key, prev, func() error {
+			return addWithTTL(ctx, c.Storage, key, value, c.fresh.hard)
+		})
+	}
+	return add(ctx, c.Storage, key, value)
+}
+
 // Set set new value to Storage.
 func (c *layerCache) Set(key interface{}, value interface{}) (err error) {
-	err = c.Storage.Add(key, value)
+	return c.SetContext(context.Background(), key, value)
+}
+
+// SetContext set new value to Storage.
+func (c *layerCache) SetContext(ctx context.Context, key interface{}, value interface{}) (err error) {
+	err = c.setContext(ctx, key, value)
 	if err != nil {
 		return err
 	}
+	c.hub.notify(c, MessageSet, key, value)
+	return nil
+}
+
+func (c *layerCache) setContext(ctx context.Context, key interface{}, value interface{}) (err error) {
+	c.invalidate(key)
 	if c.next == nil {
 		// This backend cache is final destination
+		return add(ctx, c.Storage, key, value)
+	}
+	switch c.policy {
+	case WriteThrough:
+		err = c.next.SetContext(ctx, key, value)
+		if err != nil {
+			return err
+		}
+		return add(ctx, c.Storage, key, value)
+	case WriteAround:
+		// Drop old value, next Get will read it from next layer
+		err = remove(ctx, c.Storage, key)
+		if err != nil {
+			return err
+		}
+		return c.next.SetContext(ctx, key, value)
+	}
+	err = add(ctx, c.Storage, key, value)
+	if err != nil {
+		return err
+	}
+	// Queue to flush
+	return c.enqueue(ctx, log{key: key, Message: &Message{Value: value, Message: MessageSet}})
+}
+
+// SetWithTTL set new value to Storage, it expires after ttl.
+// Expired value is not found in Storage, so it is got from next layer again.
+// Note that the value got from next layer is stored without ttl.
+func (c *layerCache) SetWithTTL(ctx context.Context, key interface{}, value interface{}, ttl time.Duration) (err error) {
+	err = c.setWithTTL(ctx, key, value, ttl)
+	if err != nil {
+		return err
+	}
+	c.hub.notify(c, MessageSet, key, value)
+	return nil
+}
+
+func (c *layerCache) setWithTTL(ctx context.Context, key interface{}, value interface{}, ttl time.Duration) (err error) {
+	expire, err := ExpireAt(ttl)
+	if err != nil {
+		return err
+	}
+	c.invalidate(key)
+	if c.next == nil {
+		// This backend cache is final destination
+		return addWithTTL(ctx, c.Storage, key, value, ttl)
+	}
+	switch c.policy {
+	case WriteThrough:
+		err = c.next.SetWithTTL(ctx, key, value, ttl)
+		if err != nil {
+			return err
+		}
+		return addWithTTL(ctx, c.Storage, key, value, ttl)
+	case WriteAround:
+		// Drop old value, next Get will read it from next layer
+		err = remove(ctx, c.Storage, key)
+		if err != nil {
+			return err
+		}
+		return c.next.SetWithTTL(ctx, key, value, ttl)
+	}
+	err = addWithTTL(ctx, c.Storage, key, value, ttl)
+	if err != nil {
+		return err
+	}
+	// Queue to flush
+	return c.enqueue(ctx, log{key: key, Message: &Message{Value: value, Message: MessageSet, Expire: expire}})
+}
+
+// invalidate forgets the key in negative cache and freshness, if enabled
+func (c *layerCache) invalidate(key interface{}) {
+	if c.negative != nil {
+		c.negative.invalidate(key)
+	}
+	if c.fresh != nil {
+		c.fresh.forget(key)
+	}
+}
+
+func (c *layerCache) enqueue(ctx context.Context, l log) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	if c.wal != nil {
+		l.seq, err = c.wal.append(l.key, l.Message)
+		if err != nil {
+			return err
+		}
+	}
+	select {
+	case c.log <- l:
 		return nil
+	case <-ctx.Done():
+		if c.wal != nil {
+			// Canceled operation must not be replayed
+			err = c.wal.discard(l.seq)
+			if err != nil {
+				return err
+			}
+		}
+		return ctx.Err()
+	}
+}
+
+// SetMulti set new values to Storage, and apply them to next layer at once by WritePolicy.
+func (c *layerCache) SetMulti(ctx context.Context, values map[interface{}]interface{}) (err error) {
+	err = c.setMulti(ctx, values)
+	if err != nil {
+		return err
+	}
+	for key, value := range values {
+		c.hub.notify(c, MessageSet, key, value)
+	}
+	return nil
+}
+
+func (c *layerCache) setMulti(ctx context.Context, values map[interface{}]interface{}) (err error) {
+	for key := range values {
+		c.invalidate(key)
+	}
+	storage := NewBackendStorageMulti(c.Storage)
+	if c.next == nil {
+		// This backend cache is final destination
+		return storage.AddMulti(ctx, values)
+	}
+	switch c.policy {
+	case WriteThrough:
+		err = c.next.SetMulti(ctx, values)
+		if err != nil {
+			return err
+		}
+		return storage.AddMulti(ctx, values)
+	case WriteAround:
+		// Drop old values, next Get will read them from next layer
+		keys := make([]interface{}, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		err = storage.RemoveMulti(ctx, keys)
+		if err != nil {
+			return err
+		}
+		return c.next.SetMulti(ctx, values)
+	}
+	err = storage.AddMulti(ctx, values)
+	if err != nil {
+		return err
+	}
+	// Queue to flush
+	for key, value := range values {
+		err = c.enqueue(ctx, log{key: key, Message: &Message{Value: value, Message: MessageSet}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveMulti recursively remove next layer's values at once
+func (c *layerCache) RemoveMulti(ctx context.Context, keys []interface{}) (err error) {
+	err = c.removeMulti(ctx, keys)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		c.hub.notify(c, MessageRemove, key, nil)
+	}
+	return nil
+}
+
+func (c *layerCache) removeMulti(ctx context.Context, keys []interface{}) (err error) {
+	if c.fresh != nil {
+		for _, key := range keys {
+			c.fresh.forget(key)
+		}
+	}
+	err = NewBackendStorageMulti(c.Storage).RemoveMulti(ctx, keys)
+	if err != nil {
+		return err
+	}
+	if c.next == nil {
+		// This is bottom layer
+		return nil
+	}
+	if c.policy != WriteBack {
+		return c.next.RemoveMulti(ctx, keys)
 	}
 	// Queue to flush
-	c.log <- log{key, &Message{Value: value, Message: MessageSet}}
+	for _, key := range keys {
+		err = c.enqueue(ctx, log{key: key, Message: &Message{Value: nil, Message: MessageRemove}})
+		if err != nil {
+			return err
+		}
+	}
+	return c.requestSync(ctx, keys) // Remove must be synced
+}
+
+// Scan keys in Storage and next layer.
+// If Storage doesn't support scan, buffered value is synced before scan of next layer.
+func (c *layerCache) Scan(ctx context.Context, r ScanRange) (*ScanPage, error) {
+	if c.next == nil {
+		return scan(ctx, c.Storage, r)
+	}
+	cached := &ScanPage{}
+	if _, ok := c.Storage.(BackendStorageScan); ok {
+		page, err := scan(ctx, c.Storage, r)
+		if err != nil {
+			return nil, err
+		}
+		cached = page
+	} else if c.policy == WriteBack {
+		err := c.SyncContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	page, err := c.next.Scan(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	return mergePages(r, cached, page), nil
+}
+
+// GetVersion value and its version from next layer, and store the value.
+// Buffered value is synced before, so that the version is the latest.
+func (c *layerCache) GetVersion(ctx context.Context, key interface{}) (value interface{}, version string, err error) {
+	if c.next == nil {
+		storage, err := versionStorage(c.Storage)
+		if err != nil {
+			return nil, "", err
+		}
+		return storage.GetVersion(ctx, key)
+	}
+	err = c.syncWriteBack(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	var prev *freshEntry
+	if c.fresh != nil {
+		prev = c.fresh.get(key)
+	}
+	value, version, err = c.next.GetVersion(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+	return value, version, c.store(ctx, key, value, prev)
+}
+
+// SetIfAbsent set new value to next layer if the key doesn't exist, and then to Storage.
+// Storage is invalidated if it is failed.
+func (c *layerCache) SetIfAbsent(ctx context.Context, key interface{}, value interface{}) (version string, err error) {
+	return c.conditional(ctx, key, value, func(storage BackendStorageVersion) (string, error) {
+		return storage.AddIfAbsent(ctx, key, value)
+	}, func() (string, error) {
+		return c.next.SetIfAbsent(ctx, key, value)
+	})
+}
+
+// CompareAndSwap set new value to next layer if the version is matched, and then to Storage.
+// Storage is invalidated if it is failed.
+func (c *layerCache) CompareAndSwap(ctx context.Context, key interface{}, value interface{}, version string) (newVersion string, err error) {
+	return c.conditional(ctx, key, value, func(storage BackendStorageVersion) (string, error) {
+		return storage.AddIfVersion(ctx, key, value, version)
+	}, func() (string, error) {
+		return c.next.CompareAndSwap(ctx, key, value, version)
+	})
+}
+
+// RemoveIfVersion remove value of next layer if the version is matched, and Storage.
+func (c *layerCache) RemoveIfVersion(ctx context.Context, key interface{}, version string) (err error) {
+	_, err = c.conditional(ctx, key, nil, func(storage BackendStorageVersion) (string, error) {
+		return "", storage.RemoveIfVersion(ctx, key, version)
+	}, func() (string, error) {
+		return "", c.next.RemoveIfVersion(ctx, key, version)
+	})
+	return err
+}
+
+// conditional applies conditional operation to Storage if this is bottom layer,
+// or to next layer and update Storage by the result.
+// If value is nil or WritePolicy is WriteAround, the key is removed from Storage.
+func (c *layerCache) conditional(ctx context.Context, key interface{}, value interface{},
+	bottom func(storage BackendStorageVersion) (string, error), next func() (string, error)) (string, error) {
+	c.invalidate(key)
+	var version string
+	var err error
+	if c.next == nil {
+		storage, err := versionStorage(c.Storage)
+		if err != nil {
+			return "", err
+		}
+		version, err = bottom(storage)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		err = c.syncWriteBack(ctx)
+		if err != nil {
+			return "", err
+		}
+		version, err = next()
+		if err != nil || value == nil || c.policy == WriteAround {
+			// Drop the value, it may be conflicted
+			removeErr := remove(ctx, c.Storage, key)
+			if err != nil {
+				return "", err
+			}
+			if removeErr != nil {
+				return "", removeErr
+			}
+		} else {
+			err = add(ctx, c.Storage, key, value)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	if value == nil {
+		c.hub.notify(c, MessageRemove, key, nil)
+	} else {
+		c.hub.notify(c, MessageSet, key, value)
+	}
+	return version, nil
+}
+
+// commitTransaction commits the operations by next layer, and drops the keys from Storage.
+// Buffered value is synced before, so that the versions are validated against the latest.
+func (c *layerCache) commitTransaction(ctx context.Context, operations []*Message) error {
+	if c.next == nil {
+		return errors.New("bottom cache doesn't support transaction")
+	}
+	err := c.syncWriteBack(ctx)
+	if err != nil {
+		return err
+	}
+	err = commitTransaction(ctx, c.next, operations)
+	// Drop the keys even if it is failed, they may be partially applied
+	for _, op := range operations {
+		c.evict(op.Key)
+	}
+	if err != nil {
+		return err
+	}
+	for _, op := range operations {
+		c.hub.notify(c, op.Message, op.Key, op.Value)
+	}
 	return nil
 }
 
+// syncWriteBack syncs buffered value for WriteBack
+func (c *layerCache) syncWriteBack(ctx context.Context) error {
+	if c.policy != WriteBack {
+		return nil
+	}
+	return c.SyncContext(ctx)
+}
+
 // Sync current buffered value
+// It returns FlushErrors if any operations are failed to flush since the last Sync,
+// up to the latest 1000 errors.
 func (c *layerCache) Sync() error {
-	c.sync <- true
-	<-c.synced
-	return nil
+	return c.SyncContext(context.Background())
+}
+
+// SyncContext current buffered value
+func (c *layerCache) SyncContext(ctx context.Context) error {
+	return c.requestSync(ctx, nil)
+}
+
+// requestSync flushes buffered value, and returns FlushErrors of the keys, or all if keys is nil
+func (c *layerCache) requestSync(ctx context.Context, keys []interface{}) error {
+	r := syncRequest{ctx: ctx, keys: keys, done: make(chan error, 1)}
+	select {
+	case c.sync <- r:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-r.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Remove recursively remove next layer's value
 func (c *layerCache) Remove(key interface{}) (err error) {
-	err = c.Storage.Remove(key)
+	return c.RemoveContext(context.Background(), key)
+}
+
+// RemoveContext recursively remove next layer's value
+func (c *layerCache) RemoveContext(ctx context.Context, key interface{}) (err error) {
+	err = c.removeContext(ctx, key)
+	if err != nil {
+		return err
+	}
+	c.hub.notify(c, MessageRemove, key, nil)
+	return nil
+}
+
+func (c *layerCache) removeContext(ctx context.Context, key interface{}) (err error) {
+	if c.fresh != nil {
+		c.fresh.forget(key)
+	}
+	err = remove(ctx, c.Storage, key)
 	if err != nil {
 		return err
 	}
@@ -178,10 +1006,27 @@ func (c *layerCache) Remove(key interface{}) (err error) {
 		// This is bottom layer
 		return nil
 	}
+	if c.policy != WriteBack {
+		return c.next.RemoveContext(ctx, key)
+	}
 	// Queue to flush
-	c.log <- log{key, &Message{Value: nil, Message: MessageRemove}}
-	c.Sync() // Remove must be synced
-	return nil
+	err = c.enqueue(ctx, log{key: key, Message: &Message{Value: nil, Message: MessageRemove}})
+	if err != nil {
+		return err
+	}
+	// Remove must be synced, errors of other keys are left for Sync
+	return c.requestSync(ctx, []interface{}{key})
+}
+
+// evict drops the key from Storage, without applying to next Layer.
+// Buffered operation of the key is still flushed.
+func (c *layerCache) evict(key interface{}) {
+	c.invalidate(key)
+	c.Storage.Remove(key)
+}
+
+func (c *layerCache) setHub(h *watchHub) {
+	c.hub = h
 }
 
 // SetNext set next layer
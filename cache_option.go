@@ -0,0 +1,100 @@
+package transparent
+
+import "time"
+
+// CacheOption configures LayerCache
+type CacheOption func(c *layerCache)
+
+// WithFlushRetry sets retry count and initial backoff for failed flush.
+// Default is 3 times retry with 100 milliseconds backoff.
+func WithFlushRetry(retry int, backoff time.Duration) CacheOption {
+	return func(c *layerCache) {
+		c.retry = retry
+		c.backoff = backoff
+	}
+}
+
+// WithFlushErrorHandler sets the function called with the error of failed flush.
+// It is called from flusher goroutine, after all retries are failed.
+func WithFlushErrorHandler(handler func(err *FlushError)) CacheOption {
+	return func(c *layerCache) {
+		c.errorHandler = handler
+	}
+}
+
+// WritePolicy determines when LayerCache apply Set to next Layer
+type WritePolicy int
+
+// WritePolicy of LayerCache
+const (
+	// WriteBack set value to Storage, and asynchronously to next Layer
+	WriteBack WritePolicy = iota
+	// WriteThrough set value to next Layer, and then to Storage
+	WriteThrough
+	// WriteAround set value to next Layer only, Storage is filled by Get
+	WriteAround
+)
+
+// WithWritePolicy sets WritePolicy, default is WriteBack.
+func WithWritePolicy(policy WritePolicy) CacheOption {
+	return func(c *layerCache) {
+		c.policy = policy
+	}
+}
+
+// WithBatchSize sets the number of buffered operations for WriteBack,
+// they are flushed when more than size are buffered.
+// It must be positive, default is 5.
+func WithBatchSize(size int) CacheOption {
+	return func(c *layerCache) {
+		c.batchSize = size
+	}
+}
+
+// WithFlushInterval sets the duration of silence before flush for WriteBack.
+// It must be positive, default is 1 second.
+func WithFlushInterval(interval time.Duration) CacheOption {
+	return func(c *layerCache) {
+		c.interval = interval
+	}
+}
+
+// WithWriteAheadLog sets the file of write-ahead log for WriteBack.
+// Set and Remove are appended to the file before they return,
+// and replayed to next Layer by Stack.Start if they are not flushed.
+// Types of key and value must be registered by gob.Register before NewLayerCache.
+func WithWriteAheadLog(filename string) CacheOption {
+	return func(c *layerCache) {
+		c.walFilename = filename
+	}
+}
+
+// WithNegativeCache enables negative cache.
+// KeyNotFoundError from next Layer is remembered for ttl, so that Get of
+// the key returns KeyNotFoundError without asking next Layer.
+// It is forgotten by Set of the key to this Layer.
+func WithNegativeCache(ttl time.Duration) CacheOption {
+	return func(c *layerCache) {
+		c.negative = newNegativeCache(ttl)
+	}
+}
+
+// WithStaleWhileRevalidate enables stale-while-revalidate.
+// Value got from next Layer is stored with hard TTL, and after soft TTL,
+// Get returns the stale value and refresh it from next Layer in background.
+// Storage must implement BackendStorageTTL.
+func WithStaleWhileRevalidate(soft, hard time.Duration) CacheOption {
+	return func(c *layerCache) {
+		c.fresh = newFreshness(soft, hard)
+	}
+}
+
+// WithRefreshAhead enables refresh-ahead with stale-while-revalidate.
+// Value read at least hits times is refreshed in background,
+// when it is older than hard TTL minus ahead, even if it is not stale.
+func WithRefreshAhead(ahead time.Duration, hits int) CacheOption {
+	return func(c *layerCache) {
+		c.refreshAhead = ahead
+		c.refreshHits = hits
+	}
+}
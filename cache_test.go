@@ -0,0 +1,902 @@
+package transparent_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juntaki/transparent"
+	"github.com/juntaki/transparent/custom"
+	"github.com/juntaki/transparent/lru"
+	"github.com/juntaki/transparent/test"
+)
+
+// newFailingSource returns source layer, Add fails while fail is true
+func newFailingSource(t *testing.T, fail *bool) transparent.Layer {
+	ds := test.NewStorage(0)
+	cs, err := custom.NewStorage(ds.Get, func(k interface{}, v interface{}) error {
+		if *fail {
+			return errors.New("add failed")
+		}
+		return ds.Add(k, v)
+	}, ds.Remove)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := transparent.NewLayerSource(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+func TestCacheFlushError(t *testing.T) {
+	fail := true
+	handled := make(chan *transparent.FlushError, 1)
+	cache, err := transparent.NewLayerCache(10, lru.NewStorage(10),
+		transparent.WithFlushRetry(2, time.Millisecond),
+		transparent.WithFlushErrorHandler(func(err *transparent.FlushError) {
+			handled <- err
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stack := transparent.NewStack()
+	stack.Stack(newFailingSource(t, &fail))
+	stack.Stack(cache)
+	stack.Start()
+	defer stack.Stop()
+
+	err = stack.Set("key", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Remove of another key doesn't take the error of the key
+	err = stack.Remove("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stack.Sync()
+	flushErrs, ok := err.(transparent.FlushErrors)
+	if !ok || len(flushErrs) != 1 || flushErrs[0].Key != "key" {
+		t.Fatal(err)
+	}
+	select {
+	case flushErr := <-handled:
+		if flushErr.Message != transparent.MessageSet {
+			t.Error(flushErr)
+		}
+	default:
+		t.Error("handler is not called")
+	}
+
+	// Errors are reported only once
+	fail = false
+	err = stack.Set("key", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stack.Sync()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCacheWritePolicy(t *testing.T) {
+	for _, policy := range []transparent.WritePolicy{
+		transparent.WriteBack,
+		transparent.WriteThrough,
+		transparent.WriteAround,
+	} {
+		storage := lru.NewStorage(10)
+		cache, err := transparent.NewLayerCache(10, storage,
+			transparent.WithWritePolicy(policy),
+			transparent.WithFlushInterval(10*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		source := test.NewSource(0)
+		stack := transparent.NewStack()
+		stack.Stack(source)
+		stack.Stack(cache)
+		stack.Start()
+
+		err = stack.Set("key", []byte("value"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if policy == transparent.WriteBack {
+			// Wait for flush by interval
+			time.Sleep(100 * time.Millisecond)
+		}
+		value, err := source.Get("key")
+		if err != nil || string(value.([]byte)) != "value" {
+			t.Error(policy, err, value)
+		}
+		_, err = storage.Get("key")
+		if policy == transparent.WriteAround {
+			if _, ok := err.(*transparent.KeyNotFoundError); !ok {
+				t.Error(policy, err)
+			}
+		} else if err != nil {
+			t.Error(policy, err)
+		}
+
+		test.BasicStackFunc(t, stack)
+		stack.Stop()
+	}
+}
+
+func TestCacheInvalidOption(t *testing.T) {
+	for _, option := range []transparent.CacheOption{
+		transparent.WithBatchSize(0),
+		transparent.WithFlushInterval(0),
+	} {
+		_, err := transparent.NewLayerCache(10, lru.NewStorage(10), option)
+		if err == nil {
+			t.Error("invalid option is accepted")
+		}
+	}
+}
+
+func TestCacheWriteAheadLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transparent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "wal")
+
+	// Crash before flush, flusher is not started
+	cache, err := transparent.NewLayerCache(10, lru.NewStorage(10),
+		transparent.WithWriteAheadLog(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stack := transparent.NewStack()
+	stack.Stack(test.NewSource(0))
+	stack.Stack(cache)
+	err = stack.Set("key1", []byte("value1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stack.Set("key2", []byte("value2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restart, buffered value is replayed
+	cache, err = transparent.NewLayerCache(10, lru.NewStorage(10),
+		transparent.WithWriteAheadLog(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := test.NewSource(0)
+	stack = transparent.NewStack()
+	stack.Stack(source)
+	stack.Stack(cache)
+	err = stack.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key1", "key2"} {
+		value, err := source.Get(key)
+		if err != nil {
+			t.Error(key, err)
+		} else if string(value.([]byte)) != "value"+key[3:] {
+			t.Error(key, value)
+		}
+	}
+
+	// Log is truncated after flush
+	err = stack.Set("key3", []byte("value3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stack.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filename)
+	if err != nil || info.Size() != 0 {
+		t.Error(err, info)
+	}
+	stack.Stop()
+}
+
+// blockingStorage blocks Add of key "blocked" until release is closed
+type blockingStorage struct {
+	transparent.BackendStorage
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStorage) Add(k interface{}, v interface{}) error {
+	if k == "blocked" {
+		close(s.entered)
+		<-s.release
+	}
+	return s.BackendStorage.Add(k, v)
+}
+
+func TestCacheWriteAheadLogCommit(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "wal")
+	storage := &blockingStorage{
+		BackendStorage: test.NewStorage(0),
+		entered:        make(chan struct{}),
+		release:        make(chan struct{}),
+	}
+	source, err := transparent.NewLayerSource(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := transparent.NewLayerCache(10, lru.NewStorage(10),
+		transparent.WithWriteAheadLog(filename), transparent.WithFlushInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stack := transparent.NewStack()
+	stack.Stack(source)
+	stack.Stack(cache)
+	err = stack.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Written while flush is blocked, it is pending when the flush is committed
+	err = stack.Set("blocked", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	synced := make(chan error)
+	go func() { synced <- stack.Sync() }()
+	<-storage.entered
+	err = stack.Set("pending", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(storage.release)
+	err = <-synced
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Crash, only the pending value is replayed
+	cache, err = transparent.NewLayerCache(10, lru.NewStorage(10),
+		transparent.WithWriteAheadLog(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := test.NewSource(0)
+	stack = transparent.NewStack()
+	stack.Stack(replayed)
+	stack.Stack(cache)
+	err = stack.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stack.Stop()
+	_, err = replayed.Get("pending")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = replayed.Get("blocked")
+	if _, ok := err.(*transparent.KeyNotFoundError); !ok {
+		t.Error("committed value is replayed", err)
+	}
+}
+
+func TestCacheWriteAheadLogCancel(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "wal")
+
+	// Flusher is not started, the second Set waits for room of the buffer
+	cache, err := transparent.NewLayerCache(1, lru.NewStorage(10),
+		transparent.WithWriteAheadLog(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stack := transparent.NewStack()
+	stack.Stack(test.NewSource(0))
+	stack.Stack(cache)
+	err = stack.Set("key1", []byte("value1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = stack.SetContext(ctx, "key2", []byte("value2"))
+	if err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+
+	// Restart, canceled Set is not replayed
+	cache, err = transparent.NewLayerCache(10, lru.NewStorage(10),
+		transparent.WithWriteAheadLog(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := test.NewSource(0)
+	stack = transparent.NewStack()
+	stack.Stack(source)
+	stack.Stack(cache)
+	err = stack.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stack.Stop()
+	_, err = source.Get("key1")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = source.Get("key2")
+	if _, ok := err.(*transparent.KeyNotFoundError); !ok {
+		t.Error("canceled Set is replayed", err)
+	}
+}
+
+// countingSource is source layer, which counts Get
+type countingSource struct {
+	transparent.Layer
+	storage transparent.BackendStorage
+	lock    sync.Mutex
+	fetched int
+}
+
+func newCountingSource(t *testing.T, wait time.Duration) *countingSource {
+	c := &countingSource{storage: test.NewStorage(wait)}
+	cs, err := custom.NewStorage(func(k interface{}) (interface{}, error) {
+		c.lock.Lock()
+		c.fetched++
+		c.lock.Unlock()
+		return c.storage.Get(k)
+	}, c.storage.Add, c.storage.Remove)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Layer, err = transparent.NewLayerSource(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func (c *countingSource) count() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.fetched
+}
+
+func TestCacheCoalesce(t *testing.T) {
+	source := newCountingSource(t, 50)
+	ds := source.storage
+	cache, err := transparent.NewLayerCache(10, lru.NewStorage(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := transparent.NewStack()
+	s.Stack(source)
+	s.Stack(cache)
+	s.Start()
+	defer s.Stop()
+
+	ds.Add("key", "value")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := s.Get("key")
+			if err != nil || value != "value" {
+				t.Error(value, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if source.count() != 1 {
+		t.Error("fetched", source.count())
+	}
+	stats, err := transparent.GetCacheStats(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Miss != 10 || stats.Coalesced != 9 {
+		t.Error(stats)
+	}
+}
+
+func TestCacheStorageError(t *testing.T) {
+	source := newCountingSource(t, 0)
+	ls := lru.NewStorage(10)
+	fail := true
+	storage, err := custom.NewStorage(func(k interface{}) (interface{}, error) {
+		if fail {
+			return nil, errors.New("get failed")
+		}
+		return ls.Get(k)
+	}, ls.Add, ls.Remove)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := transparent.NewLayerCache(10, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := transparent.NewStack()
+	s.Stack(source)
+	s.Stack(cache)
+	s.Start()
+	defer s.Stop()
+
+	// Failure of cache storage is returned, not fetched from next layer
+	source.storage.Add("key", "value")
+	_, err = s.Get("key")
+	if err == nil || err.Error() != "get failed" {
+		t.Error(err)
+	}
+	if source.count() != 0 {
+		t.Error("fetched", source.count())
+	}
+	fail = false
+	value, err := s.Get("key")
+	if err != nil || value != "value" || source.count() != 1 {
+		t.Error(value, err, source.count())
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	source := newCountingSource(t, 0)
+	cache, err := transparent.NewLayerCache(10, lru.NewStorage(10),
+		transparent.WithNegativeCache(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := transparent.NewStack()
+	s.Stack(source)
+	s.Stack(cache)
+	s.Start()
+	defer s.Stop()
+
+	for i := 0; i < 3; i++ {
+		_, err = s.Get("key")
+		if _, ok := err.(*transparent.KeyNotFoundError); !ok {
+			t.Fatal(err)
+		}
+	}
+	if source.count() != 1 {
+		t.Error("fetched", source.count())
+	}
+	stats, err := transparent.GetCacheStats(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Negative != 2 {
+		t.Error(stats)
+	}
+
+	// Expired
+	time.Sleep(200 * time.Millisecond)
+	_, err = s.Get("key")
+	if _, ok := err.(*transparent.KeyNotFoundError); !ok {
+		t.Fatal(err)
+	}
+	if source.count() != 2 {
+		t.Error("fetched", source.count())
+	}
+
+	// Invalidated by Set
+	err = s.Set("key", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := s.Get("key")
+	if err != nil || value != "value" {
+		t.Error(value, err)
+	}
+}
+
+// waitFor polls cond until it is true, or fail after 1 second
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timeout")
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	source := newCountingSource(t, 0)
+	cache, err := transparent.NewLayerCache(10, lru.NewStorage(10),
+		transparent.WithStaleWhileRevalidate(50*time.Millisecond, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := transparent.NewStack()
+	s.Stack(source)
+	s.Stack(cache)
+	s.Start()
+	defer s.Stop()
+
+	source.storage.Add("key", "old")
+	value, err := s.Get("key")
+	if err != nil || value != "old" {
+		t.Fatal(value, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	source.storage.Add("key", "new")
+
+	// Stale value is returned, and refreshed in background
+	value, err = s.Get("key")
+	if err != nil || value != "old" {
+		t.Fatal(value, err)
+	}
+	waitFor(t, func() bool {
+		value, err := s.Get("key")
+		return err == nil && value == "new"
+	})
+	stats, err := transparent.GetCacheStats(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Stale == 0 || stats.Refresh != 1 || source.count() != 2 {
+		t.Error(stats, source.count())
+	}
+}
+
+func TestCacheStaleGetVersion(t *testing.T) {
+	storage := test.NewStorage(0)
+	source, err := transparent.NewLayerSource(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := transparent.NewLayerCache(10, lru.NewStorage(10),
+		transparent.WithStaleWhileRevalidate(50*time.Millisecond, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := transparent.NewStack()
+	s.Stack(source)
+	s.Stack(cache)
+	s.Start()
+	defer s.Stop()
+
+	// Value got with version is also refreshed after soft TTL
+	storage.Add("key", "old")
+	value, _, err := s.GetVersion(context.Background(), "key")
+	if err != nil || value != "old" {
+		t.Fatal(value, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	storage.Add("key", "new")
+	waitFor(t, func() bool {
+		value, err := s.Get("key")
+		return err == nil && value == "new"
+	})
+}
+
+func TestCacheRefreshAhead(t *testing.T) {
+	source := newCountingSource(t, 0)
+	cache, err := transparent.NewLayerCache(10, lru.NewStorage(10),
+		transparent.WithStaleWhileRevalidate(time.Second, time.Second),
+		transparent.WithRefreshAhead(900*time.Millisecond, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := transparent.NewStack()
+	s.Stack(source)
+	s.Stack(cache)
+	s.Start()
+	defer s.Stop()
+
+	source.storage.Add("key", "old")
+	_, err = s.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	source.storage.Add("key", "new")
+
+	// Hot value is refreshed before it is stale
+	for i := 0; i < 2; i++ {
+		_, err = s.Get("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool {
+		value, err := s.Get("key")
+		return err == nil && value == "new"
+	})
+	stats, err := transparent.GetCacheStats(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Stale != 0 || stats.Refresh != 1 {
+		t.Error(stats)
+	}
+
+	_, err = transparent.NewLayerCache(10, lru.NewStorage(10),
+		transparent.WithRefreshAhead(time.Second, 2))
+	if err == nil {
+		t.Error("refresh-ahead without stale-while-revalidate must fail")
+	}
+}
+
+// slowStorage blocks AddWithTTL of key "slow" until release is closed
+type slowStorage struct {
+	transparent.BackendStorageTTL
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *slowStorage) AddWithTTL(ctx context.Context, k interface{}, v interface{}, ttl time.Duration) error {
+	if k == "slow" {
+		close(s.entered)
+		<-s.release
+	}
+	return s.BackendStorageTTL.AddWithTTL(ctx, k, v, ttl)
+}
+
+func TestCacheFillConcurrency(t *testing.T) {
+	source := newCountingSource(t, 0)
+	storage := &slowStorage{
+		BackendStorageTTL: lru.NewStorage(10).(transparent.BackendStorageTTL),
+		entered:           make(chan struct{}),
+		release:           make(chan struct{}),
+	}
+	cache, err := transparent.NewLayerCache(10, storage,
+		transparent.WithStaleWhileRevalidate(time.Second, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := transparent.NewStack()
+	s.Stack(source)
+	s.Stack(cache)
+	s.Start()
+	defer s.Stop()
+
+	source.storage.Add("slow", "value")
+	source.storage.Add("fast", "value")
+	slow := make(chan error, 1)
+	go func() {
+		_, err := s.Get("slow")
+		slow <- err
+	}()
+	<-storage.entered
+
+	// Fill of other key is not blocked by slow Storage
+	fast := make(chan error, 1)
+	go func() {
+		_, err := s.Get("fast")
+		fast <- err
+	}()
+	select {
+	case err := <-fast:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("fill is blocked by other key")
+	}
+	close(storage.release)
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// multiStorage counts AddMulti
+type multiStorage struct {
+	transparent.BackendStorageMulti
+	lock  sync.Mutex
+	calls int
+}
+
+func (m *multiStorage) AddMulti(ctx context.Context, values map[interface{}]interface{}) error {
+	m.lock.Lock()
+	m.calls++
+	m.lock.Unlock()
+	return m.BackendStorageMulti.AddMulti(ctx, values)
+}
+
+func TestCacheFlushMulti(t *testing.T) {
+	storage := &multiStorage{
+		BackendStorageMulti: transparent.NewBackendStorageMulti(test.NewStorage(0)),
+	}
+	source, err := transparent.NewLayerSource(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := transparent.NewLayerCache(10, lru.NewStorage(10),
+		transparent.WithBatchSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := transparent.NewStack()
+	s.Stack(source)
+	s.Stack(cache)
+	s.Start()
+	defer s.Stop()
+
+	for _, key := range []string{"a", "b", "c"} {
+		err = s.Set(key, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage.calls != 1 {
+		t.Error("flushed by", storage.calls)
+	}
+	values, err := source.GetMulti(context.Background(), []interface{}{"a", "b", "c"})
+	if err != nil || len(values) != 3 {
+		t.Error(values, err)
+	}
+}
+
+func TestCacheBatchSize(t *testing.T) {
+	storage := test.NewStorage(0)
+	source, err := transparent.NewLayerSource(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := transparent.NewLayerCache(10, lru.NewStorage(10),
+		transparent.WithBatchSize(2), transparent.WithFlushInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := transparent.NewStack()
+	s.Stack(source)
+	s.Stack(cache)
+	s.Start()
+	defer s.Stop()
+
+	// Flushed when more than batch size are buffered
+	s.Set("a", "value")
+	s.Set("b", "value")
+	time.Sleep(50 * time.Millisecond)
+	if _, err := storage.Get("a"); err == nil {
+		t.Error("flushed at batch size")
+	}
+	s.Set("c", "value")
+	waitFor(t, func() bool {
+		_, err := storage.Get("a")
+		return err == nil
+	})
+}
+
+func TestCacheScan(t *testing.T) {
+	storage := test.NewStorage(0)
+	source, err := transparent.NewLayerSource(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := transparent.NewLayerCache(10, lru.NewStorage(10),
+		transparent.WithBatchSize(10), transparent.WithFlushInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := transparent.NewStack()
+	s.Stack(source)
+	s.Stack(cache)
+	s.Start()
+	defer s.Stop()
+
+	// b is not flushed to source yet
+	storage.Add("a", "value")
+	storage.Add("c", "value")
+	err = s.Set("b", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scanned := []string{}
+	it := s.Iterate(context.Background(), transparent.ScanRange{Limit: 1})
+	for it.Next() {
+		scanned = append(scanned, it.Key())
+	}
+	if it.Err() != nil || !reflect.DeepEqual(scanned, []string{"a", "b", "c"}) {
+		t.Error(it.Err(), scanned)
+	}
+}
+
+func TestCacheCompareAndSwap(t *testing.T) {
+	storage := test.NewStorage(0)
+	source, err := transparent.NewLayerSource(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := transparent.NewLayerCache(10, lru.NewStorage(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := transparent.NewStack()
+	s.Stack(source)
+	s.Stack(cache)
+	s.Start()
+	defer s.Stop()
+
+	ctx := context.Background()
+	version, err := s.SetIfAbsent(ctx, "key", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another writer changes source, cache has old value
+	storage.Add("key", "b")
+	value, err := s.Get("key")
+	if err != nil || value != "a" {
+		t.Fatal(value, err)
+	}
+
+	// Conflict invalidates cache
+	_, err = s.CompareAndSwap(ctx, "key", "c", version)
+	if _, ok := err.(*transparent.VersionConflictError); !ok {
+		t.Fatal(err)
+	}
+	value, err = s.Get("key")
+	if err != nil || value != "b" {
+		t.Fatal(value, err)
+	}
+
+	_, version, err = s.GetVersion(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.CompareAndSwap(ctx, "key", "c", version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err = storage.Get("key")
+	if err != nil || value != "c" {
+		t.Error(value, err)
+	}
+}
+
+func TestCacheCompareAndSwapWriteAround(t *testing.T) {
+	source, err := transparent.NewLayerSource(test.NewStorage(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := lru.NewStorage(10)
+	cache, err := transparent.NewLayerCache(10, storage,
+		transparent.WithWritePolicy(transparent.WriteAround))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := transparent.NewStack()
+	s.Stack(source)
+	s.Stack(cache)
+	s.Start()
+	defer s.Stop()
+
+	// Written value is not stored to cache
+	ctx := context.Background()
+	version, err := s.SetIfAbsent(ctx, "key", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Get("key"); err == nil {
+		t.Error("SetIfAbsent stores to cache")
+	}
+	_, err = s.CompareAndSwap(ctx, "key", "b", version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Get("key"); err == nil {
+		t.Error("CompareAndSwap stores to cache")
+	}
+	value, err := s.Get("key")
+	if err != nil || value != "b" {
+		t.Error(value, err)
+	}
+}
@@ -1,8 +1,11 @@
 package transparent
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"sync"
+	"time"
 
 	uuid "github.com/satori/go.uuid"
 )
@@ -10,7 +13,7 @@ import (
 // NewLayerConsensus returns LayerConsensus.
 // LayerConsensus wraps BackendTransmitter.
 // It send Set operation and key-value to multiple Stacks asynchronously
-// and Get key-value from Next Layer.
+// and Get key-value from Next Layer, which is confirmed by cluster if ReadMode is not ReadLocal.
 // It must be Stacked on a Layer.
 //
 //    User program A       User program B
@@ -23,132 +26,470 @@ import (
 func NewLayerConsensus(t BackendTransmitter) (Layer, error) {
 	c := &layerConsensus{
 		inFlight:    make(map[string]chan error),
+		locked:      make(map[interface{}]string),
+		versions:    make(map[interface{}]string),
 		Transmitter: t,
 	}
 	err := t.SetCallback(c.commit)
 	if err != nil {
 		return nil, err
 	}
+	if tp, ok := t.(BackendTransmitterPrepare); ok {
+		err = tp.SetPrepareCallback(c.prepare)
+		if err != nil {
+			return nil, err
+		}
+		err = tp.SetAbortCallback(c.abort)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return c, nil
 }
 
+// KeyLockedError means the key is prepared by another operation, which is not committed yet
+type KeyLockedError struct {
+	Key interface{}
+}
+
+func (e *KeyLockedError) Error() string {
+	return fmt.Sprintf("key %v is locked by another operation", e.Key)
+}
+
+// initialVersion is version of the key whose last write is unknown to this node.
+// Raft rebuilds versions from snapshot and log after restart, but participant of twopc doesn't,
+// so that it votes abort for conditional write of the key until the key is written again.
+const initialVersion = "initial"
+
 type layerConsensus struct {
 	lock        sync.Mutex
+	applying    sync.RWMutex // Held while committed operation is applied, so that value and version are read together
 	inFlight    map[string]chan error
+	locked      map[interface{}]string // UUID of prepared operation by key
+	versions    map[interface{}]string // UUID of the last committed write by key, which is replicated in the log
+	readMode    ReadMode
 	next        Layer
 	Transmitter BackendTransmitter
 }
 
 // Set send a request to cluster
 func (d *layerConsensus) Set(key interface{}, value interface{}) (err error) {
-	// We will check which message is commited by UUID
-	uuid := uuid.NewV4().String()
-	channel := make(chan error)
-	d.lock.Lock()
-	d.inFlight[uuid] = channel
-	d.lock.Unlock()
+	return d.SetContext(context.Background(), key, value)
+}
+
+// SetContext send a request to cluster
+func (d *layerConsensus) SetContext(ctx context.Context, key interface{}, value interface{}) (err error) {
 	operation := &Message{
 		Key:     key,
 		Value:   value,
 		Message: MessageSet,
-		UUID:    uuid,
 	}
-	_, err = d.Transmitter.Request(operation)
+	return d.propose(ctx, operation)
+}
+
+// SetWithTTL send a request to cluster, the key expires after ttl
+func (d *layerConsensus) SetWithTTL(ctx context.Context, key interface{}, value interface{}, ttl time.Duration) (err error) {
+	expire, err := ExpireAt(ttl)
 	if err != nil {
 		return err
 	}
-	err = <-channel
-	d.lock.Lock()
-	delete(d.inFlight, uuid)
-	d.lock.Unlock()
-	return err
+	operation := &Message{
+		Key:     key,
+		Value:   value,
+		Message: MessageSet,
+		Expire:  expire,
+	}
+	return d.propose(ctx, operation)
 }
 
-// Get just get the value from next layer
+// Get get the value from next layer by ReadMode
 func (d *layerConsensus) Get(key interface{}) (value interface{}, err error) {
+	return d.GetContext(context.Background(), key)
+}
+
+// GetContext get the value from next layer by ReadMode
+func (d *layerConsensus) GetContext(ctx context.Context, key interface{}) (value interface{}, err error) {
 	// Recursively get value from list.
 	if d.next == nil {
 		return nil, errors.New("next layer not found")
 	}
-	value, err = d.next.Get(key)
+	err = d.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	value, err = d.next.GetContext(ctx, key)
 	if err != nil {
 		return nil, err
 	}
 	return value, nil
 }
 
+// GetMulti get the values from next layer by ReadMode
+func (d *layerConsensus) GetMulti(ctx context.Context, keys []interface{}) (map[interface{}]interface{}, error) {
+	if d.next == nil {
+		return nil, errors.New("next layer not found")
+	}
+	err := d.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return d.next.GetMulti(ctx, keys)
+}
+
+// SetMulti send a request of each key to cluster
+func (d *layerConsensus) SetMulti(ctx context.Context, values map[interface{}]interface{}) error {
+	return setEach(ctx, d, values)
+}
+
+// RemoveMulti send a request of each key to cluster
+func (d *layerConsensus) RemoveMulti(ctx context.Context, keys []interface{}) error {
+	return removeEach(ctx, d, keys)
+}
+
+// Scan scan keys in next layer by ReadMode
+func (d *layerConsensus) Scan(ctx context.Context, r ScanRange) (*ScanPage, error) {
+	if d.next == nil {
+		return nil, errors.New("next layer not found")
+	}
+	err := d.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return d.next.Scan(ctx, r)
+}
+
+// GetVersion get the value from next layer by ReadMode, and its version replicated by cluster.
+// Version of next layer is not used, because it is different on each node.
+func (d *layerConsensus) GetVersion(ctx context.Context, key interface{}) (interface{}, string, error) {
+	if d.next == nil {
+		return nil, "", errors.New("next layer not found")
+	}
+	err := d.read(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	d.applying.RLock()
+	defer d.applying.RUnlock()
+	return d.version(ctx, key)
+}
+
+// version returns the value and its replicated version
+func (d *layerConsensus) version(ctx context.Context, key interface{}) (interface{}, string, error) {
+	value, err := d.next.GetContext(ctx, key)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := err.(*KeyNotFoundError); ok {
+		// Expired key is forgotten, versions has at most an entry per existing key
+		delete(d.versions, key)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	version, ok := d.versions[key]
+	if !ok {
+		version = initialVersion
+	}
+	return value, version, nil
+}
+
+// validate checks versions of conditional writes against replicated versions,
+// so that all nodes get the same result
+func (d *layerConsensus) validate(operations []*Message) error {
+	for _, op := range operations {
+		if op.Version == "" {
+			continue
+		}
+		_, version, err := d.version(context.Background(), op.Key)
+		if _, ok := err.(*KeyNotFoundError); ok || (err == nil && version != op.Version) {
+			return &VersionConflictError{Key: op.Key}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// written updates replicated versions of the keys written by the operation
+func (d *layerConsensus) written(op *Message) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	writes := []*Message{op}
+	if op.Message == MessageTransaction {
+		writes = op.Batch
+	}
+	for _, w := range writes {
+		switch {
+		case w.Message == MessageSet && op.UUID != "":
+			d.versions[w.Key] = op.UUID
+		case w.Message == MessageSet, w.Message == MessageRemove:
+			// Set without UUID is not proposed by any node, its version is unknown
+			delete(d.versions, w.Key)
+		}
+	}
+}
+
+// SetIfAbsent is not supported, the result of cluster is not returned
+func (d *layerConsensus) SetIfAbsent(ctx context.Context, key interface{}, value interface{}) (string, error) {
+	return "", errors.New("consensus doesn't support conditional write")
+}
+
+// CompareAndSwap is not supported, the result of cluster is not returned
+func (d *layerConsensus) CompareAndSwap(ctx context.Context, key interface{}, value interface{}, version string) (string, error) {
+	return "", errors.New("consensus doesn't support conditional write")
+}
+
+// RemoveIfVersion is not supported, the result of cluster is not returned
+func (d *layerConsensus) RemoveIfVersion(ctx context.Context, key interface{}, version string) error {
+	return errors.New("consensus doesn't support conditional write")
+}
+
 // Remove send a request to cluster
 func (d *layerConsensus) Remove(key interface{}) (err error) {
-	uuid := uuid.NewV4().String()
-	channel := make(chan error)
-	d.lock.Lock()
-	d.inFlight[uuid] = channel
-	d.lock.Unlock()
+	return d.RemoveContext(context.Background(), key)
+}
+
+// RemoveContext send a request to cluster
+func (d *layerConsensus) RemoveContext(ctx context.Context, key interface{}) (err error) {
 	operation := &Message{
 		Key:     key,
 		Value:   nil,
 		Message: MessageRemove,
-		UUID:    uuid,
-	}
-	_, err = d.Transmitter.Request(operation)
-	if err != nil {
-		return err
 	}
-	err = <-channel
-	d.lock.Lock()
-	delete(d.inFlight, uuid)
-	d.lock.Unlock()
-	return err
+	return d.propose(ctx, operation)
 }
 
 // Sync send a request to cluster
 func (d *layerConsensus) Sync() (err error) {
-	uuid := uuid.NewV4().String()
-	channel := make(chan error)
-	d.lock.Lock()
-	d.inFlight[uuid] = channel
-	d.lock.Unlock()
+	return d.SyncContext(context.Background())
+}
+
+// SyncContext send a request to cluster
+func (d *layerConsensus) SyncContext(ctx context.Context) (err error) {
 	operation := &Message{
 		Key:     nil,
 		Value:   nil,
 		Message: MessageSync,
-		UUID:    uuid,
 	}
-	_, err = d.Transmitter.Request(operation)
-	if err != nil {
-		return err
+	return d.propose(ctx, operation)
+}
+
+// read waits until the next layer can be read by ReadMode of the context or Stack
+func (d *layerConsensus) read(ctx context.Context) error {
+	d.lock.Lock()
+	mode := readModeOf(ctx, d.readMode)
+	d.lock.Unlock()
+	if mode == ReadLocal {
+		return nil
+	}
+	r, ok := d.Transmitter.(BackendTransmitterRead)
+	if !ok {
+		return errors.New("transmitter doesn't support linearizable read")
 	}
-	err = <-channel
+	if mode == ReadLease {
+		return r.ReadLease(ctx)
+	}
+	return r.ReadIndex(ctx)
+}
+
+func (d *layerConsensus) setReadMode(mode ReadMode) {
+	d.lock.Lock()
+	d.readMode = mode
+	d.lock.Unlock()
+}
+
+// commitTransaction send the operations to cluster, they are applied atomically
+func (d *layerConsensus) commitTransaction(ctx context.Context, operations []*Message) error {
+	operation := &Message{
+		Message: MessageTransaction,
+		Batch:   operations,
+	}
+	return d.propose(ctx, operation)
+}
+
+// propose send the operation and wait until it is commited
+func (d *layerConsensus) propose(ctx context.Context, operation *Message) (err error) {
+	// We will check which message is commited by UUID
+	operation.UUID = uuid.NewV4().String()
+	channel := make(chan error, 1)
 	d.lock.Lock()
-	delete(d.inFlight, uuid)
+	d.inFlight[operation.UUID] = channel
 	d.lock.Unlock()
-	return err
+	defer func() {
+		d.lock.Lock()
+		delete(d.inFlight, operation.UUID)
+		d.lock.Unlock()
+	}()
+	_, err = request(ctx, d.Transmitter, operation)
+	if err != nil {
+		select {
+		case e := <-channel:
+			// Rejected by this node, the reason is more specific
+			if e != nil {
+				return e
+			}
+		default:
+		}
+		return err
+	}
+	select {
+	case err = <-channel:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // commit is callback function to apply operation
 func (d *layerConsensus) commit(op *Message) (res *Message, err error) {
+	if op.Message == MessageBatch {
+		// Operations batched by BackendTransmitter are applied in order
+		for _, o := range op.Batch {
+			_, e := d.commit(o)
+			if err == nil {
+				err = e
+			}
+		}
+		return nil, err
+	}
+	defer d.unlock(op)
 	err = nil
 	key := op.Key
 	if d.next == nil {
 		err = errors.New("next layer not found")
 	}
+	d.applying.Lock()
 	switch op.Message {
 	case MessageSync:
 		err = d.next.Sync()
-	case MessageRemove:
-		err = d.next.Remove(key)
-	case MessageSet:
-		err = d.next.Set(key, op.Value)
+	case MessageRemove, MessageSet:
+		err = apply(context.Background(), d.next, key, op)
+	case MessageTransaction:
+		// Transaction is validated by prepare, if the transmitter has the phase
+		if _, ok := d.Transmitter.(BackendTransmitterPrepare); !ok {
+			err = d.validate(op.Batch)
+		}
+		if err == nil {
+			err = applyTransaction(context.Background(), d.next, op.Batch)
+		}
 	default:
 		err = errors.New("unknown message")
 	}
+	if err == nil {
+		d.written(op)
+	}
+	d.applying.Unlock()
+	d.reply(op.UUID, err)
+	return nil, err
+}
+
+// prepare is callback function to lock the keys and validate transaction before commit.
+// The error is returned to the proposer, because the operation is never committed.
+func (d *layerConsensus) prepare(op *Message) (err error) {
+	if op.Message == MessageBatch {
+		return d.prepareBatch(op)
+	}
+	defer func() {
+		if err != nil {
+			d.unlock(op)
+			d.reply(op.UUID, err)
+		}
+	}()
+	err = d.lockKeys(op)
+	if err != nil {
+		return err
+	}
+	if op.Message != MessageTransaction {
+		return nil
+	}
+	if d.next == nil {
+		return errors.New("next layer not found")
+	}
+	return d.validate(op.Batch)
+}
+
+// prepareBatch prepares all operations in the batch, they are aborted together if any is failed
+func (d *layerConsensus) prepareBatch(op *Message) error {
+	for i, o := range op.Batch {
+		err := d.prepare(o)
+		if err != nil {
+			for _, prepared := range op.Batch[:i] {
+				d.abort(prepared)
+			}
+			for _, rest := range op.Batch[i+1:] {
+				d.reply(rest.UUID, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// abort is callback function to release the prepared operation
+func (d *layerConsensus) abort(op *Message) {
+	if op.Message == MessageBatch {
+		for _, o := range op.Batch {
+			d.abort(o)
+		}
+		return
+	}
+	// The requester is told the decision by BackendTransmitter
+	d.unlock(op)
+}
+
+// lockKeys locks all keys written by the operation, until it is committed or aborted
+func (d *layerConsensus) lockKeys(op *Message) error {
+	keys := writtenKeys(op)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, key := range keys {
+		if uuid, ok := d.locked[key]; ok && uuid != op.UUID {
+			return &KeyLockedError{Key: key}
+		}
+	}
+	for _, key := range keys {
+		d.locked[key] = op.UUID
+	}
+	return nil
+}
+
+// unlock releases the keys locked by the operation
+func (d *layerConsensus) unlock(op *Message) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, key := range writtenKeys(op) {
+		if d.locked[key] == op.UUID {
+			delete(d.locked, key)
+		}
+	}
+}
+
+// writtenKeys returns keys of Set and Remove in the operation
+func writtenKeys(op *Message) []interface{} {
+	switch op.Message {
+	case MessageSet, MessageRemove:
+		return []interface{}{op.Key}
+	case MessageTransaction:
+		keys := []interface{}{}
+		for _, o := range op.Batch {
+			keys = append(keys, o.Key)
+		}
+		return keys
+	}
+	return nil
+}
+
+// reply the result to the proposer of the operation, if it is this node
+func (d *layerConsensus) reply(uuid string, err error) {
 	d.lock.Lock()
-	channel, ok := d.inFlight[op.UUID]
+	channel, ok := d.inFlight[uuid]
 	d.lock.Unlock()
 	if ok {
-		channel <- err
+		select {
+		case channel <- err:
+		default:
+		}
 	}
-	return nil, err
 }
 
 func (d *layerConsensus) setNext(next Layer) error {
@@ -1,15 +1,16 @@
 package custom
 
 import (
+	"context"
 	"errors"
 
 	"github.com/juntaki/transparent"
 )
 
 type storage struct {
-	getFunc    func(k interface{}) (interface{}, error)
-	addFunc    func(k interface{}, v interface{}) error
-	removeFunc func(k interface{}) error
+	getFunc    func(ctx context.Context, k interface{}) (interface{}, error)
+	addFunc    func(ctx context.Context, k interface{}, v interface{}) error
+	removeFunc func(ctx context.Context, k interface{}) error
 }
 
 // NewStorage returns Storage
@@ -17,6 +18,37 @@ func NewStorage(
 	getFunc func(k interface{}) (interface{}, error),
 	addFunc func(k interface{}, v interface{}) error,
 	removeFunc func(k interface{}) error,
+) (transparent.BackendStorage, error) {
+	if getFunc == nil || addFunc == nil || removeFunc == nil {
+		return nil, errors.New("function must be filled")
+	}
+	return &storage{
+		getFunc: func(ctx context.Context, k interface{}) (interface{}, error) {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return getFunc(k)
+		},
+		addFunc: func(ctx context.Context, k interface{}, v interface{}) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return addFunc(k, v)
+		},
+		removeFunc: func(ctx context.Context, k interface{}) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return removeFunc(k)
+		},
+	}, nil
+}
+
+// NewContextStorage returns Storage, its functions accept context.Context
+func NewContextStorage(
+	getFunc func(ctx context.Context, k interface{}) (interface{}, error),
+	addFunc func(ctx context.Context, k interface{}, v interface{}) error,
+	removeFunc func(ctx context.Context, k interface{}) error,
 ) (transparent.BackendStorage, error) {
 	if getFunc == nil || addFunc == nil || removeFunc == nil {
 		return nil, errors.New("function must be filled")
@@ -30,15 +62,30 @@ func NewStorage(
 
 // Get is customizable get function
 func (c *storage) Get(k interface{}) (interface{}, error) {
-	return c.getFunc(k)
+	return c.getFunc(context.Background(), k)
 }
 
 // Add is customizable add function
 func (c *storage) Add(k interface{}, v interface{}) error {
-	return c.addFunc(k, v)
+	return c.addFunc(context.Background(), k, v)
 }
 
 // Remove is customizable remove function
 func (c *storage) Remove(k interface{}) error {
-	return c.removeFunc(k)
+	return c.removeFunc(context.Background(), k)
+}
+
+// GetContext is customizable get function
+func (c *storage) GetContext(ctx context.Context, k interface{}) (interface{}, error) {
+	return c.getFunc(ctx, k)
+}
+
+// AddContext is customizable add function
+func (c *storage) AddContext(ctx context.Context, k interface{}, v interface{}) error {
+	return c.addFunc(ctx, k, v)
+}
+
+// RemoveContext is customizable remove function
+func (c *storage) RemoveContext(ctx context.Context, k interface{}) error {
+	return c.removeFunc(ctx, k)
 }
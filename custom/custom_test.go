@@ -3,6 +3,7 @@ package custom
 import (
 	"testing"
 
+	"github.com/juntaki/transparent"
 	"github.com/juntaki/transparent/test"
 )
 
@@ -15,3 +16,12 @@ func TestCustom(t *testing.T) {
 	}
 	test.BasicStorageFunc(t, cs)
 }
+
+func TestCustomContext(t *testing.T) {
+	ds := test.NewStorage(0).(transparent.BackendStorageContext)
+	cs, err := NewContextStorage(ds.GetContext, ds.AddContext, ds.RemoveContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.BasicStorageFunc(t, cs)
+}
@@ -1,15 +1,28 @@
 package filesystem
 
 import (
+	"context"
+	"crypto/sha256"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"time"
 
 	"github.com/juntaki/transparent"
 	"github.com/juntaki/transparent/simple"
 	"github.com/pkg/errors"
 )
 
+// expireDirectory has empty files, their mtime is expiration time of the same name file
+const expireDirectory = ".expire/"
+
+// lockFile is locked by conditional write, and by write of the file with its expiration.
+// Conditional writes are serialized between processes, and expired file is not unlinked
+// while it is written again.
+const lockFile = ".lock"
+
 // simpleStorage store file at directory, filename is key
 type simpleStorage struct {
 	directory string
@@ -37,6 +50,18 @@ func (f *simpleStorage) Get(k interface{}) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+	if f.expired(filename) {
+		err = f.removeExpired(filename)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &transparent.KeyNotFoundError{Key: filename}
+	}
+	return f.readFile(filename)
+}
+
+// readFile reads the file without checking its expiration
+func (f *simpleStorage) readFile(filename string) ([]byte, error) {
 	data, cause := ioutil.ReadFile(f.directory + filename)
 	if cause != nil {
 		if os.IsNotExist(cause) {
@@ -57,7 +82,61 @@ func (f *simpleStorage) Add(k interface{}, v interface{}) error {
 	if err != nil {
 		return err
 	}
-	cause := ioutil.WriteFile(f.directory+filename, data, 0600)
+	unlock, err := f.lockExpiration()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return f.add(filename, data)
+}
+
+// add removes expiration of the file before write, caller must lock expiration
+func (f *simpleStorage) add(filename string, data []byte) error {
+	cause := os.Remove(f.directory + expireDirectory + filename)
+	if cause != nil && !os.IsNotExist(cause) {
+		return errors.Wrapf(cause, "failed to remove expiration. filename = %s", filename)
+	}
+	cause = ioutil.WriteFile(f.directory+filename, data, 0600)
+	if cause != nil {
+		return errors.Wrapf(cause, "failed to write file. filename = %s", filename)
+	}
+	return nil
+}
+
+// AddWithTTL is file write, and mtime of the file in expireDirectory is set to expiration time
+func (f *simpleStorage) AddWithTTL(ctx context.Context, k interface{}, v interface{}, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	expire, err := transparent.ExpireAt(ttl)
+	if err != nil {
+		return err
+	}
+	filename, err := f.validateKey(k)
+	if err != nil {
+		return err
+	}
+	data, err := f.validateValue(v)
+	if err != nil {
+		return err
+	}
+	unlock, err := f.lockExpiration()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	cause := os.MkdirAll(f.directory+expireDirectory, 0700)
+	if cause != nil {
+		return errors.Wrapf(cause, "failed to create directory. directory = %s", f.directory+expireDirectory)
+	}
+	cause = ioutil.WriteFile(f.directory+expireDirectory+filename, []byte{}, 0600)
+	if cause == nil {
+		cause = os.Chtimes(f.directory+expireDirectory+filename, expire, expire)
+	}
+	if cause != nil {
+		return errors.Wrapf(cause, "failed to write expiration. filename = %s", filename)
+	}
+	cause = ioutil.WriteFile(f.directory+filename, data, 0600)
 	if cause != nil {
 		return errors.Wrapf(cause, "failed to write file. filename = %s", filename)
 	}
@@ -70,13 +149,277 @@ func (f *simpleStorage) Remove(k interface{}) error {
 	if err != nil {
 		return err
 	}
+	unlock, err := f.lockExpiration()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return f.remove(filename)
+}
+
+// remove unlinks the file and its expiration, caller must lock expiration
+func (f *simpleStorage) remove(filename string) error {
 	cause := os.Remove(f.directory + filename)
 	if cause != nil {
 		return errors.Wrapf(cause, "failed to remove file. filename = %s", filename)
 	}
+	cause = os.Remove(f.directory + expireDirectory + filename)
+	if cause != nil && !os.IsNotExist(cause) {
+		return errors.Wrapf(cause, "failed to remove expiration. filename = %s", filename)
+	}
 	return nil
 }
 
+// expired returns true if the file has expiration time and it is passed
+func (f *simpleStorage) expired(filename string) bool {
+	info, err := os.Stat(f.directory + expireDirectory + filename)
+	if err != nil {
+		return false
+	}
+	return info.ModTime().Before(time.Now())
+}
+
+// removeExpired unlinks the file if it is still expired after lock
+func (f *simpleStorage) removeExpired(filename string) error {
+	unlock, err := f.lockExpiration()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if f.expired(filename) {
+		f.unlink(filename)
+	}
+	return nil
+}
+
+// unlink removes the file and its expiration, caller must lock expiration
+func (f *simpleStorage) unlink(filename string) {
+	os.Remove(f.directory + filename)
+	os.Remove(f.directory + expireDirectory + filename)
+}
+
+// GetContext is file read
+func (f *simpleStorage) GetContext(ctx context.Context, k interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.Get(k)
+}
+
+// AddContext is file write
+func (f *simpleStorage) AddContext(ctx context.Context, k interface{}, v interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return f.Add(k, v)
+}
+
+// RemoveContext is file unlink
+func (f *simpleStorage) RemoveContext(ctx context.Context, k interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return f.Remove(k)
+}
+
+// GetMulti is file read of each key
+func (f *simpleStorage) GetMulti(ctx context.Context, keys []interface{}) (map[interface{}]interface{}, error) {
+	values := make(map[interface{}]interface{}, len(keys))
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		data, err := f.Get(k)
+		if err != nil {
+			if _, ok := err.(*transparent.KeyNotFoundError); ok {
+				continue
+			}
+			return nil, err
+		}
+		values[k] = data
+	}
+	return values, nil
+}
+
+// AddMulti is file write of each key, all keys and values are validated before write
+func (f *simpleStorage) AddMulti(ctx context.Context, values map[interface{}]interface{}) error {
+	for k, v := range values {
+		if _, err := f.validateKey(k); err != nil {
+			return err
+		}
+		if _, err := f.validateValue(v); err != nil {
+			return err
+		}
+	}
+	for k, v := range values {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := f.Add(k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveMulti is file unlink of each key, all keys are validated before unlink
+func (f *simpleStorage) RemoveMulti(ctx context.Context, keys []interface{}) error {
+	for _, k := range keys {
+		if _, err := f.validateKey(k); err != nil {
+			return err
+		}
+	}
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := f.Remove(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scan walks the directory, filename is key
+func (f *simpleStorage) Scan(ctx context.Context, r transparent.ScanRange) (*transparent.ScanPage, error) {
+	keys := []string{}
+	cause := filepath.Walk(f.directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		filename, err := filepath.Rel(f.directory, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if filename+"/" == expireDirectory {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filename != lockFile && !f.expired(filename) {
+			keys = append(keys, filename)
+		}
+		return nil
+	})
+	if cause != nil {
+		if cause == ctx.Err() {
+			return nil, cause
+		}
+		return nil, errors.Wrapf(cause, "failed to walk directory. directory = %s", f.directory)
+	}
+	return transparent.ScanKeys(keys, r), nil
+}
+
+// GetVersion is file read, version is SHA-256 of the file
+func (f *simpleStorage) GetVersion(ctx context.Context, k interface{}) (interface{}, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	data, err := f.Get(k)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, version(data.([]byte)), nil
+}
+
+// AddIfAbsent is file write with lock, if the file doesn't exist
+func (f *simpleStorage) AddIfAbsent(ctx context.Context, k interface{}, v interface{}) (string, error) {
+	return f.addIf(ctx, k, v, func(data []byte, found bool) bool {
+		return !found
+	})
+}
+
+// AddIfVersion is file write with lock, if the version is matched
+func (f *simpleStorage) AddIfVersion(ctx context.Context, k interface{}, v interface{}, ver string) (string, error) {
+	return f.addIf(ctx, k, v, func(data []byte, found bool) bool {
+		return found && version(data) == ver
+	})
+}
+
+// RemoveIfVersion is file unlink with lock, if the version is matched
+func (f *simpleStorage) RemoveIfVersion(ctx context.Context, k interface{}, ver string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	filename, err := f.validateKey(k)
+	if err != nil {
+		return err
+	}
+	unlock, err := f.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	data, found, err := f.read(filename)
+	if err != nil {
+		return err
+	}
+	if !found || version(data) != ver {
+		return &transparent.VersionConflictError{Key: k}
+	}
+	return f.remove(filename)
+}
+
+// addIf writes the file with lock, if cond of current file is true
+func (f *simpleStorage) addIf(ctx context.Context, k interface{}, v interface{}, cond func(data []byte, found bool) bool) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	filename, err := f.validateKey(k)
+	if err != nil {
+		return "", err
+	}
+	value, err := f.validateValue(v)
+	if err != nil {
+		return "", err
+	}
+	unlock, err := f.lock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	data, found, err := f.read(filename)
+	if err != nil {
+		return "", err
+	}
+	if !cond(data, found) {
+		return "", &transparent.VersionConflictError{Key: k}
+	}
+	err = f.add(filename, value)
+	if err != nil {
+		return "", err
+	}
+	return version(value), nil
+}
+
+// read returns the file, found is false if it doesn't exist or expired.
+// Caller must lock expiration.
+func (f *simpleStorage) read(filename string) (data []byte, found bool, err error) {
+	if f.expired(filename) {
+		f.unlink(filename)
+		return nil, false, nil
+	}
+	data, err = f.readFile(filename)
+	if err != nil {
+		if _, ok := err.(*transparent.KeyNotFoundError); ok {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// version of the file content
+func version(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
 func (f *simpleStorage) validateKey(k interface{}) (string, error) {
 	key, ok := k.(string)
 	if !ok {
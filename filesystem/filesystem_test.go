@@ -1,9 +1,14 @@
 package filesystem
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/juntaki/transparent"
+	"github.com/juntaki/transparent/lru"
 	"github.com/juntaki/transparent/test"
 )
 
@@ -11,11 +16,98 @@ func TestFilesystemSimpleStorage(t *testing.T) {
 	fss := NewSimpleStorage("/tmp")
 	test.BasicStorageFunc(t, fss)
 	test.SimpleStorageFunc(t, fss)
+	test.TTLStorageFunc(t, fss)
+	test.MultiStorageFunc(t, fss)
+}
+
+func TestFilesystemScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transparent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fss := NewSimpleStorage(dir)
+	test.ScanStorageFunc(t, fss)
+	test.VersionStorageFunc(t, fss)
+
+	// Expired file is not scanned
+	err = fss.(transparent.BackendStorageTTL).AddWithTTL(context.Background(), "scan-expired", []byte("value"), time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	source, err := transparent.NewLayerSource(fss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := transparent.NewLayerCache(10, lru.NewStorage(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stack := transparent.NewStack()
+	stack.Stack(source)
+	stack.Stack(cache)
+	stack.Start()
+	test.ScanStackFunc(t, stack)
+	stack.Stop()
 }
 
 func TestFilesystemStorage(t *testing.T) {
 	fs := NewStorage("/tmp")
 	test.BasicStorageFunc(t, fs)
+	test.TTLStorageFunc(t, fs)
+	test.MultiStorageFunc(t, fs)
+}
+
+func TestFilesystemJanitor(t *testing.T) {
+	fss := NewSimpleStorage("/tmp").(transparent.BackendStorageTTL)
+	err := fss.AddWithTTL(context.Background(), "janitor", []byte("value"), time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := NewJanitor("/tmp", 10*time.Millisecond)
+	j.Start()
+	time.Sleep(100 * time.Millisecond)
+	j.Stop()
+	_, err = os.Stat("/tmp/janitor")
+	if !os.IsNotExist(err) {
+		t.Error(err)
+	}
+
+	// Stop doesn't block without Start
+	NewJanitor("/tmp", time.Second).Stop()
+}
+
+func TestFilesystemExpiredRace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transparent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fss := NewSimpleStorage(dir).(transparent.BackendStorageTTL)
+
+	// Get of expired file doesn't unlink the file written again
+	for i := 0; i < 100; i++ {
+		err = fss.AddWithTTL(context.Background(), "race", []byte("old"), time.Nanosecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan bool)
+		go func() {
+			fss.Get("race")
+			close(done)
+		}()
+		err = fss.Add("race", []byte("new"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		value, err := fss.Get("race")
+		if err != nil || string(value.([]byte)) != "new" {
+			t.Fatal(i, value, err)
+		}
+	}
 }
 
 func TestFilesystemSource(t *testing.T) {
@@ -29,3 +121,18 @@ func TestFilesystemCache(t *testing.T) {
 	c := NewCache(10, "/tmp")
 	test.BasicCacheFunc(t, c)
 }
+
+func TestFilesystemCacheTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transparent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stack := transparent.NewStack()
+	stack.Stack(NewSource("/tmp"))
+	stack.Stack(NewCache(10, dir))
+	stack.Start()
+	test.TTLStackFunc(t, stack)
+	test.MultiStackFunc(t, stack)
+	stack.Stop()
+}
@@ -0,0 +1,73 @@
+package filesystem
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Janitor removes expired files in the directory periodically
+type Janitor struct {
+	storage  *simpleStorage
+	interval time.Duration
+	done     chan bool
+}
+
+// NewJanitor returns Janitor for the directory of Storage
+func NewJanitor(directory string, interval time.Duration) *Janitor {
+	return &Janitor{
+		storage: &simpleStorage{
+			directory: directory + "/",
+		},
+		interval: interval,
+		done:     make(chan bool),
+	}
+}
+
+// Start cleaning in background
+func (j *Janitor) Start() error {
+	go func() {
+		for {
+			select {
+			case <-time.After(j.interval):
+				j.Clean()
+			case <-j.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop cleaning, it can be called without Start
+func (j *Janitor) Stop() error {
+	select {
+	case <-j.done:
+	default:
+		close(j.done)
+	}
+	return nil
+}
+
+// Clean removes expired files now
+func (j *Janitor) Clean() error {
+	directory := j.storage.directory + expireDirectory
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to read directory. directory = %s", directory)
+	}
+	for _, file := range files {
+		if j.storage.expired(file.Name()) {
+			err = j.storage.removeExpired(file.Name())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package filesystem
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// lock the directory by flock of lockFile, for conditional write.
+// It returns the function to unlock.
+func (f *simpleStorage) lock() (func(), error) {
+	file, cause := os.OpenFile(f.directory+lockFile, os.O_CREATE|os.O_RDWR, 0600)
+	if cause != nil {
+		return nil, errors.Wrapf(cause, "failed to open lock file. directory = %s", f.directory)
+	}
+	cause = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	if cause != nil {
+		file.Close()
+		return nil, errors.Wrapf(cause, "failed to lock. directory = %s", f.directory)
+	}
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// lockExpiration locks the directory for write of the file with its expiration
+func (f *simpleStorage) lockExpiration() (func(), error) {
+	return f.lock()
+}
@@ -0,0 +1,13 @@
+package filesystem
+
+import "errors"
+
+// lock is not supported on windows
+func (f *simpleStorage) lock() (func(), error) {
+	return nil, errors.New("file locking is not supported")
+}
+
+// lockExpiration is no-op on windows, expired file may be unlinked while it is written again
+func (f *simpleStorage) lockExpiration() (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,29 @@
+module github.com/juntaki/transparent
+
+go 1.19
+
+require (
+	github.com/aws/aws-sdk-go v1.55.8
+	github.com/golang/protobuf v1.5.3
+	github.com/hashicorp/raft v1.5.0
+	github.com/pkg/errors v0.9.1
+	github.com/satori/go.uuid v1.2.0
+	golang.org/x/net v0.12.0
+	google.golang.org/grpc v1.56.3
+)
+
+require (
+	github.com/armon/go-metrics v0.4.1 // indirect
+	github.com/fatih/color v1.13.0 // indirect
+	github.com/hashicorp/go-hclog v1.5.0 // indirect
+	github.com/hashicorp/go-immutable-radix v1.0.0 // indirect
+	github.com/hashicorp/go-msgpack v0.5.5 // indirect
+	github.com/hashicorp/golang-lru v0.5.0 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/mattn/go-colorable v0.1.12 // indirect
+	github.com/mattn/go-isatty v0.0.14 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1 // indirect
+	google.golang.org/protobuf v1.30.0 // indirect
+)
@@ -0,0 +1,157 @@
+// Package logfile is append-only file of records, shared by write-ahead log and 2PC log.
+// Each record is 4 bytes big endian length and gob encoded value.
+package logfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// File is append-only file of records, it is not safe for concurrent use
+type File struct {
+	name     string // Name of the log in error messages
+	filename string
+	file     *os.File
+}
+
+// Open reads records left by the last process, and opens the file to append.
+// Record partially written by crash is dropped.
+func Open(name string, filename string) (*File, [][]byte, error) {
+	f := &File{name: name, filename: filename}
+	records, err := f.read()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = f.Rewrite(records)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, records, nil
+}
+
+func (f *File) read() ([][]byte, error) {
+	file, err := os.Open(f.filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s. filename = %s", f.name, f.filename)
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	records := [][]byte{}
+	for {
+		var length uint32
+		err = binary.Read(r, binary.BigEndian, &length)
+		if err != nil {
+			return records, nil
+		}
+		data := make([]byte, length)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			// Record is partially written by crash
+			return records, nil
+		}
+		records = append(records, data)
+	}
+}
+
+// Encode returns gob encoded value
+func Encode(value interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := gob.NewEncoder(buf).Encode(value)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode decodes gob encoded record to value
+func Decode(data []byte, value interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
+
+// Append writes the record, it is durable when returned
+func (f *File) Append(data []byte) error {
+	err := f.write(f.file, data)
+	if err != nil {
+		return err
+	}
+	err = f.file.Sync()
+	if err != nil {
+		return errors.Wrapf(err, "failed to sync %s. filename = %s", f.name, f.filename)
+	}
+	return nil
+}
+
+func (f *File) write(w io.Writer, data []byte) error {
+	err := binary.Write(w, binary.BigEndian, uint32(len(data)))
+	if err == nil {
+		_, err = w.Write(data)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to write %s. filename = %s", f.name, f.filename)
+	}
+	return nil
+}
+
+// Rewrite replaces the file with the records, and opens it to append.
+// It costs the size of the records, so it is for compaction.
+func (f *File) Rewrite(records [][]byte) error {
+	tmp := f.filename + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s. filename = %s", f.name, tmp)
+	}
+	writer := bufio.NewWriter(file)
+	for _, data := range records {
+		err = f.write(writer, data)
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return errors.Wrapf(err, "failed to write %s. filename = %s", f.name, tmp)
+	}
+	err = os.Rename(tmp, f.filename)
+	if err != nil {
+		return errors.Wrapf(err, "failed to rename %s. filename = %s", f.name, tmp)
+	}
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file, err = os.OpenFile(f.filename, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s. filename = %s", f.name, f.filename)
+	}
+	return nil
+}
+
+// Truncate removes all records, it is cheaper than Rewrite of no record
+func (f *File) Truncate() error {
+	err := f.file.Truncate(0)
+	if err == nil {
+		err = f.file.Sync()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to truncate %s. filename = %s", f.name, f.filename)
+	}
+	return nil
+}
+
+// Close the file
+func (f *File) Close() error {
+	return f.file.Close()
+}
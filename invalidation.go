@@ -0,0 +1,468 @@
+package transparent
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// evictable is Layer which can drop the key without applying it to next Layer
+type evictable interface {
+	evict(key interface{})
+}
+
+type layerInvalidation struct {
+	Receiver    BackendReceiver
+	next        Layer
+	above       []evictable
+	interval    time.Duration
+	logFilename string
+	log         *invalidationLog
+	lock        sync.Mutex
+	seq         uint64 // Sequence of the last publish
+	peers       map[string]*peer
+	running     bool
+}
+
+// InvalidationOption configures LayerInvalidation
+type InvalidationOption func(i *layerInvalidation)
+
+// WithPeer adds the peer which receives invalidations by the name.
+func WithPeer(name string, transmitter BackendTransmitter) InvalidationOption {
+	return func(i *layerInvalidation) {
+		i.peers[name] = &peer{name: name, transmitter: transmitter}
+	}
+}
+
+// WithInvalidationRetry sets the interval to retry failed invalidations.
+// Default is 1 second.
+func WithInvalidationRetry(interval time.Duration) InvalidationOption {
+	return func(i *layerInvalidation) {
+		i.interval = interval
+	}
+}
+
+// WithInvalidationLog sets the file of invalidations not delivered to peers yet.
+// They are appended to the file before the write returns,
+// and delivered after restart if the node stops before it.
+// Types of keys must be registered by gob.Register before NewLayerInvalidation.
+func WithInvalidationLog(filename string) InvalidationOption {
+	return func(i *layerInvalidation) {
+		i.logFilename = filename
+	}
+}
+
+// NewLayerInvalidation returns LayerInvalidation.
+// LayerInvalidation publishes the keys written to next Layer to peers,
+// and evicts the keys published by peers from cache layers above it.
+// Invalidations are delivered at least once, they are retried until the peer accepts them.
+// Stop and RemovePeer send pending invalidations within the retry interval,
+// and WithInvalidationLog keeps them over restart and crash.
+// Receiver can be nil if the Stack has no cache to evict.
+func NewLayerInvalidation(receiver BackendReceiver, options ...InvalidationOption) (Layer, error) {
+	i := &layerInvalidation{
+		Receiver: receiver,
+		interval: time.Second,
+		peers:    make(map[string]*peer),
+	}
+	for _, option := range options {
+		option(i)
+	}
+	if i.interval <= 0 {
+		return nil, errors.New("retry interval must be positive")
+	}
+	if receiver != nil {
+		err := receiver.SetCallback(i.callback)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if i.logFilename != "" {
+		log, err := openInvalidationLog(i.logFilename)
+		if err != nil {
+			return nil, err
+		}
+		i.log = log
+		i.seq = log.seq
+	}
+	for _, p := range i.peers {
+		p.init(i.log)
+	}
+	return i, nil
+}
+
+// AddPeer adds the peer to LayerInvalidation
+func AddPeer(l Layer, name string, transmitter BackendTransmitter) error {
+	i, ok := l.(*layerInvalidation)
+	if !ok {
+		return errors.New("not LayerInvalidation")
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if _, ok := i.peers[name]; ok {
+		return errors.New("peer already exists")
+	}
+	p := &peer{name: name, transmitter: transmitter}
+	p.init(i.log)
+	if i.running {
+		err := p.start(i.interval)
+		if err != nil {
+			return err
+		}
+	}
+	i.peers[name] = p
+	return nil
+}
+
+// RemovePeer removes the peer from LayerInvalidation.
+// Invalidations not yet delivered to the peer are sent within the retry interval,
+// and discarded after that.
+func RemovePeer(l Layer, name string) error {
+	i, ok := l.(*layerInvalidation)
+	if !ok {
+		return errors.New("not LayerInvalidation")
+	}
+	i.lock.Lock()
+	p, ok := i.peers[name]
+	delete(i.peers, name)
+	running := i.running
+	i.lock.Unlock()
+	if !ok {
+		return errors.New("peer not found")
+	}
+	if running {
+		err := p.stop(i.interval)
+		if err != nil {
+			return err
+		}
+	}
+	if i.log != nil {
+		return i.log.remove(name)
+	}
+	return nil
+}
+
+// Set set the value to next Layer, and publish the key
+func (i *layerInvalidation) Set(key interface{}, value interface{}) error {
+	return i.SetContext(context.Background(), key, value)
+}
+
+// SetContext set the value to next Layer, and publish the key
+func (i *layerInvalidation) SetContext(ctx context.Context, key interface{}, value interface{}) error {
+	err := i.next.SetContext(ctx, key, value)
+	if err != nil {
+		return err
+	}
+	return i.publish(key)
+}
+
+// SetWithTTL set the value to next Layer, and publish the key
+func (i *layerInvalidation) SetWithTTL(ctx context.Context, key interface{}, value interface{}, ttl time.Duration) error {
+	err := i.next.SetWithTTL(ctx, key, value, ttl)
+	if err != nil {
+		return err
+	}
+	return i.publish(key)
+}
+
+// Get get the value from next Layer
+func (i *layerInvalidation) Get(key interface{}) (value interface{}, err error) {
+	return i.next.Get(key)
+}
+
+// GetContext get the value from next Layer
+func (i *layerInvalidation) GetContext(ctx context.Context, key interface{}) (value interface{}, err error) {
+	return i.next.GetContext(ctx, key)
+}
+
+// Remove remove the key from next Layer, and publish the key
+func (i *layerInvalidation) Remove(key interface{}) error {
+	return i.RemoveContext(context.Background(), key)
+}
+
+// RemoveContext remove the key from next Layer, and publish the key
+func (i *layerInvalidation) RemoveContext(ctx context.Context, key interface{}) error {
+	err := i.next.RemoveContext(ctx, key)
+	if err != nil {
+		return err
+	}
+	return i.publish(key)
+}
+
+// GetMulti get the values from next Layer
+func (i *layerInvalidation) GetMulti(ctx context.Context, keys []interface{}) (map[interface{}]interface{}, error) {
+	return i.next.GetMulti(ctx, keys)
+}
+
+// SetMulti set the values to next Layer, and publish the keys
+func (i *layerInvalidation) SetMulti(ctx context.Context, values map[interface{}]interface{}) error {
+	err := i.next.SetMulti(ctx, values)
+	if err != nil {
+		return err
+	}
+	keys := make([]interface{}, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	return i.publish(keys...)
+}
+
+// RemoveMulti remove the keys from next Layer, and publish the keys
+func (i *layerInvalidation) RemoveMulti(ctx context.Context, keys []interface{}) error {
+	err := i.next.RemoveMulti(ctx, keys)
+	if err != nil {
+		return err
+	}
+	return i.publish(keys...)
+}
+
+// Scan scan keys of next Layer
+func (i *layerInvalidation) Scan(ctx context.Context, r ScanRange) (*ScanPage, error) {
+	return i.next.Scan(ctx, r)
+}
+
+// GetVersion get the value and its version from next Layer
+func (i *layerInvalidation) GetVersion(ctx context.Context, key interface{}) (interface{}, string, error) {
+	return i.next.GetVersion(ctx, key)
+}
+
+// SetIfAbsent set the value to next Layer, and publish the key
+func (i *layerInvalidation) SetIfAbsent(ctx context.Context, key interface{}, value interface{}) (string, error) {
+	version, err := i.next.SetIfAbsent(ctx, key, value)
+	if err != nil {
+		return "", err
+	}
+	return version, i.publish(key)
+}
+
+// CompareAndSwap set the value to next Layer, and publish the key
+func (i *layerInvalidation) CompareAndSwap(ctx context.Context, key interface{}, value interface{}, version string) (string, error) {
+	newVersion, err := i.next.CompareAndSwap(ctx, key, value, version)
+	if err != nil {
+		return "", err
+	}
+	return newVersion, i.publish(key)
+}
+
+// RemoveIfVersion remove the key from next Layer, and publish the key
+func (i *layerInvalidation) RemoveIfVersion(ctx context.Context, key interface{}, version string) error {
+	err := i.next.RemoveIfVersion(ctx, key, version)
+	if err != nil {
+		return err
+	}
+	return i.publish(key)
+}
+
+// Sync next Layer
+func (i *layerInvalidation) Sync() error {
+	return i.next.Sync()
+}
+
+// SyncContext next Layer
+func (i *layerInvalidation) SyncContext(ctx context.Context) error {
+	return i.next.SyncContext(ctx)
+}
+
+func (i *layerInvalidation) setNext(next Layer) error {
+	i.next = next
+	return nil
+}
+
+func (i *layerInvalidation) start() error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	for _, p := range i.peers {
+		err := p.start(i.interval)
+		if err != nil {
+			return err
+		}
+	}
+	i.running = true
+	if i.Receiver != nil {
+		return i.Receiver.Start()
+	}
+	return nil
+}
+
+func (i *layerInvalidation) stop() error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if !i.running {
+		return nil
+	}
+	if i.Receiver != nil {
+		err := i.Receiver.Stop()
+		if err != nil {
+			return err
+		}
+	}
+	i.running = false
+	for _, p := range i.peers {
+		err := p.stop(i.interval)
+		if err != nil {
+			return err
+		}
+	}
+	if i.log != nil {
+		return i.log.close()
+	}
+	return nil
+}
+
+// publish queues invalidation of the keys to all peers.
+// The keys are written to the log before they are queued.
+func (i *layerInvalidation) publish(keys ...interface{}) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if len(i.peers) == 0 {
+		return nil
+	}
+	i.seq++
+	if i.log != nil {
+		names := make([]string, 0, len(i.peers))
+		for name := range i.peers {
+			names = append(names, name)
+		}
+		err := i.log.publish(names, keys, i.seq)
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range i.peers {
+		p.add(keys, i.seq)
+	}
+	return nil
+}
+
+// callback evicts the keys invalidated by peer
+func (i *layerInvalidation) callback(m *Message) (*Message, error) {
+	operations := []*Message{m}
+	if m.Message == MessageBatch {
+		operations = m.Batch
+	}
+	for _, o := range operations {
+		if o.Message != MessageInvalidate {
+			return nil, errors.New("unknown message")
+		}
+	}
+	for _, o := range operations {
+		for _, e := range i.above {
+			e.evict(o.Key)
+		}
+	}
+	return &Message{Message: m.Message}, nil
+}
+
+// peer delivers invalidations to a Transmitter
+type peer struct {
+	name        string
+	transmitter BackendTransmitter
+	log         *invalidationLog // Optional, pending keys are kept over restart
+	lock        sync.Mutex
+	pending     map[interface{}]uint64 // Sequence of the last publish by key
+	signal      chan bool
+	cancel      context.CancelFunc
+	done        chan bool
+}
+
+// init restores the keys pending in the log
+func (p *peer) init(log *invalidationLog) {
+	p.log = log
+	p.pending = make(map[interface{}]uint64)
+	p.signal = make(chan bool, 1)
+	if log != nil {
+		p.pending = log.keys(p.name)
+	}
+}
+
+func (p *peer) start(interval time.Duration) error {
+	err := p.transmitter.Start()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.done = make(chan bool)
+	go p.run(ctx, interval)
+	return nil
+}
+
+// stop sends pending keys once more within timeout, and stops the transmitter
+func (p *peer) stop(timeout time.Duration) error {
+	p.cancel()
+	<-p.done
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	p.send(ctx)
+	return p.transmitter.Stop()
+}
+
+// add queues the keys, the same key pending is sent once
+func (p *peer) add(keys []interface{}, seq uint64) {
+	p.lock.Lock()
+	for _, key := range keys {
+		p.pending[key] = seq
+	}
+	p.lock.Unlock()
+	select {
+	case p.signal <- true:
+	default:
+	}
+}
+
+// run sends pending keys, and retries them at interval until they are accepted
+func (p *peer) run(ctx context.Context, interval time.Duration) {
+	defer close(p.done)
+	retry := time.NewTicker(interval)
+	defer retry.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.signal:
+		case <-retry.C:
+		}
+		p.send(ctx)
+	}
+}
+
+// send delivers pending keys, they are kept pending until the peer accepts them
+func (p *peer) send(ctx context.Context) {
+	p.lock.Lock()
+	sent := make(map[interface{}]uint64, len(p.pending))
+	for key, seq := range p.pending {
+		sent[key] = seq
+	}
+	p.lock.Unlock()
+	if len(sent) == 0 {
+		return
+	}
+
+	operations := make([]*Message, 0, len(sent))
+	keys := make([]interface{}, 0, len(sent))
+	var last uint64
+	for key, seq := range sent {
+		operations = append(operations, &Message{Message: MessageInvalidate, Key: key})
+		keys = append(keys, key)
+		if last < seq {
+			last = seq
+		}
+	}
+	_, err := requestBatch(ctx, p.transmitter, operations)
+	if err != nil {
+		return
+	}
+	// Keys published again while sending are still pending
+	p.lock.Lock()
+	for key, seq := range sent {
+		if p.pending[key] == seq {
+			delete(p.pending, key)
+		}
+	}
+	p.lock.Unlock()
+	if p.log != nil {
+		// Failure to mark only delivers the keys again after restart
+		p.log.delivered(p.name, keys, last)
+	}
+}
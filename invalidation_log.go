@@ -0,0 +1,176 @@
+package transparent
+
+import (
+	"sync"
+
+	"github.com/juntaki/transparent/internal/logfile"
+	"github.com/pkg/errors"
+)
+
+// invalidationLog is append-only file of invalidations not delivered to peers yet.
+// Each record is gob encoded invalidationRecord in logfile.
+// Delivery appends a marker, and the file is rewritten only to compact it.
+type invalidationLog struct {
+	lock    sync.Mutex
+	file    *logfile.File
+	seq     uint64                            // Sequence of the last publish
+	size    int                               // Number of records in the file
+	live    int                               // Number of pending keys of all peers
+	pending map[string]map[interface{}]uint64 // Sequence of the last publish by peer and key
+}
+
+type invalidationRecord struct {
+	Peers     []string
+	Seq       uint64
+	Keys      []interface{}
+	Delivered bool // Marker of the keys delivered, which are not published again after Seq
+	Removed   bool // Marker of the peers removed, their keys are not delivered
+}
+
+// invalidationCompaction is the number of records not pending, which triggers rewrite of the file
+const invalidationCompaction = 1024
+
+// openInvalidationLog opens the file and reads records left by the last process.
+func openInvalidationLog(filename string) (*invalidationLog, error) {
+	file, records, err := logfile.Open("invalidation log", filename)
+	if err != nil {
+		return nil, err
+	}
+	l := &invalidationLog{
+		file:    file,
+		size:    len(records),
+		pending: make(map[string]map[interface{}]uint64),
+	}
+	for _, data := range records {
+		record := &invalidationRecord{}
+		err = logfile.Decode(data, record)
+		if err != nil {
+			file.Close()
+			return nil, errors.Wrapf(err, "failed to decode invalidation log. filename = %s", filename)
+		}
+		l.apply(record)
+		if l.seq < record.Seq {
+			l.seq = record.Seq
+		}
+	}
+	return l, nil
+}
+
+// apply updates pending keys by the record
+func (l *invalidationLog) apply(r *invalidationRecord) {
+	for _, peer := range r.Peers {
+		keys := l.pending[peer]
+		if r.Removed {
+			l.live -= len(keys)
+			delete(l.pending, peer)
+			continue
+		}
+		if keys == nil {
+			keys = make(map[interface{}]uint64)
+			l.pending[peer] = keys
+		}
+		for _, key := range r.Keys {
+			seq, ok := keys[key]
+			switch {
+			case !r.Delivered && !ok:
+				l.live++
+				keys[key] = r.Seq
+			case !r.Delivered:
+				keys[key] = r.Seq
+			case ok && seq <= r.Seq:
+				l.live--
+				delete(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			delete(l.pending, peer)
+		}
+	}
+}
+
+// publish writes the keys pending for the peers by the sequence.
+// Types of keys must be registered by gob.Register.
+func (l *invalidationLog) publish(peers []string, keys []interface{}, seq uint64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.seq = seq
+	return l.append(&invalidationRecord{Peers: peers, Seq: seq, Keys: keys})
+}
+
+// delivered writes the marker of the keys delivered to the peer, which are published until seq
+func (l *invalidationLog) delivered(peer string, keys []interface{}, seq uint64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.append(&invalidationRecord{Peers: []string{peer}, Seq: seq, Keys: keys, Delivered: true})
+}
+
+// remove writes the marker of the peer removed
+func (l *invalidationLog) remove(peer string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.append(&invalidationRecord{Peers: []string{peer}, Removed: true})
+}
+
+// keys returns the keys pending for the peer, and their sequence
+func (l *invalidationLog) keys(peer string) map[interface{}]uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	keys := make(map[interface{}]uint64, len(l.pending[peer]))
+	for key, seq := range l.pending[peer] {
+		keys[key] = seq
+	}
+	return keys
+}
+
+// append writes the record, and compacts the file if most of records are not pending.
+// The file is truncated if nothing is pending.
+func (l *invalidationLog) append(r *invalidationRecord) error {
+	l.apply(r)
+	if l.live == 0 {
+		err := l.file.Truncate()
+		if err != nil {
+			return err
+		}
+		l.size = 0
+		return nil
+	}
+	if l.size-l.live >= invalidationCompaction && l.size >= 2*l.live {
+		return l.rewrite()
+	}
+	data, err := logfile.Encode(r)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode invalidation log")
+	}
+	err = l.file.Append(data)
+	if err != nil {
+		return err
+	}
+	l.size++
+	return nil
+}
+
+// rewrite replaces the file with a record per pending key
+func (l *invalidationLog) rewrite() error {
+	records := make([][]byte, 0, l.live)
+	for peer, keys := range l.pending {
+		for key, seq := range keys {
+			data, err := logfile.Encode(&invalidationRecord{Peers: []string{peer}, Seq: seq, Keys: []interface{}{key}})
+			if err != nil {
+				return errors.Wrap(err, "failed to encode invalidation log")
+			}
+			records = append(records, data)
+		}
+	}
+	err := l.file.Rewrite(records)
+	if err != nil {
+		return err
+	}
+	l.size = len(records)
+	return nil
+}
+
+func (l *invalidationLog) close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,221 @@
+package transparent_test
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juntaki/transparent"
+	"github.com/juntaki/transparent/lru"
+	"github.com/juntaki/transparent/test"
+)
+
+// loopback is Receiver, and Transmitter to the Receiver
+type loopback struct {
+	lock     sync.Mutex
+	callback func(m *transparent.Message) (*transparent.Message, error)
+	fail     int // Number of requests to fail
+	received int
+}
+
+func (l *loopback) Request(m *transparent.Message) (*transparent.Message, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.fail > 0 {
+		l.fail--
+		return nil, errors.New("unreachable")
+	}
+	l.received++
+	return l.callback(m)
+}
+
+func (l *loopback) count() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.received
+}
+
+func (l *loopback) Start() error { return nil }
+func (l *loopback) Stop() error  { return nil }
+func (l *loopback) SetCallback(cb func(m *transparent.Message) (*transparent.Message, error)) error {
+	l.callback = cb
+	return nil
+}
+
+// newInvalidationNode returns Stack of cache, invalidation and source of the storage
+func newInvalidationNode(t *testing.T, storage transparent.BackendStorage, receiver *loopback,
+	options ...transparent.InvalidationOption) (*transparent.Stack, transparent.Layer) {
+	source, err := transparent.NewLayerSource(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalidation, err := transparent.NewLayerInvalidation(receiver, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := transparent.NewLayerCache(10, lru.NewStorage(10),
+		transparent.WithWritePolicy(transparent.WriteThrough))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := transparent.NewStack()
+	s.Stack(source)
+	s.Stack(invalidation)
+	s.Stack(cache)
+	s.Start()
+	return s, invalidation
+}
+
+func TestInvalidation(t *testing.T) {
+	storage := test.NewStorage(0)
+	toA, toB := &loopback{}, &loopback{}
+	a, _ := newInvalidationNode(t, storage, toA, transparent.WithPeer("b", toB))
+	defer a.Stop()
+	b, _ := newInvalidationNode(t, storage, toB, transparent.WithPeer("a", toA))
+	defer b.Stop()
+
+	err := a.Set("key", []byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := b.Get("key")
+	if err != nil || !reflect.DeepEqual(value, []byte("old")) {
+		t.Fatal(value, err)
+	}
+
+	// b evicts the key from cache, and get the new value from source
+	err = a.Set("key", []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		value, err := b.Get("key")
+		return err == nil && reflect.DeepEqual(value, []byte("new"))
+	})
+
+	err = b.Remove("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		_, err := a.Get("key")
+		_, ok := err.(*transparent.KeyNotFoundError)
+		return ok
+	})
+}
+
+func TestInvalidationRetry(t *testing.T) {
+	storage := test.NewStorage(0)
+	toA, toB := &loopback{}, &loopback{fail: 2}
+	a, _ := newInvalidationNode(t, storage, toA, transparent.WithPeer("b", toB),
+		transparent.WithInvalidationRetry(10*time.Millisecond))
+	defer a.Stop()
+	b, _ := newInvalidationNode(t, storage, toB)
+	defer b.Stop()
+
+	a.Set("key", []byte("old"))
+	b.Get("key")
+	a.Set("key", []byte("new"))
+
+	// Delivered after failures
+	waitFor(t, func() bool {
+		value, err := b.Get("key")
+		return err == nil && reflect.DeepEqual(value, []byte("new"))
+	})
+}
+
+func TestInvalidationStop(t *testing.T) {
+	storage := test.NewStorage(0)
+	toB := &loopback{fail: 1}
+	a, _ := newInvalidationNode(t, storage, &loopback{}, transparent.WithPeer("b", toB),
+		transparent.WithInvalidationRetry(time.Hour))
+	b, _ := newInvalidationNode(t, storage, toB)
+	defer b.Stop()
+
+	a.Set("key", []byte("value"))
+	time.Sleep(50 * time.Millisecond)
+	if toB.count() != 0 {
+		t.Fatal("invalidation is delivered before retry")
+	}
+
+	// Pending invalidation is sent by Stop
+	err := a.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if toB.count() != 1 {
+		t.Error("pending invalidation is not sent by Stop")
+	}
+}
+
+func TestInvalidationLog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "invalidation")
+	storage := test.NewStorage(0)
+	toB := &loopback{fail: 1000}
+	b, _ := newInvalidationNode(t, storage, toB)
+	defer b.Stop()
+	a, _ := newInvalidationNode(t, storage, &loopback{}, transparent.WithPeer("b", toB),
+		transparent.WithInvalidationRetry(10*time.Millisecond), transparent.WithInvalidationLog(filename))
+
+	a.Set("key", []byte("old"))
+	b.Get("key")
+	a.Set("key", []byte("new"))
+	err := a.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restarted node delivers the invalidation left in the log
+	toB.lock.Lock()
+	toB.fail = 0
+	toB.lock.Unlock()
+	a, _ = newInvalidationNode(t, storage, &loopback{}, transparent.WithPeer("b", toB),
+		transparent.WithInvalidationRetry(10*time.Millisecond), transparent.WithInvalidationLog(filename))
+	defer a.Stop()
+	waitFor(t, func() bool {
+		value, err := b.Get("key")
+		return err == nil && reflect.DeepEqual(value, []byte("new"))
+	})
+}
+
+func TestInvalidationPeer(t *testing.T) {
+	storage := test.NewStorage(0)
+	toA, toB := &loopback{}, &loopback{}
+	a, invalidation := newInvalidationNode(t, storage, toA)
+	defer a.Stop()
+	b, _ := newInvalidationNode(t, storage, toB)
+	defer b.Stop()
+
+	err := transparent.AddPeer(invalidation, "b", toB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transparent.AddPeer(invalidation, "b", toB)
+	if err == nil {
+		t.Error("duplicated peer is added")
+	}
+	a.Set("key", []byte("value"))
+	waitFor(t, func() bool { return toB.count() == 1 })
+
+	err = transparent.RemovePeer(invalidation, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transparent.RemovePeer(invalidation, "b")
+	if err == nil {
+		t.Error("removed peer is removed again")
+	}
+	a.Set("key", []byte("value"))
+	time.Sleep(50 * time.Millisecond)
+	if toB.count() != 1 {
+		t.Error("invalidation is sent to removed peer")
+	}
+
+	err = transparent.AddPeer(b, "a", toA)
+	if err == nil {
+		t.Error("peer is added to Stack")
+	}
+}
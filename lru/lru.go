@@ -3,7 +3,10 @@
 package lru
 
 import (
+	"context"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/juntaki/transparent"
 )
@@ -14,13 +17,20 @@ type storage struct {
 	listHead       *keyValue
 	currentEntries int
 	maxEntries     int
+	version        uint64 // Last version of value
 }
 
 type keyValue struct {
-	key   interface{}
-	value interface{}
-	prev  *keyValue
-	next  *keyValue
+	key     interface{}
+	value   interface{}
+	expire  time.Time // Zero if it never expires
+	version string
+	prev    *keyValue
+	next    *keyValue
+}
+
+func (kv *keyValue) expired() bool {
+	return !kv.expire.IsZero() && kv.expire.Before(time.Now())
 }
 
 // NewStorage returns LRU Storage
@@ -40,9 +50,18 @@ func NewStorage(maxEntries int) transparent.BackendStorage {
 
 // Get value from cache if exist
 func (c *storage) Get(key interface{}) (value interface{}, err error) {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
+	// Lock for write, the list is modified
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.get(key)
+}
+
+func (c *storage) get(key interface{}) (value interface{}, err error) {
 	if kv, ok := c.hash[key]; ok {
+		if kv.expired() {
+			c.remove(kv)
+			return nil, &transparent.KeyNotFoundError{Key: key}
+		}
 		if kv != c.listHead.next {
 			listRemove(kv)
 			listAdd(c.listHead, kv)
@@ -54,14 +73,39 @@ func (c *storage) Get(key interface{}) (value interface{}, err error) {
 
 // Add value to cache
 func (c *storage) Add(key interface{}, value interface{}) (err error) {
+	return c.add(key, value, time.Time{})
+}
+
+// AddWithTTL add value to cache, it expires after ttl
+func (c *storage) AddWithTTL(ctx context.Context, key interface{}, value interface{}, ttl time.Duration) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	expire, err := transparent.ExpireAt(ttl)
+	if err != nil {
+		return err
+	}
+	return c.add(key, value, expire)
+}
+
+func (c *storage) add(key interface{}, value interface{}, expire time.Time) (err error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	c.put(key, value, expire)
+	return nil
+}
+
+func (c *storage) put(key interface{}, value interface{}, expire time.Time) string {
+	c.version++
+	version := strconv.FormatUint(c.version, 10)
 	if kv, ok := c.hash[key]; ok {
 		if kv != c.listHead.next {
 			listRemove(kv)
 			listAdd(c.listHead, kv)
 		}
 		kv.value = value
+		kv.expire = expire
+		kv.version = version
 	} else {
 		if c.maxEntries != c.currentEntries {
 			c.currentEntries++
@@ -72,13 +116,15 @@ func (c *storage) Add(key interface{}, value interface{}) (err error) {
 		}
 
 		kv := &keyValue{
-			key:   key,
-			value: value,
+			key:     key,
+			value:   value,
+			expire:  expire,
+			version: version,
 		}
 		listAdd(c.listHead, kv)
 		c.hash[key] = kv
 	}
-	return nil
+	return version
 }
 
 // Remove value from cache
@@ -86,9 +132,153 @@ func (c *storage) Remove(key interface{}) (err error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	if kv, ok := c.hash[key]; ok {
-		delete(c.hash, key)
-		listRemove(kv)
+		c.remove(kv)
+	}
+	return nil
+}
+
+func (c *storage) remove(kv *keyValue) {
+	delete(c.hash, kv.key)
+	listRemove(kv)
+	c.currentEntries--
+}
+
+// GetContext value from cache if exist
+func (c *storage) GetContext(ctx context.Context, key interface{}) (value interface{}, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Get(key)
+}
+
+// AddContext value to cache
+func (c *storage) AddContext(ctx context.Context, key interface{}, value interface{}) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Add(key, value)
+}
+
+// RemoveContext value from cache
+func (c *storage) RemoveContext(ctx context.Context, key interface{}) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Remove(key)
+}
+
+// GetMulti values from cache if exist
+func (c *storage) GetMulti(ctx context.Context, keys []interface{}) (map[interface{}]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	values := make(map[interface{}]interface{}, len(keys))
+	for _, key := range keys {
+		value, err := c.get(key)
+		if err == nil {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+// AddMulti values to cache
+func (c *storage) AddMulti(ctx context.Context, values map[interface{}]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key, value := range values {
+		c.put(key, value, time.Time{})
+	}
+	return nil
+}
+
+// RemoveMulti values from cache
+func (c *storage) RemoveMulti(ctx context.Context, keys []interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, key := range keys {
+		if kv, ok := c.hash[key]; ok {
+			c.remove(kv)
+		}
+	}
+	return nil
+}
+
+// Scan string keys in cache
+func (c *storage) Scan(ctx context.Context, r transparent.ScanRange) (*transparent.ScanPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	keys := make([]string, 0, len(c.hash))
+	for key, kv := range c.hash {
+		if s, ok := key.(string); ok && !kv.expired() {
+			keys = append(keys, s)
+		}
+	}
+	return transparent.ScanKeys(keys, r), nil
+}
+
+// GetVersion value and its version from cache if exist
+func (c *storage) GetVersion(ctx context.Context, key interface{}) (interface{}, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	value, err := c.get(key)
+	if err != nil {
+		return nil, "", err
+	}
+	return value, c.hash[key].version, nil
+}
+
+// AddIfAbsent add value to cache if the key doesn't exist
+func (c *storage) AddIfAbsent(ctx context.Context, key interface{}, value interface{}) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, err := c.get(key); err == nil {
+		return "", &transparent.VersionConflictError{Key: key}
+	}
+	return c.put(key, value, time.Time{}), nil
+}
+
+// AddIfVersion add value to cache if the version is matched
+func (c *storage) AddIfVersion(ctx context.Context, key interface{}, value interface{}, version string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, err := c.get(key); err != nil || c.hash[key].version != version {
+		return "", &transparent.VersionConflictError{Key: key}
+	}
+	return c.put(key, value, time.Time{}), nil
+}
+
+// RemoveIfVersion remove value from cache if the version is matched
+func (c *storage) RemoveIfVersion(ctx context.Context, key interface{}, version string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, err := c.get(key); err != nil || c.hash[key].version != version {
+		return &transparent.VersionConflictError{Key: key}
 	}
+	c.remove(c.hash[key])
 	return nil
 }
 
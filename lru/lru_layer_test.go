@@ -3,6 +3,7 @@ package lru
 import (
 	"testing"
 
+	"github.com/juntaki/transparent"
 	test "github.com/juntaki/transparent/test"
 )
 
@@ -13,3 +14,32 @@ func TestLRUCache(t *testing.T) {
 	}
 	test.BasicCacheFunc(t, c)
 }
+
+func TestLRUCacheContext(t *testing.T) {
+	c, err := NewCache(10, 100)
+	if err != nil {
+		t.Error(err)
+	}
+	stack := transparent.NewStack()
+	stack.Stack(test.NewSource(100))
+	stack.Stack(c)
+	stack.Start()
+	test.ContextStackFunc(t, stack)
+	stack.Stop()
+}
+
+func TestLRUCacheTTL(t *testing.T) {
+	c, err := NewCache(10, 100)
+	if err != nil {
+		t.Error(err)
+	}
+	stack := transparent.NewStack()
+	stack.Stack(test.NewSource(0))
+	stack.Stack(c)
+	stack.Start()
+	test.TTLStackFunc(t, stack)
+	test.MultiStackFunc(t, stack)
+	test.ScanStackFunc(t, stack)
+	test.VersionStackFunc(t, stack)
+	stack.Stop()
+}
@@ -9,4 +9,8 @@ import (
 func TestLRUStorage(t *testing.T) {
 	c := NewStorage(10)
 	test.BasicStorageFunc(t, c)
+	test.TTLStorageFunc(t, c)
+	test.MultiStorageFunc(t, c)
+	test.ScanStorageFunc(t, c)
+	test.VersionStorageFunc(t, c)
 }
@@ -0,0 +1,73 @@
+package transparent
+
+import (
+	"sync"
+	"time"
+)
+
+// negativeCache remembers keys which are not found in next layer
+type negativeCache struct {
+	lock   sync.Mutex
+	ttl    time.Duration
+	expire map[interface{}]time.Time
+	gen    uint64 // Incremented by every invalidation
+}
+
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	return &negativeCache{
+		ttl:    ttl,
+		expire: make(map[interface{}]time.Time),
+	}
+}
+
+// found returns true if the key is remembered as not found
+func (n *negativeCache) found(key interface{}) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	expire, ok := n.expire[key]
+	if !ok {
+		return false
+	}
+	if expire.Before(time.Now()) {
+		delete(n.expire, key)
+		return false
+	}
+	return true
+}
+
+// generation returns current generation, it should be passed to add
+func (n *negativeCache) generation() uint64 {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.gen
+}
+
+// add remembers the key, unless any key is invalidated since gen
+func (n *negativeCache) add(key interface{}, gen uint64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if gen != n.gen {
+		return
+	}
+	n.expire[key] = time.Now().Add(n.ttl)
+}
+
+// invalidate forgets the key
+func (n *negativeCache) invalidate(key interface{}) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.gen++
+	delete(n.expire, key)
+}
+
+// sweep deletes expired keys
+func (n *negativeCache) sweep() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	now := time.Now()
+	for key, expire := range n.expire {
+		if expire.Before(now) {
+			delete(n.expire, key)
+		}
+	}
+}
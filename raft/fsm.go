@@ -0,0 +1,180 @@
+package raft
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sync"
+
+	hraft "github.com/hashicorp/raft"
+	"github.com/juntaki/transparent"
+)
+
+// fsm applies committed operations by callback.
+// It keeps the latest Set of each key, to restore the next layer from snapshot.
+// UUID of the Set is kept with it, which is the version of the key in consensus layer.
+type fsm struct {
+	lock     sync.Mutex
+	callback func(m *transparent.Message) (*transparent.Message, error)
+	state    map[string][]byte // Payload of the latest Set
+	applied  uint64            // Index of the last applied operation
+	advanced chan bool         // Closed and replaced when applied is updated
+}
+
+func newFSM() *fsm {
+	return &fsm{state: make(map[string][]byte), advanced: make(chan bool)}
+}
+
+// snapshotData is persisted as snapshot
+type snapshotData struct {
+	Index uint64
+	State map[string][]byte
+}
+
+// Apply is called when the operation is committed.
+// The index is updated after callback, so that waiters see the result.
+func (f *fsm) Apply(l *hraft.Log) interface{} {
+	defer f.advance(l.Index)
+	operation, err := decode(l.Data)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	switch operation.Message {
+	case transparent.MessageSet:
+		f.state[fmt.Sprint(operation.Key)] = l.Data
+	case transparent.MessageRemove:
+		delete(f.state, fmt.Sprint(operation.Key))
+	}
+	f.lock.Unlock()
+
+	_, err = f.callback(operation)
+	if err == nil && operation.Message == transparent.MessageTransaction {
+		err = f.applyTransaction(operation)
+	}
+	return err
+}
+
+// applyTransaction keeps the writes of the transaction, which is applied by callback.
+// UUID of the transaction is kept as the version of the keys.
+func (f *fsm) applyTransaction(operation *transparent.Message) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, op := range operation.Batch {
+		switch op.Message {
+		case transparent.MessageSet:
+			payload, err := encode(&transparent.Message{Message: op.Message, Key: op.Key, Value: op.Value, UUID: operation.UUID})
+			if err != nil {
+				return err
+			}
+			f.state[fmt.Sprint(op.Key)] = payload
+		case transparent.MessageRemove:
+			delete(f.state, fmt.Sprint(op.Key))
+		}
+	}
+	return nil
+}
+
+// Snapshot returns current state, it is not called concurrently with Apply
+func (f *fsm) Snapshot() (hraft.FSMSnapshot, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	data := &snapshotData{Index: f.applied, State: make(map[string][]byte, len(f.state))}
+	for key, payload := range f.state {
+		data.State[key] = payload
+	}
+	return data, nil
+}
+
+// Restore replaces the next layer with snapshot.
+// Keys not in snapshot are removed.
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var data snapshotData
+	err := gob.NewDecoder(rc).Decode(&data)
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	old := f.state
+	f.state = data.State
+	if f.state == nil {
+		f.state = make(map[string][]byte)
+	}
+	f.lock.Unlock()
+
+	for key, payload := range old {
+		if _, ok := data.State[key]; ok {
+			continue
+		}
+		operation, err := decode(payload)
+		if err != nil {
+			return err
+		}
+		_, err = f.callback(&transparent.Message{Message: transparent.MessageRemove, Key: operation.Key})
+		if err != nil {
+			return err
+		}
+	}
+	for _, payload := range data.State {
+		operation, err := decode(payload)
+		if err != nil {
+			return err
+		}
+		// UUID is kept, it is the version of the key
+		_, err = f.callback(operation)
+		if err != nil {
+			return err
+		}
+	}
+	f.advance(data.Index)
+	return nil
+}
+
+// advance updates the index of the last applied operation, and wakes up waiters
+func (f *fsm) advance(index uint64) {
+	f.lock.Lock()
+	f.applied = index
+	close(f.advanced)
+	f.advanced = make(chan bool)
+	f.lock.Unlock()
+}
+
+// index returns the index of the last applied operation
+func (f *fsm) index() uint64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.applied
+}
+
+// wait until the operation of index is applied
+func (f *fsm) wait(ctx context.Context, index uint64) error {
+	for {
+		f.lock.Lock()
+		applied, advanced := f.applied, f.advanced
+		f.lock.Unlock()
+		if applied >= index {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-advanced:
+		}
+	}
+}
+
+// Persist writes snapshot to sink
+func (s *snapshotData) Persist(sink hraft.SnapshotSink) error {
+	err := gob.NewEncoder(sink).Encode(s)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// Release do nothing
+func (s *snapshotData) Release() {}
@@ -0,0 +1,313 @@
+// Package raft is Raft consensus implements for key-value store
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+
+	hraft "github.com/hashicorp/raft"
+	"github.com/juntaki/transparent"
+)
+
+// Forwarder sends payload of follower to leader, and returns the result of Node.Handle on leader.
+type Forwarder func(ctx context.Context, leader hraft.ServerID, payload []byte) (index uint64, err error)
+
+// Config of Node
+type Config struct {
+	ID        hraft.ServerID  // Unique ID in the cluster
+	Transport hraft.Transport // Transport to other nodes
+
+	// Servers bootstraps new cluster with them.
+	// Empty if the node joins existing cluster by AddVoter.
+	Servers []hraft.Server
+
+	// Forward is used by follower to request leader.
+	// If nil, Request of follower returns NotLeaderError.
+	Forward Forwarder
+
+	// Stores of log, state and snapshot, in memory if nil.
+	// Use persistent stores to recover from crash.
+	LogStore      hraft.LogStore
+	StableStore   hraft.StableStore
+	SnapshotStore hraft.SnapshotStore
+
+	// Raft is the base configuration, hashicorp/raft DefaultConfig if nil.
+	// LocalID is overwritten by ID.
+	Raft *hraft.Config
+
+	// Timeout of operations without deadline, default is 10 seconds.
+	Timeout time.Duration
+}
+
+// NotLeaderError means the operation must be requested to leader
+type NotLeaderError struct {
+	Leader hraft.ServerID // Empty if leader is unknown
+}
+
+func (e *NotLeaderError) Error() string {
+	return fmt.Sprintf("not leader, leader is %q", e.Leader)
+}
+
+// Node is BackendTransmitter, which replicates operations by Raft.
+// Committed operations are applied by callback in the same order on all nodes.
+type Node struct {
+	config       Config
+	raft         *hraft.Raft
+	fsm          *fsm
+	leaseTimeout time.Duration
+	lock         sync.Mutex
+	lease        time.Time // Leadership is confirmed until lease
+	leaseTerm    uint64    // Term of the lease
+}
+
+// NewNode returns Node
+func NewNode(config Config) (*Node, error) {
+	if config.ID == "" {
+		return nil, errors.New("empty ID")
+	}
+	if config.Transport == nil {
+		return nil, errors.New("empty transport")
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.LogStore == nil || config.StableStore == nil {
+		store := hraft.NewInmemStore()
+		if config.LogStore == nil {
+			config.LogStore = store
+		}
+		if config.StableStore == nil {
+			config.StableStore = store
+		}
+	}
+	if config.SnapshotStore == nil {
+		config.SnapshotStore = hraft.NewInmemSnapshotStore()
+	}
+	return &Node{
+		config: config,
+		fsm:    newFSM(),
+	}, nil
+}
+
+// NewTCPTransport returns Transport listening the address
+func NewTCPTransport(address string) (hraft.Transport, error) {
+	return hraft.NewTCPTransport(address, nil, 3, 10*time.Second, ioutil.Discard)
+}
+
+// Start starts Raft, and bootstraps cluster if the node has no state
+func (n *Node) Start() error {
+	var conf hraft.Config
+	if n.config.Raft != nil {
+		conf = *n.config.Raft
+	} else {
+		conf = *hraft.DefaultConfig()
+		conf.LogOutput = ioutil.Discard
+	}
+	conf.LocalID = n.config.ID
+	n.leaseTimeout = conf.LeaderLeaseTimeout
+
+	if len(n.config.Servers) > 0 {
+		exists, err := hraft.HasExistingState(n.config.LogStore, n.config.StableStore, n.config.SnapshotStore)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			err = hraft.BootstrapCluster(&conf, n.config.LogStore, n.config.StableStore,
+				n.config.SnapshotStore, n.config.Transport, hraft.Configuration{Servers: n.config.Servers})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	r, err := hraft.NewRaft(&conf, n.fsm, n.config.LogStore, n.config.StableStore,
+		n.config.SnapshotStore, n.config.Transport)
+	if err != nil {
+		return err
+	}
+	n.raft = r
+	return nil
+}
+
+// Stop shutdowns Raft
+func (n *Node) Stop() error {
+	return n.raft.Shutdown().Error()
+}
+
+// SetCallback sets the function to apply committed operation
+func (n *Node) SetCallback(cb func(m *transparent.Message) (*transparent.Message, error)) error {
+	n.fsm.callback = cb
+	return nil
+}
+
+// Request replicates the operation
+func (n *Node) Request(operation *transparent.Message) (*transparent.Message, error) {
+	return n.RequestContext(context.Background(), operation)
+}
+
+// RequestContext replicates the operation, and returns after it is committed.
+// Follower forwards it to leader.
+func (n *Node) RequestContext(ctx context.Context, operation *transparent.Message) (*transparent.Message, error) {
+	payload, err := encode(operation)
+	if err != nil {
+		return nil, err
+	}
+	if n.raft.State() == hraft.Leader {
+		_, err = n.Handle(ctx, payload)
+	} else {
+		_, err = n.forward(ctx, payload)
+	}
+	return nil, err
+}
+
+// Handle applies payload forwarded from follower, and returns its index.
+// Empty payload is request of read index, see LinearizableRead.
+// It must be called on leader.
+func (n *Node) Handle(ctx context.Context, payload []byte) (uint64, error) {
+	if len(payload) == 0 {
+		return n.readIndex(ctx)
+	}
+	f := n.raft.Apply(payload, n.timeout(ctx))
+	err := f.Error()
+	if err != nil {
+		return 0, n.wrap(err)
+	}
+	return f.Index(), nil
+}
+
+// LinearizableRead waits until the operations committed before it are applied to this node.
+// Reading the next layer after it returns the latest value.
+func (n *Node) LinearizableRead(ctx context.Context) error {
+	var index uint64
+	var err error
+	if n.raft.State() == hraft.Leader {
+		index, err = n.readIndex(ctx)
+	} else {
+		index, err = n.forward(ctx, nil)
+	}
+	if err != nil {
+		return err
+	}
+	return n.fsm.wait(ctx, index)
+}
+
+// ReadIndex is LinearizableRead
+func (n *Node) ReadIndex(ctx context.Context) error {
+	return n.LinearizableRead(ctx)
+}
+
+// ReadLease is LinearizableRead, but leader skips Barrier while its lease is valid.
+// The lease lasts LeaderLeaseTimeout from the last Barrier in the same term, leader steps down
+// without contact to quorum in it. Follower has no lease, and asks leader.
+func (n *Node) ReadLease(ctx context.Context) error {
+	n.lock.Lock()
+	valid := time.Now().Before(n.lease) && n.leaseTerm == n.term()
+	n.lock.Unlock()
+	if valid && n.raft.State() == hraft.Leader {
+		// Committed operations are applied on leader before they are returned
+		return nil
+	}
+	return n.LinearizableRead(ctx)
+}
+
+// term returns the current term of raft
+func (n *Node) term() uint64 {
+	term, _ := strconv.ParseUint(n.raft.Stats()["term"], 10, 64)
+	return term
+}
+
+// readIndex confirms leadership by Barrier, and returns the index of applied operation
+func (n *Node) readIndex(ctx context.Context) (uint64, error) {
+	start, term := time.Now(), n.term()
+	err := n.raft.Barrier(n.timeout(ctx)).Error()
+	if err != nil {
+		return 0, n.wrap(err)
+	}
+	n.lock.Lock()
+	n.lease, n.leaseTerm = start.Add(n.leaseTimeout), term
+	n.lock.Unlock()
+	return n.fsm.index(), nil
+}
+
+// forward payload to leader, it waits for election if leader is unknown
+func (n *Node) forward(ctx context.Context, payload []byte) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, n.timeout(ctx))
+	defer cancel()
+	for {
+		_, leader := n.raft.LeaderWithID()
+		if leader != "" {
+			if n.config.Forward == nil {
+				return 0, &NotLeaderError{Leader: leader}
+			}
+			return n.config.Forward(ctx, leader, payload)
+		}
+		select {
+		case <-ctx.Done():
+			return 0, &NotLeaderError{}
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Leader returns ID of current leader, empty if it is unknown
+func (n *Node) Leader() hraft.ServerID {
+	_, id := n.raft.LeaderWithID()
+	return id
+}
+
+// AddVoter adds the server to the cluster, it must be called on leader
+func (n *Node) AddVoter(ctx context.Context, id hraft.ServerID, address hraft.ServerAddress) error {
+	return n.wrap(n.raft.AddVoter(id, address, 0, n.timeout(ctx)).Error())
+}
+
+// RemoveServer removes the server from the cluster, it must be called on leader
+func (n *Node) RemoveServer(ctx context.Context, id hraft.ServerID) error {
+	return n.wrap(n.raft.RemoveServer(id, 0, n.timeout(ctx)).Error())
+}
+
+// Snapshot takes snapshot, and compacts the log
+func (n *Node) Snapshot() error {
+	return n.raft.Snapshot().Error()
+}
+
+// timeout returns the duration until deadline of ctx, or default timeout
+func (n *Node) timeout(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Until(deadline)
+	}
+	return n.config.Timeout
+}
+
+// wrap hashicorp/raft errors of leadership
+func (n *Node) wrap(err error) error {
+	if err == hraft.ErrNotLeader || err == hraft.ErrLeadershipLost {
+		_, leader := n.raft.LeaderWithID()
+		return &NotLeaderError{Leader: leader}
+	}
+	return err
+}
+
+func encode(operation *transparent.Message) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := gob.NewEncoder(buf).Encode(operation)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decode(payload []byte) (*transparent.Message, error) {
+	var operation transparent.Message
+	err := gob.NewDecoder(bytes.NewBuffer(payload)).Decode(&operation)
+	if err != nil {
+		return nil, err
+	}
+	return &operation, nil
+}
@@ -0,0 +1,17 @@
+package raft
+
+import "github.com/juntaki/transparent"
+
+// NewConsensus returns Raft consensus layer
+func NewConsensus(config Config) (transparent.Layer, error) {
+	node, err := NewNode(config)
+	if err != nil {
+		return nil, err
+	}
+	c, err := transparent.NewLayerConsensus(node)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
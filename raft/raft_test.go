@@ -0,0 +1,329 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	hraft "github.com/hashicorp/raft"
+	"github.com/juntaki/transparent"
+	"github.com/juntaki/transparent/test"
+)
+
+// cluster is in-process Raft cluster with in memory transport
+type cluster struct {
+	lock       sync.Mutex
+	nodes      map[hraft.ServerID]*Node
+	transports map[hraft.ServerID]*hraft.InmemTransport
+	stacks     map[hraft.ServerID]*transparent.Stack
+	sources    map[hraft.ServerID]transparent.Layer
+}
+
+func fastConfig() *hraft.Config {
+	conf := hraft.DefaultConfig()
+	conf.HeartbeatTimeout = 50 * time.Millisecond
+	conf.ElectionTimeout = 50 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.CommitTimeout = 5 * time.Millisecond
+	conf.TrailingLogs = 1
+	conf.LogOutput = ioutil.Discard
+	return conf
+}
+
+func (c *cluster) forward(ctx context.Context, leader hraft.ServerID, payload []byte) (uint64, error) {
+	c.lock.Lock()
+	n := c.nodes[leader]
+	c.lock.Unlock()
+	return n.Handle(ctx, payload)
+}
+
+// add starts a node, bootstrap cluster with servers if not empty
+func (c *cluster) add(t *testing.T, id hraft.ServerID, servers []hraft.Server) {
+	_, transport := hraft.NewInmemTransport(hraft.ServerAddress(id))
+	c.lock.Lock()
+	for other, tr := range c.transports {
+		transport.Connect(hraft.ServerAddress(other), tr)
+		tr.Connect(hraft.ServerAddress(id), transport)
+	}
+	c.transports[id] = transport
+	c.lock.Unlock()
+
+	node, err := NewNode(Config{
+		ID:        id,
+		Transport: transport,
+		Servers:   servers,
+		Forward:   c.forward,
+		Raft:      fastConfig(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	consensus, err := transparent.NewLayerConsensus(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := test.NewSource(0)
+	s := transparent.NewStack()
+	s.Stack(source)
+	s.Stack(consensus)
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.lock.Lock()
+	c.nodes[id] = node
+	c.stacks[id] = s
+	c.sources[id] = source
+	c.lock.Unlock()
+}
+
+func newCluster(t *testing.T, n int) *cluster {
+	c := &cluster{
+		nodes:      make(map[hraft.ServerID]*Node),
+		transports: make(map[hraft.ServerID]*hraft.InmemTransport),
+		stacks:     make(map[hraft.ServerID]*transparent.Stack),
+		sources:    make(map[hraft.ServerID]transparent.Layer),
+	}
+	servers := []hraft.Server{}
+	for i := 0; i < n; i++ {
+		id := hraft.ServerID(fmt.Sprintf("node%d", i))
+		servers = append(servers, hraft.Server{ID: id, Address: hraft.ServerAddress(id)})
+	}
+	for _, server := range servers {
+		c.add(t, server.ID, servers)
+	}
+	c.leader(t)
+	return c
+}
+
+// leader waits for election, and returns the leader
+func (c *cluster) leader(t *testing.T) hraft.ServerID {
+	for i := 0; i < 200; i++ {
+		for id, n := range c.nodes {
+			if n.raft.State() == hraft.Leader {
+				return id
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("leader is not elected")
+	return ""
+}
+
+// follower returns a node which is not the leader
+func (c *cluster) follower(t *testing.T) hraft.ServerID {
+	leader := c.leader(t)
+	for id := range c.nodes {
+		if id != leader {
+			return id
+		}
+	}
+	t.Fatal("no follower")
+	return ""
+}
+
+func (c *cluster) stop(id hraft.ServerID) {
+	c.stacks[id].Stop()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.nodes, id)
+	delete(c.stacks, id)
+	delete(c.sources, id)
+}
+
+func (c *cluster) stopAll() {
+	for id := range c.nodes {
+		c.stop(id)
+	}
+}
+
+// checkReplicated checks that all sources have the value after linearizable read
+func (c *cluster) checkReplicated(t *testing.T, key string, value string) {
+	for id, n := range c.nodes {
+		err := n.LinearizableRead(context.Background())
+		if err != nil {
+			t.Fatal(id, err)
+		}
+		v, err := c.sources[id].Get(key)
+		if err != nil || string(v.([]byte)) != value {
+			t.Error(id, v, err)
+		}
+	}
+}
+
+func TestConsensus(t *testing.T) {
+	c := newCluster(t, 3)
+	defer c.stopAll()
+
+	test.BasicStackFunc(t, c.stacks[c.leader(t)])
+	test.BasicStackFunc(t, c.stacks[c.follower(t)])
+	test.TransactionStackFunc(t, c.stacks[c.leader(t)])
+	test.TransactionStackFunc(t, c.stacks[c.follower(t)])
+	test.ReadModeStackFunc(t, c.stacks[c.leader(t)], c.stacks[c.follower(t)])
+	test.ReadModeStackFunc(t, c.stacks[c.follower(t)], c.stacks[c.leader(t)])
+
+	err := c.stacks[c.follower(t)].Set("key", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.checkReplicated(t, "key", "value")
+}
+
+func TestTransactionHistory(t *testing.T) {
+	c := newCluster(t, 3)
+	defer c.stopAll()
+
+	// Versions of the next layer differ by local write
+	err := c.sources[c.follower(t)].Set("local", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.stacks[c.leader(t)].Set("key", []byte("value1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []hraft.ServerID{c.leader(t), c.follower(t)} {
+		s := c.stacks[id]
+		_, version, err := s.GetVersion(context.Background(), "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx := s.Begin()
+		tx.CompareAndSwap("key", []byte(string(id)), version)
+		err = tx.Commit(context.Background())
+		if err != nil {
+			t.Fatal(id, err)
+		}
+		c.checkReplicated(t, "key", string(id))
+	}
+}
+
+func TestTransactionRestart(t *testing.T) {
+	c := newCluster(t, 3)
+	defer c.stopAll()
+
+	s := c.stacks[c.leader(t)]
+	err := s.Set("key", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := s.Begin()
+	tx.Set("tx", []byte("value"))
+	err = tx.Commit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.nodes[c.leader(t)].Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restarted node is restored from snapshot, versions are the same as other nodes
+	restarted := c.follower(t)
+	c.stop(restarted)
+	c.add(t, restarted, nil)
+	err = c.nodes[restarted].LinearizableRead(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []hraft.ServerID{restarted, c.leader(t)} {
+		for _, key := range []string{"key", "tx"} {
+			_, version, err := c.stacks[id].GetVersion(context.Background(), key)
+			if err != nil {
+				t.Fatal(id, key, err)
+			}
+			for other, n := range c.nodes {
+				err = n.LinearizableRead(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, v, err := c.stacks[other].GetVersion(context.Background(), key)
+				if err != nil || v != version {
+					t.Error(other, key, err, v, version)
+				}
+			}
+			tx := c.stacks[id].Begin()
+			tx.CompareAndSwap(key, []byte(string(id)), version)
+			err = tx.Commit(context.Background())
+			if err != nil {
+				t.Fatal(id, key, err)
+			}
+			c.checkReplicated(t, key, string(id))
+		}
+	}
+}
+
+func TestLeaderFailure(t *testing.T) {
+	c := newCluster(t, 3)
+	defer c.stopAll()
+
+	err := c.stacks[c.leader(t)].Set("key", []byte("value1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.stop(c.leader(t))
+
+	// New leader is elected by remaining nodes
+	err = c.stacks[c.follower(t)].Set("key", []byte("value2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.checkReplicated(t, "key", "value2")
+}
+
+func TestSnapshotAndMembership(t *testing.T) {
+	c := newCluster(t, 3)
+	defer c.stopAll()
+
+	s := c.stacks[c.leader(t)]
+	for i := 0; i < 10; i++ {
+		err := s.Set(fmt.Sprintf("key%d", i), []byte("value"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Remove("key0")
+	leader := c.nodes[c.leader(t)]
+	err := leader.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// New node is restored from snapshot
+	c.add(t, "node3", nil)
+	err = leader.AddVoter(context.Background(), "node3", "node3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.nodes["node3"].LinearizableRead(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 10; i++ {
+		_, err := c.sources["node3"].Get(fmt.Sprintf("key%d", i))
+		if err != nil {
+			t.Error(i, err)
+		}
+	}
+	_, err = c.sources["node3"].Get("key0")
+	if err == nil {
+		t.Error("removed key is restored")
+	}
+
+	err = c.nodes[c.follower(t)].AddVoter(context.Background(), "node4", "node4")
+	if _, ok := err.(*NotLeaderError); !ok {
+		t.Error(err)
+	}
+	err = leader.RemoveServer(context.Background(), "node3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := leader.raft.GetConfiguration()
+	if err := future.Error(); err != nil || len(future.Configuration().Servers) != 3 {
+		t.Error(err, future.Configuration())
+	}
+}
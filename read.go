@@ -0,0 +1,47 @@
+package transparent
+
+import "context"
+
+// ReadMode is consistency of Get from consensus layer.
+// Layers above consensus, such as cache, return the value they have.
+type ReadMode int
+
+const (
+	// ReadLocal reads the next layer as it is, the value may be stale
+	ReadLocal ReadMode = iota
+	// ReadIndex confirms with the cluster that the latest commit is applied before read
+	ReadIndex
+	// ReadLease is ReadIndex, but the confirmation may be skipped while the lease is valid
+	ReadLease
+)
+
+// readModeKey is key of ReadMode in context
+type readModeKey struct{}
+
+// WithReadMode returns context, which overrides ReadMode of Stack for the call
+func WithReadMode(ctx context.Context, mode ReadMode) context.Context {
+	return context.WithValue(ctx, readModeKey{}, mode)
+}
+
+// readModeOf returns ReadMode of the context, or def if not set
+func readModeOf(ctx context.Context, def ReadMode) ReadMode {
+	if mode, ok := ctx.Value(readModeKey{}).(ReadMode); ok {
+		return mode
+	}
+	return def
+}
+
+// readModer is Layer which reads by ReadMode
+type readModer interface {
+	setReadMode(mode ReadMode)
+}
+
+// SetReadMode sets ReadMode of all consensus layers in the Stack, default is ReadLocal
+func (s *Stack) SetReadMode(mode ReadMode) {
+	s.readMode = mode
+	for _, l := range s.all {
+		if r, ok := l.(readModer); ok {
+			r.setReadMode(mode)
+		}
+	}
+}
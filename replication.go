@@ -0,0 +1,561 @@
+package transparent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type layerReplication struct {
+	replicas  []Layer
+	write     int
+	read      int
+	tombstone time.Duration
+	clock     uint64
+	repairing sync.WaitGroup
+	hub       *watchHub
+}
+
+// ReplicationOption configures LayerReplication
+type ReplicationOption func(r *layerReplication)
+
+// WithWriteQuorum sets the number of replicas to acknowledge write.
+// Default is majority of replicas.
+func WithWriteQuorum(w int) ReplicationOption {
+	return func(r *layerReplication) {
+		r.write = w
+	}
+}
+
+// WithReadQuorum sets the number of replicas to respond read.
+// Default is majority of replicas.
+func WithReadQuorum(n int) ReplicationOption {
+	return func(r *layerReplication) {
+		r.read = n
+	}
+}
+
+// WithTombstoneTTL sets TTL of tombstone written by Remove.
+// Default is 0, tombstones never expire.
+// Removed key may be resurrected by read-repair, if its tombstone expired before repaired.
+func WithTombstoneTTL(ttl time.Duration) ReplicationOption {
+	return func(r *layerReplication) {
+		r.tombstone = ttl
+	}
+}
+
+// NewLayerReplication returns LayerReplication.
+// LayerReplication writes value to all replicas, and succeeds if W replicas acknowledged.
+// It reads value from R replicas, and returns the newest version of them.
+// Stale replicas found by read are repaired asynchronously, only if the replica is not changed after the read.
+// Replica without version support is checked again just before the repair, so a write between them may be overwritten.
+// If R + W is greater than the number of replicas, read always sees the latest write.
+//
+// Values must be []byte, they are stored with version as timestamp.
+// Concurrent writes to the key are resolved by last writer wins.
+// Remove writes tombstone, so that the removed value is not repaired.
+// This layer must be the bottom of Stack.
+func NewLayerReplication(replicas []Layer, options ...ReplicationOption) (Layer, error) {
+	if len(replicas) == 0 {
+		return nil, errors.New("empty replicas")
+	}
+	r := &layerReplication{
+		replicas: replicas,
+		write:    len(replicas)/2 + 1,
+		read:     len(replicas)/2 + 1,
+	}
+	for _, option := range options {
+		option(r)
+	}
+	if r.write <= 0 || r.write > len(replicas) {
+		return nil, errors.New("write quorum must be between 1 and the number of replicas")
+	}
+	if r.read <= 0 || r.read > len(replicas) {
+		return nil, errors.New("read quorum must be between 1 and the number of replicas")
+	}
+	if r.tombstone < 0 {
+		return nil, errors.New("tombstone ttl must not be negative")
+	}
+	return r, nil
+}
+
+// QuorumError means less replicas than quorum succeeded
+type QuorumError struct {
+	Key      interface{}
+	Required int
+	Acks     int
+	Err      error // Last error of replicas
+}
+
+func (e *QuorumError) Error() string {
+	return fmt.Sprintf("%d of %d replicas required for key %v: %s", e.Acks, e.Required, e.Key, e.Err)
+}
+
+// versioned is a value stored in replicas
+type versioned struct {
+	version uint64
+	expire  time.Time // Zero if the key never expires
+	deleted bool
+	value   []byte
+}
+
+// encode to version (8 bytes), expire in unix nano (8 bytes), tombstone flag (1 byte), and value
+func (v *versioned) encode() []byte {
+	b := make([]byte, 17+len(v.value))
+	binary.BigEndian.PutUint64(b, v.version)
+	if !v.expire.IsZero() {
+		binary.BigEndian.PutUint64(b[8:], uint64(v.expire.UnixNano()))
+	}
+	if v.deleted {
+		b[16] = 1
+	}
+	copy(b[17:], v.value)
+	return b
+}
+
+// decodeVersioned decodes value, expired value is decoded as tombstone
+func decodeVersioned(value interface{}) (*versioned, error) {
+	b, ok := value.([]byte)
+	if !ok || len(b) < 17 {
+		return nil, errors.New("invalid replicated value")
+	}
+	v := &versioned{
+		version: binary.BigEndian.Uint64(b),
+		deleted: b[16] == 1,
+		value:   b[17:],
+	}
+	if expire := binary.BigEndian.Uint64(b[8:]); expire != 0 {
+		v.expire = time.Unix(0, int64(expire))
+		v.deleted = v.deleted || !v.expire.After(time.Now())
+	}
+	return v, nil
+}
+
+// newer returns true if v is newer than o, nil is the oldest
+func (v *versioned) newer(o *versioned) bool {
+	return v != nil && (o == nil || v.version > o.version)
+}
+
+// next returns new version, it is current time but greater than previous one
+func (r *layerReplication) next() uint64 {
+	for {
+		last := atomic.LoadUint64(&r.clock)
+		version := uint64(time.Now().UnixNano())
+		if version <= last {
+			version = last + 1
+		}
+		if atomic.CompareAndSwapUint64(&r.clock, last, version) {
+			return version
+		}
+	}
+}
+
+// replicaRead is response of a replica, v is nil if the key is not found
+type replicaRead struct {
+	replica Layer
+	v       *versioned
+	version string // Version of the value in the replica
+	checked bool   // Replica supports version, it is repaired by conditional write
+	err     error
+}
+
+// get reads the key from R replicas, and repairs stale replicas
+func (r *layerReplication) get(ctx context.Context, key interface{}) (*versioned, error) {
+	results := make(chan *replicaRead, len(r.replicas))
+	for _, l := range r.replicas {
+		go func(l Layer) {
+			res := &replicaRead{replica: l}
+			value, version, err := l.GetVersion(ctx, key)
+			_, notFound := err.(*KeyNotFoundError)
+			res.checked = err == nil || notFound
+			if !res.checked {
+				// The replica may not support version
+				value, err = l.GetContext(ctx, key)
+			}
+			if err == nil {
+				res.version = version
+				res.v, res.err = decodeVersioned(value)
+			} else if _, ok := err.(*KeyNotFoundError); !ok {
+				res.err = err
+			}
+			results <- res
+		}(l)
+	}
+
+	responses := []*replicaRead{}
+	var newest *versioned
+	var lastErr error
+	acks := 0
+	for acks < r.read && len(responses)-acks <= len(r.replicas)-r.read {
+		res := <-results
+		responses = append(responses, res)
+		if res.err != nil {
+			lastErr = res.err
+			continue
+		}
+		acks++
+		if res.v.newer(newest) {
+			newest = res.v
+		}
+	}
+
+	r.repairing.Add(1)
+	go r.repair(key, responses, results)
+
+	if acks < r.read {
+		return nil, &QuorumError{Key: key, Required: r.read, Acks: acks, Err: lastErr}
+	}
+	return newest, nil
+}
+
+// repair waits for all responses, and writes the newest value to stale replicas
+func (r *layerReplication) repair(key interface{}, responses []*replicaRead, results chan *replicaRead) {
+	defer r.repairing.Done()
+	for len(responses) < len(r.replicas) {
+		responses = append(responses, <-results)
+	}
+	var newest *versioned
+	for _, res := range responses {
+		if res.err == nil && res.v.newer(newest) {
+			newest = res.v
+		}
+	}
+	if newest == nil {
+		return
+	}
+	for _, res := range responses {
+		if res.err == nil && newest.newer(res.v) {
+			r.storeIf(context.Background(), res.replica, key, newest, res)
+		}
+	}
+}
+
+// store writes versioned value to the replica, with TTL until it expires
+func (r *layerReplication) store(ctx context.Context, l Layer, key interface{}, v *versioned) error {
+	if v.expire.IsZero() {
+		return l.SetContext(ctx, key, v.encode())
+	}
+	ttl := time.Until(v.expire)
+	if ttl <= 0 {
+		return nil
+	}
+	return l.SetWithTTL(ctx, key, v.encode(), ttl)
+}
+
+// storeIf writes versioned value to the replica, if the replica is not changed from the read.
+// Conflict means the replica is written after the read, it is not repaired.
+func (r *layerReplication) storeIf(ctx context.Context, l Layer, key interface{}, v *versioned, read *replicaRead) error {
+	if !v.expire.IsZero() && !v.expire.After(time.Now()) {
+		return nil
+	}
+	if !read.checked {
+		// Without version, check the replica is still older
+		value, err := l.GetContext(ctx, key)
+		if err == nil {
+			current, err := decodeVersioned(value)
+			if err != nil {
+				return err
+			}
+			if !v.newer(current) {
+				return nil
+			}
+		} else if _, ok := err.(*KeyNotFoundError); !ok {
+			return err
+		}
+		return r.store(ctx, l, key, v)
+	}
+	if read.v != nil {
+		_, err := l.CompareAndSwap(ctx, key, v.encode(), read.version)
+		return err
+	}
+	_, err := l.SetIfAbsent(ctx, key, v.encode())
+	return err
+}
+
+// put writes versioned value to all replicas, and waits for W acknowledgements
+func (r *layerReplication) put(ctx context.Context, key interface{}, v *versioned) error {
+	results := make(chan error, len(r.replicas))
+	for _, l := range r.replicas {
+		go func(l Layer) {
+			results <- r.store(ctx, l, key, v)
+		}(l)
+	}
+	var lastErr error
+	acks, failures := 0, 0
+	for acks < r.write {
+		err := <-results
+		if err != nil {
+			lastErr = err
+			failures++
+			if failures > len(r.replicas)-r.write {
+				return &QuorumError{Key: key, Required: r.write, Acks: acks, Err: lastErr}
+			}
+			continue
+		}
+		acks++
+	}
+	return nil
+}
+
+func (r *layerReplication) set(ctx context.Context, key interface{}, value interface{}, ttl time.Duration) error {
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("replication supports only []byte value")
+	}
+	v := &versioned{version: r.next(), value: b}
+	if ttl > 0 {
+		v.expire = time.Now().Add(ttl)
+	}
+	err := r.put(ctx, key, v)
+	if err != nil {
+		return err
+	}
+	r.hub.notify(r, MessageSet, key, value)
+	return nil
+}
+
+// Set set the value to replicas
+func (r *layerReplication) Set(key interface{}, value interface{}) error {
+	return r.SetContext(context.Background(), key, value)
+}
+
+// SetContext set the value to replicas
+func (r *layerReplication) SetContext(ctx context.Context, key interface{}, value interface{}) error {
+	return r.set(ctx, key, value, 0)
+}
+
+// SetWithTTL set the value to replicas, it expires after ttl
+func (r *layerReplication) SetWithTTL(ctx context.Context, key interface{}, value interface{}, ttl time.Duration) error {
+	if _, err := ExpireAt(ttl); err != nil {
+		return err
+	}
+	return r.set(ctx, key, value, ttl)
+}
+
+// Get get the newest value from replicas
+func (r *layerReplication) Get(key interface{}) (value interface{}, err error) {
+	return r.GetContext(context.Background(), key)
+}
+
+// GetContext get the newest value from replicas
+func (r *layerReplication) GetContext(ctx context.Context, key interface{}) (value interface{}, err error) {
+	v, err := r.get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil || v.deleted {
+		return nil, &KeyNotFoundError{Key: key}
+	}
+	return v.value, nil
+}
+
+// Remove write tombstone of the key to replicas
+func (r *layerReplication) Remove(key interface{}) error {
+	return r.RemoveContext(context.Background(), key)
+}
+
+// RemoveContext write tombstone of the key to replicas
+func (r *layerReplication) RemoveContext(ctx context.Context, key interface{}) error {
+	v := &versioned{version: r.next(), deleted: true}
+	if r.tombstone > 0 {
+		v.expire = time.Now().Add(r.tombstone)
+	}
+	err := r.put(ctx, key, v)
+	if err != nil {
+		return err
+	}
+	r.hub.notify(r, MessageRemove, key, nil)
+	return nil
+}
+
+// GetMulti get the newest values of each key from replicas
+func (r *layerReplication) GetMulti(ctx context.Context, keys []interface{}) (map[interface{}]interface{}, error) {
+	return getEach(ctx, r, keys)
+}
+
+// SetMulti set each value to replicas
+func (r *layerReplication) SetMulti(ctx context.Context, values map[interface{}]interface{}) error {
+	return setEach(ctx, r, values)
+}
+
+// RemoveMulti write tombstone of each key to replicas
+func (r *layerReplication) RemoveMulti(ctx context.Context, keys []interface{}) error {
+	return removeEach(ctx, r, keys)
+}
+
+// Scan scan keys of replicas, removed keys are excluded by reading them.
+// Next pages are scanned until the page has Limit keys or the range ends.
+// It fails if less than R replicas responded.
+// Unlike Get, stale replicas found by Scan are not repaired.
+func (r *layerReplication) Scan(ctx context.Context, sr ScanRange) (*ScanPage, error) {
+	result := &ScanPage{Keys: []string{}}
+	limit := sr.Limit
+	for {
+		page, err := r.scan(ctx, sr)
+		if err != nil {
+			return nil, err
+		}
+		result.Keys = append(result.Keys, page.Keys...)
+		result.Next = page.Next
+		if limit == 0 || page.Next == "" || len(result.Keys) >= limit {
+			return result, nil
+		}
+		sr.After = page.Next
+		sr.Limit = limit - len(result.Keys)
+	}
+}
+
+// scan a page of keys of replicas, and excludes removed keys.
+// The page may be short or empty, even if Next is set.
+func (r *layerReplication) scan(ctx context.Context, sr ScanRange) (*ScanPage, error) {
+	pages := make([]*ScanPage, 0, len(r.replicas))
+	var lastErr error
+	for _, l := range r.replicas {
+		page, err := l.Scan(ctx, sr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		pages = append(pages, page)
+	}
+	if len(pages) < r.read {
+		return nil, &QuorumError{Required: r.read, Acks: len(pages), Err: lastErr}
+	}
+	page := mergePages(sr, pages...)
+	keys := make([]interface{}, 0, len(page.Keys))
+	for _, key := range page.Keys {
+		keys = append(keys, key)
+	}
+	newest, err := r.newest(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	alive := []string{}
+	for _, key := range page.Keys {
+		if v := newest[key]; v != nil && !v.deleted {
+			alive = append(alive, key)
+		}
+	}
+	page.Keys = alive
+	return page, nil
+}
+
+// multiRead is response of a replica to GetMulti
+type multiRead struct {
+	values map[interface{}]interface{}
+	err    error
+}
+
+// newest reads the keys from R replicas at once, and returns the newest of each key.
+// Stale replicas are not repaired.
+func (r *layerReplication) newest(ctx context.Context, keys []interface{}) (map[interface{}]*versioned, error) {
+	results := make(chan *multiRead, len(r.replicas))
+	for _, l := range r.replicas {
+		go func(l Layer) {
+			values, err := l.GetMulti(ctx, keys)
+			results <- &multiRead{values: values, err: err}
+		}(l)
+	}
+	newest := make(map[interface{}]*versioned, len(keys))
+	var lastErr error
+	acks, failures := 0, 0
+	for acks < r.read {
+		res := <-results
+		if res.err != nil {
+			lastErr = res.err
+			failures++
+			if failures > len(r.replicas)-r.read {
+				return nil, &QuorumError{Required: r.read, Acks: acks, Err: lastErr}
+			}
+			continue
+		}
+		for key, value := range res.values {
+			v, err := decodeVersioned(value)
+			if err != nil {
+				return nil, err
+			}
+			if v.newer(newest[key]) {
+				newest[key] = v
+			}
+		}
+		acks++
+	}
+	return newest, nil
+}
+
+// GetVersion get the newest value and its version from replicas
+func (r *layerReplication) GetVersion(ctx context.Context, key interface{}) (interface{}, string, error) {
+	v, err := r.get(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+	if v == nil || v.deleted {
+		return nil, "", &KeyNotFoundError{Key: key}
+	}
+	return v.value, strconv.FormatUint(v.version, 10), nil
+}
+
+// SetIfAbsent is not supported by Replication.
+func (r *layerReplication) SetIfAbsent(ctx context.Context, key interface{}, value interface{}) (string, error) {
+	return "", errors.New("replication doesn't support conditional write")
+}
+
+// CompareAndSwap is not supported by Replication.
+func (r *layerReplication) CompareAndSwap(ctx context.Context, key interface{}, value interface{}, version string) (string, error) {
+	return "", errors.New("replication doesn't support conditional write")
+}
+
+// RemoveIfVersion is not supported by Replication.
+func (r *layerReplication) RemoveIfVersion(ctx context.Context, key interface{}, version string) error {
+	return errors.New("replication doesn't support conditional write")
+}
+
+// Sync all replicas
+func (r *layerReplication) Sync() error {
+	return r.SyncContext(context.Background())
+}
+
+// SyncContext all replicas
+func (r *layerReplication) SyncContext(ctx context.Context) error {
+	for _, l := range r.replicas {
+		err := l.SyncContext(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *layerReplication) setHub(h *watchHub) {
+	r.hub = h
+}
+
+func (r *layerReplication) setNext(l Layer) error {
+	return errors.New("replication layer must be the bottom of Stack")
+}
+
+func (r *layerReplication) start() error {
+	for _, l := range r.replicas {
+		err := startLayer(l)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *layerReplication) stop() error {
+	r.repairing.Wait()
+	for _, l := range r.replicas {
+		err := stopLayer(l)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
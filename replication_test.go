@@ -0,0 +1,295 @@
+package transparent_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/juntaki/transparent"
+	"github.com/juntaki/transparent/test"
+)
+
+// replica is source layer, all operations fail while fail is true
+type replica struct {
+	transparent.Layer
+	storage  versionScanStorage // Storage without failure
+	fail     atomic.Bool
+	failures atomic.Int32 // Number of failed operations
+	hook     atomic.Value // func() called once before conditional write
+}
+
+// versionScanStorage is test.NewStorage
+type versionScanStorage interface {
+	transparent.BackendStorageVersion
+	Scan(ctx context.Context, r transparent.ScanRange) (*transparent.ScanPage, error)
+}
+
+// failingStorage fails while fail of the replica is true
+type failingStorage struct {
+	versionScanStorage
+	r *replica
+}
+
+func (s *failingStorage) check() error {
+	if s.r.fail.Load() {
+		s.r.failures.Add(1)
+		return errors.New("replica is down")
+	}
+	return nil
+}
+
+func (s *failingStorage) Get(k interface{}) (interface{}, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	return s.versionScanStorage.Get(k)
+}
+
+func (s *failingStorage) Add(k interface{}, v interface{}) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	return s.versionScanStorage.Add(k, v)
+}
+
+func (s *failingStorage) Remove(k interface{}) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	return s.versionScanStorage.Remove(k)
+}
+
+func (s *failingStorage) GetVersion(ctx context.Context, k interface{}) (interface{}, string, error) {
+	if err := s.check(); err != nil {
+		return nil, "", err
+	}
+	return s.versionScanStorage.GetVersion(ctx, k)
+}
+
+// before calls the hook once
+func (s *failingStorage) before() {
+	if hook, ok := s.r.hook.Swap(func() {}).(func()); ok {
+		hook()
+	}
+}
+
+func (s *failingStorage) AddIfAbsent(ctx context.Context, k interface{}, v interface{}) (string, error) {
+	if err := s.check(); err != nil {
+		return "", err
+	}
+	s.before()
+	return s.versionScanStorage.AddIfAbsent(ctx, k, v)
+}
+
+func (s *failingStorage) AddIfVersion(ctx context.Context, k interface{}, v interface{}, version string) (string, error) {
+	if err := s.check(); err != nil {
+		return "", err
+	}
+	s.before()
+	return s.versionScanStorage.AddIfVersion(ctx, k, v, version)
+}
+
+func (s *failingStorage) Scan(ctx context.Context, r transparent.ScanRange) (*transparent.ScanPage, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	return s.versionScanStorage.Scan(ctx, r)
+}
+
+func newReplica(t *testing.T) *replica {
+	r := &replica{storage: test.NewStorage(0).(versionScanStorage)}
+	var err error
+	r.Layer, err = transparent.NewLayerSource(&failingStorage{versionScanStorage: r.storage, r: r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func newReplicationStack(t *testing.T, replicas []transparent.Layer, options ...transparent.ReplicationOption) *transparent.Stack {
+	replication, err := transparent.NewLayerReplication(replicas, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := transparent.NewStack()
+	s.Stack(replication)
+	s.Start()
+	return s
+}
+
+func TestReplication(t *testing.T) {
+	replicas := []transparent.Layer{test.NewSource(0), test.NewSource(0), test.NewSource(0)}
+	s := newReplicationStack(t, replicas)
+	defer s.Stop()
+
+	test.BasicStackFunc(t, s)
+	test.MultiStackFunc(t, s)
+	test.TTLStackFunc(t, s)
+	test.ScanStackFunc(t, s)
+
+	err := s.Set("key", "not bytes")
+	if err == nil {
+		t.Error("non []byte value is set")
+	}
+	_, err = transparent.NewLayerReplication(replicas, transparent.WithWriteQuorum(4))
+	if err == nil {
+		t.Error("quorum is larger than replicas")
+	}
+}
+
+func TestReplicationQuorum(t *testing.T) {
+	a, b, c := newReplica(t), newReplica(t), newReplica(t)
+	s := newReplicationStack(t, []transparent.Layer{a, b, c})
+	defer s.Stop()
+
+	// Quorum is kept with a replica down
+	c.fail.Store(true)
+	err := s.Set("key", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := s.Get("key")
+	if err != nil || string(value.([]byte)) != "value" {
+		t.Fatal(err, value)
+	}
+
+	b.fail.Store(true)
+	err = s.Set("key", []byte("value"))
+	if _, ok := err.(*transparent.QuorumError); !ok {
+		t.Error(err)
+	}
+	_, err = s.Get("key")
+	if _, ok := err.(*transparent.QuorumError); !ok {
+		t.Error(err)
+	}
+}
+
+func TestReplicationReadRepair(t *testing.T) {
+	a, b, c := newReplica(t), newReplica(t), newReplica(t)
+	s := newReplicationStack(t, []transparent.Layer{a, b, c}, transparent.WithReadQuorum(3))
+	defer s.Stop()
+
+	err := s.Set("key", []byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write to c is not waited by quorum
+	waitFor(t, func() bool {
+		_, err := c.storage.Get("key")
+		return err == nil
+	})
+	c.fail.Store(true)
+	err = s.Set("key", []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return c.failures.Load() == 1 })
+	old, _ := c.storage.Get("key")
+	c.fail.Store(false)
+
+	// The newest version wins, and c is repaired
+	value, err := s.Get("key")
+	if err != nil || string(value.([]byte)) != "new" {
+		t.Fatal(err, value)
+	}
+	waitFor(t, func() bool {
+		repaired, _ := c.storage.Get("key")
+		return string(repaired.([]byte)) != string(old.([]byte))
+	})
+
+	// Tombstone is repaired, the removed value is not resurrected
+	c.fail.Store(true)
+	err = s.Remove("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return c.failures.Load() == 2 })
+	c.fail.Store(false)
+	_, err = s.Get("key")
+	if _, ok := err.(*transparent.KeyNotFoundError); !ok {
+		t.Fatal(err)
+	}
+	a.fail.Store(true)
+	b.fail.Store(true)
+	s2 := newReplicationStack(t, []transparent.Layer{a, b, c}, transparent.WithReadQuorum(1))
+	defer s2.Stop()
+	waitFor(t, func() bool {
+		_, err := s2.Get("key")
+		_, ok := err.(*transparent.KeyNotFoundError)
+		return ok
+	})
+}
+
+func TestReplicationScan(t *testing.T) {
+	a, b, c := newReplica(t), newReplica(t), newReplica(t)
+	s := newReplicationStack(t, []transparent.Layer{a, b, c})
+	defer s.Stop()
+
+	for _, key := range []string{"a", "b", "c"} {
+		err := s.Set(key, []byte("value"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := s.Remove("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Page is filled after removed keys are excluded
+	ctx := context.Background()
+	page, err := s.Scan(ctx, transparent.ScanRange{Limit: 2})
+	if err != nil || !reflect.DeepEqual(page.Keys, []string{"a", "c"}) {
+		t.Fatal(err, page)
+	}
+
+	// Scan tolerates N-R replicas down
+	c.fail.Store(true)
+	page, err = s.Scan(ctx, transparent.ScanRange{})
+	if err != nil || !reflect.DeepEqual(page.Keys, []string{"a", "c"}) {
+		t.Fatal(err, page)
+	}
+
+	b.fail.Store(true)
+	_, err = s.Scan(ctx, transparent.ScanRange{})
+	if _, ok := err.(*transparent.QuorumError); !ok {
+		t.Error(err)
+	}
+}
+
+func TestReplicationRepairConflict(t *testing.T) {
+	a, b, c := newReplica(t), newReplica(t), newReplica(t)
+	s := newReplicationStack(t, []transparent.Layer{a, b, c}, transparent.WithReadQuorum(3))
+
+	c.fail.Store(true)
+	err := s.Set("key", []byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return c.failures.Load() == 1 })
+	c.fail.Store(false)
+
+	// Newer write between read and repair is not overwritten by the repair
+	c.hook.Store(func() {
+		err := s.Set("key", []byte("new"))
+		if err != nil {
+			t.Error(err)
+		}
+		waitFor(t, func() bool {
+			_, err := c.storage.Get("key")
+			return err == nil
+		})
+	})
+	_, err = s.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Stop() // Wait for the repair
+	repaired, _ := c.storage.Get("key")
+	newest, _ := a.storage.Get("key")
+	if !reflect.DeepEqual(repaired, newest) {
+		t.Error(repaired, newest)
+	}
+}
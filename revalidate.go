@@ -0,0 +1,129 @@
+package transparent
+
+import (
+	"sync"
+	"time"
+)
+
+// freshness tracks when values are filled from next layer,
+// to serve stale value while it is refreshed in background.
+type freshness struct {
+	lock    sync.Mutex
+	soft    time.Duration // Value older than this is stale
+	hard    time.Duration // Value older than this is expired in Storage
+	ahead   time.Duration // Refresh hot value this duration before hard
+	hits    int           // Value read at least this times is hot
+	entries map[interface{}]*freshEntry
+	filling map[interface{}]chan struct{} // Closed when store of the key is done
+}
+
+type freshEntry struct {
+	filled     time.Time
+	hits       int
+	refreshing bool
+}
+
+func newFreshness(soft, hard time.Duration) *freshness {
+	return &freshness{
+		soft:    soft,
+		hard:    hard,
+		entries: make(map[interface{}]*freshEntry),
+		filling: make(map[interface{}]chan struct{}),
+	}
+}
+
+// get returns the entry of key, or nil
+func (f *freshness) get(key interface{}) *freshEntry {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.entries[key]
+}
+
+// hit counts a read of the key.
+// It returns true as stale if the value is older than soft TTL,
+// and true as refresh if the caller should request refresh of the value.
+func (f *freshness) hit(key interface{}) (e *freshEntry, stale, refresh bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	e, ok := f.entries[key]
+	if !ok {
+		return nil, false, false
+	}
+	e.hits++
+	age := time.Since(e.filled)
+	stale = age >= f.soft
+	hot := f.hits > 0 && e.hits >= f.hits && age >= f.hard-f.ahead
+	if (stale || hot) && !e.refreshing {
+		e.refreshing = true
+		refresh = true
+	}
+	return e, stale, refresh
+}
+
+// fill calls store and renews the entry, unless the entry is changed from prev.
+// store is called without lock, but forget and fill of the same key wait for it,
+// so that it is not reordered with them.
+func (f *freshness) fill(key interface{}, prev *freshEntry, store func() error) error {
+	f.lock.Lock()
+	f.wait(key)
+	if f.entries[key] != prev {
+		f.lock.Unlock()
+		return nil
+	}
+	done := make(chan struct{})
+	f.filling[key] = done
+	f.lock.Unlock()
+
+	err := store()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.filling, key)
+	close(done)
+	if err != nil {
+		return err
+	}
+	f.entries[key] = &freshEntry{filled: time.Now()}
+	return nil
+}
+
+// wait until store of the key is done, called with lock
+func (f *freshness) wait(key interface{}) {
+	for {
+		done, ok := f.filling[key]
+		if !ok {
+			return
+		}
+		f.lock.Unlock()
+		<-done
+		f.lock.Lock()
+	}
+}
+
+// failed marks the entry as not refreshing, to retry refresh by next read
+func (f *freshness) failed(key interface{}, e *freshEntry) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.entries[key] == e {
+		e.refreshing = false
+	}
+}
+
+// forget the key, value in Storage is not filled from next layer anymore
+func (f *freshness) forget(key interface{}) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.wait(key)
+	delete(f.entries, key)
+}
+
+// sweep deletes entries expired in Storage
+func (f *freshness) sweep() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for key, e := range f.entries {
+		if time.Since(e.filled) >= f.hard {
+			delete(f.entries, key)
+		}
+	}
+}
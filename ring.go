@@ -0,0 +1,70 @@
+package transparent
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// hashRing maps keys to nodes by consistent hashing with virtual nodes.
+// It is immutable, with and without return new hashRing.
+type hashRing struct {
+	vnodes int
+	nodes  []string
+	hashes []uint32 // Sorted hashes of virtual nodes
+	owners map[uint32]string
+}
+
+func newHashRing(vnodes int, nodes ...string) *hashRing {
+	r := &hashRing{
+		vnodes: vnodes,
+		nodes:  nodes,
+		owners: make(map[uint32]string),
+	}
+	for _, node := range nodes {
+		for i := 0; i < vnodes; i++ {
+			// Index is after the last separator, so that different node and index never make the same string
+			h := crc32.ChecksumIEEE([]byte(node + "#" + strconv.Itoa(i)))
+			// Smaller name wins on collision, to be independent of the order of nodes
+			if owner, ok := r.owners[h]; ok && owner < node {
+				continue
+			}
+			r.owners[h] = node
+		}
+	}
+	for h := range r.owners {
+		r.hashes = append(r.hashes, h)
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// with returns hashRing added the node
+func (r *hashRing) with(node string) *hashRing {
+	nodes := append([]string{node}, r.nodes...)
+	return newHashRing(r.vnodes, nodes...)
+}
+
+// without returns hashRing removed the node
+func (r *hashRing) without(node string) *hashRing {
+	nodes := []string{}
+	for _, n := range r.nodes {
+		if n != node {
+			nodes = append(nodes, n)
+		}
+	}
+	return newHashRing(r.vnodes, nodes...)
+}
+
+// owner returns the node of the key, empty if the ring has no node
+func (r *hashRing) owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
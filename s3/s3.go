@@ -1,13 +1,19 @@
 package s3
 
 import (
+	"bytes"
+	"context"
 	"reflect"
+	"strconv"
+	"time"
 
 	"github.com/juntaki/transparent"
 	"github.com/juntaki/transparent/simple"
 	"github.com/pkg/errors"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
@@ -20,9 +26,12 @@ func NewStorage(bucket string, svc s3iface.S3API) transparent.BackendStorage {
 	}
 }
 
+// expireMetadata is the object metadata of expiration time in unix nano
+const expireMetadata = "Expire"
+
 // s3SimpleStorage store file to Amazon S3 as object
 type simpleStorage struct {
-	bare   transparent.BackendStorage
+	bare   *bareStorage
 	svc    s3iface.S3API
 	bucket string
 }
@@ -30,7 +39,7 @@ type simpleStorage struct {
 // NewS3SimpleStorage returns s3SimpleStorage
 func NewSimpleStorage(bucket string, svc s3iface.S3API) transparent.BackendStorage {
 	return &simpleStorage{
-		bare:   NewBareStorage(svc),
+		bare:   &bareStorage{svc: svc},
 		svc:    svc,
 		bucket: bucket,
 	}
@@ -38,6 +47,11 @@ func NewSimpleStorage(bucket string, svc s3iface.S3API) transparent.BackendStora
 
 // Get is get request
 func (s *simpleStorage) Get(k interface{}) (interface{}, error) {
+	return s.GetContext(context.Background(), k)
+}
+
+// GetContext is get request
+func (s *simpleStorage) GetContext(ctx context.Context, k interface{}) (interface{}, error) {
 	key, err := s.validateKey(k)
 	if err != nil {
 		return nil, err
@@ -48,7 +62,7 @@ func (s *simpleStorage) Get(k interface{}) (interface{}, error) {
 		Bucket: s.bucket,
 	}
 
-	br, err := s.bare.Get(bk)
+	br, err := s.bare.GetContext(ctx, bk)
 	if err != nil {
 		if _, ok := err.(*transparent.KeyNotFoundError); ok {
 			return nil, &transparent.KeyNotFoundError{Key: key}
@@ -56,12 +70,78 @@ func (s *simpleStorage) Get(k interface{}) (interface{}, error) {
 		return nil, err
 	}
 
+	if expired(br.(*Bare)) {
+		s.removeExpired(ctx, key, br.(*Bare))
+		return nil, &transparent.KeyNotFoundError{Key: key}
+	}
+
 	body := br.(*Bare).Value["Body"]
 	return body, nil
 }
 
+// expired returns true if the object has expiration time and it is passed
+func expired(b *Bare) bool {
+	metadata, _ := b.Value["Metadata"].(map[string]*string)
+	return expiredMetadata(metadata)
+}
+
+// expiredMetadata returns true if expiration time in the metadata is passed
+func expiredMetadata(metadata map[string]*string) bool {
+	if metadata[expireMetadata] == nil {
+		return false
+	}
+	expire, err := strconv.ParseInt(*metadata[expireMetadata], 10, 64)
+	if err != nil {
+		return false
+	}
+	return time.Unix(0, expire).Before(time.Now())
+}
+
+// removeExpired deletes the expired object, only if it is not written again after it is read
+func (s *simpleStorage) removeExpired(ctx context.Context, key string, b *Bare) {
+	etag, _ := b.Value["ETag"].(*string)
+	if etag != nil {
+		s.deleteIfMatch(ctx, key, *etag)
+	}
+}
+
+// headExpired returns true if the object is expired or already removed
+func (s *simpleStorage) headExpired(ctx context.Context, key string) (bool, error) {
+	output, cause := s.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Key:    aws.String(key),
+		Bucket: aws.String(s.bucket),
+	})
+	if cause != nil {
+		if hasCode(cause, "NotFound") {
+			return true, nil
+		}
+		return false, errors.Wrapf(cause, "HeadObject failed. key = %s", key)
+	}
+	return expiredMetadata(output.Metadata), nil
+}
+
 // Add is set put request
 func (s *simpleStorage) Add(k interface{}, v interface{}) error {
+	return s.AddContext(context.Background(), k, v)
+}
+
+// AddContext is set put request
+func (s *simpleStorage) AddContext(ctx context.Context, k interface{}, v interface{}) error {
+	return s.add(ctx, k, v, map[string]*string{})
+}
+
+// AddWithTTL is set put request, expiration time is stored as object metadata
+func (s *simpleStorage) AddWithTTL(ctx context.Context, k interface{}, v interface{}, ttl time.Duration) error {
+	expire, err := transparent.ExpireAt(ttl)
+	if err != nil {
+		return err
+	}
+	return s.add(ctx, k, v, map[string]*string{
+		expireMetadata: aws.String(strconv.FormatInt(expire.UnixNano(), 10)),
+	})
+}
+
+func (s *simpleStorage) add(ctx context.Context, k interface{}, v interface{}, metadata map[string]*string) error {
 	key, err := s.validateKey(k)
 	if err != nil {
 		return err
@@ -78,12 +158,18 @@ func (s *simpleStorage) Add(k interface{}, v interface{}) error {
 
 	bv := NewBare()
 	bv.Value["Body"] = body
+	bv.Value["Metadata"] = metadata
 
-	return s.bare.Add(bk, bv)
+	return s.bare.AddContext(ctx, bk, bv)
 }
 
 // Remove is delete request
 func (s *simpleStorage) Remove(k interface{}) error {
+	return s.RemoveContext(context.Background(), k)
+}
+
+// RemoveContext is delete request
+func (s *simpleStorage) RemoveContext(ctx context.Context, k interface{}) error {
 	key, err := s.validateKey(k)
 	if err != nil {
 		return err
@@ -92,13 +178,224 @@ func (s *simpleStorage) Remove(k interface{}) error {
 		Key:    aws.String(key),
 		Bucket: aws.String(s.bucket),
 	}
-	_, cause := s.svc.DeleteObject(params)
+	_, cause := s.svc.DeleteObjectWithContext(ctx, params)
 	if cause != nil {
 		return errors.Wrapf(cause, "DeleteObject failed. key = %s", key)
 	}
 	return nil
 }
 
+// deleteObjectsLimit is max number of keys in a DeleteObjects request
+const deleteObjectsLimit = 1000
+
+// GetMulti is get request of each key
+func (s *simpleStorage) GetMulti(ctx context.Context, ks []interface{}) (map[interface{}]interface{}, error) {
+	values := make(map[interface{}]interface{}, len(ks))
+	for _, k := range ks {
+		value, err := s.GetContext(ctx, k)
+		if err != nil {
+			if _, ok := err.(*transparent.KeyNotFoundError); ok {
+				continue
+			}
+			return nil, err
+		}
+		values[k] = value
+	}
+	return values, nil
+}
+
+// AddMulti is put request of each key
+func (s *simpleStorage) AddMulti(ctx context.Context, vs map[interface{}]interface{}) error {
+	for k, v := range vs {
+		err := s.AddContext(ctx, k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveMulti is delete objects request, up to 1000 keys per request
+func (s *simpleStorage) RemoveMulti(ctx context.Context, ks []interface{}) error {
+	objects := make([]*s3.ObjectIdentifier, 0, len(ks))
+	for _, k := range ks {
+		key, err := s.validateKey(k)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+	}
+	for len(objects) > 0 {
+		n := len(objects)
+		if n > deleteObjectsLimit {
+			n = deleteObjectsLimit
+		}
+		params := &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &s3.Delete{
+				Objects: objects[:n],
+				Quiet:   aws.Bool(true),
+			},
+		}
+		output, cause := s.svc.DeleteObjectsWithContext(ctx, params)
+		if cause != nil {
+			return errors.Wrapf(cause, "DeleteObjects failed. keys = %d", n)
+		}
+		if len(output.Errors) > 0 {
+			e := output.Errors[0]
+			return errors.Errorf("DeleteObjects failed. key = %s, code = %s, message = %s",
+				aws.StringValue(e.Key), aws.StringValue(e.Code), aws.StringValue(e.Message))
+		}
+		objects = objects[n:]
+	}
+	return nil
+}
+
+// Scan is list objects request, up to 1000 keys per request.
+// Expired objects are filtered by head request of each key, because listed objects have no metadata.
+func (s *simpleStorage) Scan(ctx context.Context, r transparent.ScanRange) (*transparent.ScanPage, error) {
+	page := &transparent.ScanPage{Keys: []string{}}
+	params := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+	}
+	if r.Prefix != "" {
+		params.Prefix = aws.String(r.Prefix)
+	}
+	if r.After != "" {
+		params.StartAfter = aws.String(r.After)
+	}
+	for {
+		if r.Limit > 0 {
+			params.MaxKeys = aws.Int64(int64(r.Limit - len(page.Keys)))
+		}
+		output, cause := s.svc.ListObjectsV2WithContext(ctx, params)
+		if cause != nil {
+			return nil, errors.Wrapf(cause, "ListObjectsV2 failed. prefix = %s", r.Prefix)
+		}
+		for _, object := range output.Contents {
+			key := aws.StringValue(object.Key)
+			if r.Before != "" && key >= r.Before {
+				// Keys are listed in order, the rest is out of range
+				return page, nil
+			}
+			expired, err := s.headExpired(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			if !expired {
+				page.Keys = append(page.Keys, key)
+			}
+		}
+		if !aws.BoolValue(output.IsTruncated) {
+			return page, nil
+		}
+		if r.Limit > 0 && len(page.Keys) >= r.Limit {
+			page.Next = page.Keys[len(page.Keys)-1]
+			return page, nil
+		}
+		params.ContinuationToken = output.NextContinuationToken
+	}
+}
+
+// GetVersion is get request, version is ETag
+func (s *simpleStorage) GetVersion(ctx context.Context, k interface{}) (interface{}, string, error) {
+	key, err := s.validateKey(k)
+	if err != nil {
+		return nil, "", err
+	}
+	br, err := s.bare.GetContext(ctx, BareKey{Key: key, Bucket: s.bucket})
+	if err != nil {
+		if _, ok := err.(*transparent.KeyNotFoundError); ok {
+			return nil, "", &transparent.KeyNotFoundError{Key: key}
+		}
+		return nil, "", err
+	}
+	if expired(br.(*Bare)) {
+		s.removeExpired(ctx, key, br.(*Bare))
+		return nil, "", &transparent.KeyNotFoundError{Key: key}
+	}
+	etag, _ := br.(*Bare).Value["ETag"].(*string)
+	return br.(*Bare).Value["Body"], aws.StringValue(etag), nil
+}
+
+// AddIfAbsent is put request with If-None-Match
+func (s *simpleStorage) AddIfAbsent(ctx context.Context, k interface{}, v interface{}) (string, error) {
+	return s.put(ctx, k, v, map[string]string{"If-None-Match": "*"})
+}
+
+// AddIfVersion is put request with If-Match
+func (s *simpleStorage) AddIfVersion(ctx context.Context, k interface{}, v interface{}, version string) (string, error) {
+	return s.put(ctx, k, v, map[string]string{"If-Match": version})
+}
+
+// RemoveIfVersion is delete request with If-Match
+func (s *simpleStorage) RemoveIfVersion(ctx context.Context, k interface{}, version string) error {
+	key, err := s.validateKey(k)
+	if err != nil {
+		return err
+	}
+	return s.deleteIfMatch(ctx, key, version)
+}
+
+// deleteIfMatch is delete request with If-Match header
+func (s *simpleStorage) deleteIfMatch(ctx context.Context, key string, etag string) error {
+	params := &s3.DeleteObjectInput{
+		Key:    aws.String(key),
+		Bucket: aws.String(s.bucket),
+	}
+	_, cause := s.svc.DeleteObjectWithContext(ctx, params,
+		request.WithSetRequestHeaders(map[string]string{"If-Match": etag}))
+	if cause != nil {
+		if hasCode(cause, s3.ErrCodeNoSuchKey) {
+			return &transparent.KeyNotFoundError{Key: key}
+		}
+		if conflicted(cause) {
+			return &transparent.VersionConflictError{Key: key}
+		}
+		return errors.Wrapf(cause, "DeleteObject failed. key = %s", key)
+	}
+	return nil
+}
+
+// put is conditional put request, it returns ETag of new object.
+// PutObjectInput doesn't have the fields of the condition, they are set as headers.
+func (s *simpleStorage) put(ctx context.Context, k interface{}, v interface{}, condition map[string]string) (string, error) {
+	key, err := s.validateKey(k)
+	if err != nil {
+		return "", err
+	}
+	body, err := s.validateValue(v)
+	if err != nil {
+		return "", err
+	}
+	params := &s3.PutObjectInput{
+		Key:      aws.String(key),
+		Bucket:   aws.String(s.bucket),
+		Body:     bytes.NewReader(body),
+		Metadata: map[string]*string{},
+	}
+	output, cause := s.svc.PutObjectWithContext(ctx, params, request.WithSetRequestHeaders(condition))
+	if cause != nil {
+		// If-Match of missing key is also failure of the condition
+		if conflicted(cause) || hasCode(cause, s3.ErrCodeNoSuchKey) {
+			return "", &transparent.VersionConflictError{Key: key}
+		}
+		return "", errors.Wrapf(cause, "PutObject failed. key = %s", key)
+	}
+	return aws.StringValue(output.ETag), nil
+}
+
+// conflicted returns true if the error is failure of the condition
+func conflicted(err error) bool {
+	return hasCode(err, "PreconditionFailed") || hasCode(err, "ConditionalRequestConflict")
+}
+
+// hasCode returns true if the error is awserr.Error of the code
+func hasCode(err error, code string) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == code
+}
+
 func (s *simpleStorage) validateKey(k interface{}) (string, error) {
 	key, ok := k.(string)
 	if !ok {
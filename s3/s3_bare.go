@@ -2,6 +2,7 @@ package s3
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -105,7 +106,14 @@ func NewBareStorage(svc s3iface.S3API) transparent.BackendStorage {
 		svc: svc,
 	}
 }
+
+// Get is GetObject request
 func (b *bareStorage) Get(key interface{}) (value interface{}, err error) {
+	return b.GetContext(context.Background(), key)
+}
+
+// GetContext is GetObject request
+func (b *bareStorage) GetContext(ctx context.Context, key interface{}) (value interface{}, err error) {
 	bkey, err := b.validateBareKey(key)
 	if err != nil {
 		return nil, err
@@ -120,21 +128,27 @@ func (b *bareStorage) Get(key interface{}) (value interface{}, err error) {
 	}
 
 	var cause error
-	bare.getObjectOutput, cause = b.svc.GetObject(bare.getObjectInput)
+	bare.getObjectOutput, cause = b.svc.GetObjectWithContext(ctx, bare.getObjectInput)
 	if cause != nil {
 		if aerr, ok := cause.(awserr.Error); ok {
 			if aerr.Code() == "NoSuchKey" {
 				return nil, &transparent.KeyNotFoundError{Key: key}
 			}
 		}
-		return nil, errors.Wrapf(cause, "GetObject failed. key = %b", bare.Value)
+		return nil, errors.Wrapf(cause, "GetObject failed. key = %v", bare.Value)
 	}
 	bare.get(bare.getObjectOutput)
 
 	return interface{}(bare), nil
 }
 
+// Add is PutObject request
 func (b *bareStorage) Add(key interface{}, value interface{}) error {
+	return b.AddContext(context.Background(), key, value)
+}
+
+// AddContext is PutObject request
+func (b *bareStorage) AddContext(ctx context.Context, key interface{}, value interface{}) error {
 	bkey, err := b.validateBareKey(key)
 	if err != nil {
 		return err
@@ -152,14 +166,20 @@ func (b *bareStorage) Add(key interface{}, value interface{}) error {
 	}
 
 	var cause error
-	_, cause = b.svc.PutObject(bvalue.putObjectInput)
+	_, cause = b.svc.PutObjectWithContext(ctx, bvalue.putObjectInput)
 	if cause != nil {
 		return errors.Wrapf(cause, "PutObject failed. key = %s", bvalue.Value)
 	}
 	return nil
 }
 
+// Remove is DeleteObject request
 func (b *bareStorage) Remove(key interface{}) error {
+	return b.RemoveContext(context.Background(), key)
+}
+
+// RemoveContext is DeleteObject request
+func (b *bareStorage) RemoveContext(ctx context.Context, key interface{}) error {
 	bkey, err := b.validateBareKey(key)
 	if err != nil {
 		return err
@@ -173,9 +193,9 @@ func (b *bareStorage) Remove(key interface{}) error {
 	}
 
 	var cause error
-	_, cause = b.svc.DeleteObject(bare.deleteObjectInput)
+	_, cause = b.svc.DeleteObjectWithContext(ctx, bare.deleteObjectInput)
 	if cause != nil {
-		return errors.Wrapf(cause, "DeleteObject failed. key = %b", bare.Value)
+		return errors.Wrapf(cause, "DeleteObject failed. key = %v", bare.Value)
 	}
 
 	return nil
@@ -2,11 +2,18 @@ package s3
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"net/http"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/juntaki/transparent"
@@ -15,7 +22,39 @@ import (
 
 type mockS3Client struct {
 	s3iface.S3API
-	d transparent.BackendStorage
+	d             transparent.BackendStorage
+	deleteObjects int    // Count of DeleteObjects request
+	beforeDelete  func() // Called by DeleteObject request before precondition
+}
+
+type mockObject struct {
+	body     []byte
+	metadata map[string]*string
+	etag     string
+}
+
+// headers returns the request headers set by the options
+func headers(o []request.Option) http.Header {
+	r := &request.Request{HTTPRequest: &http.Request{Header: http.Header{}}}
+	r.ApplyOptions(o...)
+	return r.HTTPRequest.Header
+}
+
+// precondition returns PreconditionFailed if the object doesn't match If-Match or If-None-Match header
+func (m *mockS3Client) precondition(key string, header http.Header) error {
+	value, err := m.d.Get(key)
+	if header.Get("If-None-Match") != "" && err == nil {
+		return awserr.New("PreconditionFailed", "PreconditionFailedDummy", nil)
+	}
+	if ifMatch := header.Get("If-Match"); ifMatch != "" {
+		if err != nil {
+			return awserr.New("NoSuchKey", "NoSuchKeyDummy", err)
+		}
+		if value.(*mockObject).etag != ifMatch {
+			return awserr.New("PreconditionFailed", "PreconditionFailedDummy", nil)
+		}
+	}
+	return nil
 }
 
 func newMockS3Client() (*mockS3Client, error) {
@@ -32,39 +71,138 @@ func (m *mockS3Client) GetObject(i *s3.GetObjectInput) (*s3.GetObjectOutput, err
 		aerr := awserr.New("NoSuchKey", "NoSuchKeyDummy", err)
 		return nil, aerr
 	}
-	body, ok := value.([]byte)
+	object, ok := value.(*mockObject)
 	if !ok {
 		return nil, errors.New("value invalid")
 	}
-	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+	return &s3.GetObjectOutput{
+		Body:     ioutil.NopCloser(bytes.NewReader(object.body)),
+		Metadata: object.metadata,
+		ETag:     aws.String(object.etag),
+	}, nil
 }
 
 func (m *mockS3Client) PutObject(i *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	return m.putObject(i, http.Header{})
+}
+
+func (m *mockS3Client) putObject(i *s3.PutObjectInput, header http.Header) (*s3.PutObjectOutput, error) {
 	if *i.Bucket != "bucket" {
 		return nil, errors.New("bucket name invalid")
 	}
+	err := m.precondition(*i.Key, header)
+	if err != nil {
+		return nil, err
+	}
 	body, err := ioutil.ReadAll(i.Body)
 	if err != nil {
 		return nil, err
 	}
-	err = m.d.Add(*i.Key, body)
+	etag := fmt.Sprintf("\"%x\"", md5.Sum(body))
+	err = m.d.Add(*i.Key, &mockObject{body: body, metadata: i.Metadata, etag: etag})
 	if err != nil {
 		return nil, err
 	}
-	return &s3.PutObjectOutput{}, nil
+	return &s3.PutObjectOutput{ETag: aws.String(etag)}, nil
 }
 
 func (m *mockS3Client) DeleteObject(i *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	return m.deleteObject(i, http.Header{})
+}
+
+func (m *mockS3Client) deleteObject(i *s3.DeleteObjectInput, header http.Header) (*s3.DeleteObjectOutput, error) {
 	if *i.Bucket != "bucket" {
 		return nil, errors.New("bucket name invalid")
 	}
-	err := m.d.Remove(*i.Key)
+	if m.beforeDelete != nil {
+		m.beforeDelete()
+	}
+	err := m.precondition(*i.Key, header)
+	if err != nil {
+		return nil, err
+	}
+	err = m.d.Remove(*i.Key)
 	if err != nil {
 		return nil, err
 	}
 	return &s3.DeleteObjectOutput{}, nil
 }
 
+func (m *mockS3Client) GetObjectWithContext(ctx context.Context, i *s3.GetObjectInput, o ...request.Option) (*s3.GetObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.GetObject(i)
+}
+
+func (m *mockS3Client) PutObjectWithContext(ctx context.Context, i *s3.PutObjectInput, o ...request.Option) (*s3.PutObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.putObject(i, headers(o))
+}
+
+func (m *mockS3Client) DeleteObjectWithContext(ctx context.Context, i *s3.DeleteObjectInput, o ...request.Option) (*s3.DeleteObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.deleteObject(i, headers(o))
+}
+
+func (m *mockS3Client) HeadObjectWithContext(ctx context.Context, i *s3.HeadObjectInput, o ...request.Option) (*s3.HeadObjectOutput, error) {
+	output, err := m.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: i.Bucket, Key: i.Key})
+	if err != nil {
+		if hasCode(err, "NoSuchKey") {
+			return nil, awserr.New("NotFound", "NotFoundDummy", err)
+		}
+		return nil, err
+	}
+	return &s3.HeadObjectOutput{Metadata: output.Metadata, ETag: output.ETag}, nil
+}
+
+func (m *mockS3Client) DeleteObjectsWithContext(ctx context.Context, i *s3.DeleteObjectsInput, o ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if *i.Bucket != "bucket" {
+		return nil, errors.New("bucket name invalid")
+	}
+	m.deleteObjects++
+	for _, object := range i.Delete.Objects {
+		err := m.d.Remove(*object.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &s3.DeleteObjectsOutput{}, nil
+}
+
+func (m *mockS3Client) ListObjectsV2WithContext(ctx context.Context, i *s3.ListObjectsV2Input, o ...request.Option) (*s3.ListObjectsV2Output, error) {
+	if *i.Bucket != "bucket" {
+		return nil, errors.New("bucket name invalid")
+	}
+	r := transparent.ScanRange{
+		Prefix: aws.StringValue(i.Prefix),
+		After:  aws.StringValue(i.StartAfter),
+		Limit:  1, // Paginate for test
+	}
+	if i.ContinuationToken != nil {
+		r.After = *i.ContinuationToken
+	}
+	page, err := m.d.(transparent.BackendStorageScan).Scan(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	output := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(page.Next != "")}
+	for _, key := range page.Keys {
+		output.Contents = append(output.Contents, &s3.Object{Key: aws.String(key)})
+	}
+	if page.Next != "" {
+		output.NextContinuationToken = aws.String(page.Next)
+	}
+	return output, nil
+}
+
 func TestStorage(t *testing.T) {
 	var err error
 
@@ -76,6 +214,17 @@ func TestStorage(t *testing.T) {
 	sss := NewSimpleStorage("bucket", svc)
 	test.BasicStorageFunc(t, sss)
 	test.SimpleStorageFunc(t, sss)
+	test.TTLStorageFunc(t, sss)
+	test.MultiStorageFunc(t, sss)
+	if svc.deleteObjects != 1 {
+		t.Error("DeleteObjects is not used", svc.deleteObjects)
+	}
+	test.ScanStorageFunc(t, sss)
+	test.VersionStorageFunc(t, sss)
+	err = sss.(transparent.BackendStorageVersion).RemoveIfVersion(context.Background(), "missing", "\"etag\"")
+	if _, ok := err.(*transparent.KeyNotFoundError); !ok {
+		t.Error(err)
+	}
 
 	svc, err = newMockS3Client()
 	if err != nil {
@@ -83,6 +232,8 @@ func TestStorage(t *testing.T) {
 	}
 	ss := NewStorage("bucket", svc)
 	test.BasicStorageFunc(t, ss)
+	test.TTLStorageFunc(t, ss)
+	test.MultiStorageFunc(t, ss)
 
 	svc, err = newMockS3Client()
 	if err != nil {
@@ -107,3 +258,37 @@ func TestStorage(t *testing.T) {
 	}
 	test.BasicCacheFunc(t, c)
 }
+
+func TestStorageExpired(t *testing.T) {
+	ctx := context.Background()
+	svc, err := newMockS3Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sss := NewSimpleStorage("bucket", svc)
+	err = sss.(transparent.BackendStorageTTL).AddWithTTL(ctx, "expired", []byte("old"), time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// Expired object is not scanned
+	page, err := sss.(transparent.BackendStorageScan).Scan(ctx, transparent.ScanRange{})
+	if err != nil || len(page.Keys) != 0 {
+		t.Error(err, page)
+	}
+
+	// Object written again after Get is not deleted as expired
+	svc.beforeDelete = func() {
+		sss.Add("expired", []byte("new"))
+	}
+	_, err = sss.Get("expired")
+	if _, ok := err.(*transparent.KeyNotFoundError); !ok {
+		t.Error(err)
+	}
+	svc.beforeDelete = nil
+	value, err := sss.Get("expired")
+	if err != nil || string(value.([]byte)) != "new" {
+		t.Error(err, value)
+	}
+}
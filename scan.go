@@ -0,0 +1,146 @@
+package transparent
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// ScanRange specifies keys to scan.
+// Only string keys are scanned, in lexicographical order.
+type ScanRange struct {
+	Prefix string // Keys start with Prefix
+	After  string // Keys greater than After, empty means no limit
+	Before string // Keys less than Before, empty means no limit
+	Limit  int    // Max number of keys in a page, 0 means no limit
+}
+
+// contains returns true if the key is in the range
+func (r *ScanRange) contains(key string) bool {
+	return strings.HasPrefix(key, r.Prefix) &&
+		(r.After == "" || key > r.After) &&
+		(r.Before == "" || key < r.Before)
+}
+
+// ScanPage is a page of scanned keys.
+// If Next is not empty, next page is scanned by After = Next.
+type ScanPage struct {
+	Keys []string
+	Next string
+}
+
+// BackendStorageScan is BackendStorage which can scan its keys.
+type BackendStorageScan interface {
+	BackendStorage
+	Scan(ctx context.Context, r ScanRange) (*ScanPage, error)
+}
+
+// ScanKeys returns a page of keys in the range, keys are not needed to be sorted.
+// It is helper for BackendStorageScan, which has all keys in memory.
+func ScanKeys(keys []string, r ScanRange) *ScanPage {
+	page := &ScanPage{Keys: []string{}}
+	for _, key := range keys {
+		if r.contains(key) {
+			page.Keys = append(page.Keys, key)
+		}
+	}
+	sort.Strings(page.Keys)
+	return page.limit(r.Limit)
+}
+
+// limit truncates the page to n keys, and set Next if truncated
+func (p *ScanPage) limit(n int) *ScanPage {
+	if n > 0 && len(p.Keys) > n {
+		p.Keys = p.Keys[:n]
+		p.Next = p.Keys[n-1]
+	}
+	return p
+}
+
+// mergePages merges sorted pages from layers into one page
+func mergePages(r ScanRange, pages ...*ScanPage) *ScanPage {
+	keys := []string{}
+	seen := make(map[string]bool)
+	more := false
+	for _, p := range pages {
+		for _, key := range p.Keys {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+		more = more || p.Next != ""
+	}
+	sort.Strings(keys)
+	if more {
+		// Keys after the smallest Next may be missing in some pages
+		for _, p := range pages {
+			if p.Next != "" {
+				i := sort.SearchStrings(keys, p.Next)
+				if i < len(keys) && keys[i] == p.Next {
+					i++
+				}
+				keys = keys[:i]
+			}
+		}
+	}
+	page := &ScanPage{Keys: keys}
+	if more && len(keys) > 0 {
+		page.Next = keys[len(keys)-1]
+	}
+	return page.limit(r.Limit)
+}
+
+func scan(ctx context.Context, s BackendStorage, r ScanRange) (*ScanPage, error) {
+	if ss, ok := s.(BackendStorageScan); ok {
+		return ss.Scan(ctx, r)
+	}
+	return nil, errors.New("storage doesn't support scan")
+}
+
+// Iterator iterates all keys in the range by pages.
+type Iterator struct {
+	ctx   context.Context
+	layer Layer
+	r     ScanRange
+	keys  []string
+	key   string
+	err   error
+	done  bool
+}
+
+// Iterate returns Iterator of keys in the range, Limit is used as page size.
+func (s *Stack) Iterate(ctx context.Context, r ScanRange) *Iterator {
+	return &Iterator{ctx: ctx, layer: s.Layer, r: r}
+}
+
+// Next moves to the next key, it returns false at the end or on error.
+func (it *Iterator) Next() bool {
+	for len(it.keys) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+		page, err := it.layer.Scan(it.ctx, it.r)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.keys = page.Keys
+		it.r.After = page.Next
+		it.done = page.Next == ""
+	}
+	it.key = it.keys[0]
+	it.keys = it.keys[1:]
+	return true
+}
+
+// Key returns the current key
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Err returns the error occurred in Next
+func (it *Iterator) Err() error {
+	return it.err
+}
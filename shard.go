@@ -0,0 +1,519 @@
+package transparent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type layerShard struct {
+	lock    sync.RWMutex
+	vnodes  int
+	migrate bool
+	shards  map[string]Layer
+	ring    *hashRing
+	running bool
+	hub     *watchHub
+}
+
+// ShardOption configures LayerShard
+type ShardOption func(s *layerShard)
+
+// WithShard adds the Layer as a shard by the name.
+// Stack can be a shard, it is started and stopped with LayerShard.
+func WithShard(name string, l Layer) ShardOption {
+	return func(s *layerShard) {
+		s.shards[name] = l
+	}
+}
+
+// WithVirtualNodes sets the number of virtual nodes per shard on hash ring.
+// Default is 100.
+func WithVirtualNodes(n int) ShardOption {
+	return func(s *layerShard) {
+		s.vnodes = n
+	}
+}
+
+// WithMigration makes AddShard and RemoveShard move keys to their new shard.
+// Keys are found by Scan, so all shards must support it, and keys must be string.
+// Operations with other type of key fail, because Scan returns keys as string.
+// Operations are blocked during migration, and TTL of moved keys is not kept.
+func WithMigration() ShardOption {
+	return func(s *layerShard) {
+		s.migrate = true
+	}
+}
+
+// NewLayerShard returns LayerShard.
+// LayerShard distributes keys to shards by consistent hashing.
+// Keys are hashed by their string representation.
+// This layer must be the bottom of Stack.
+func NewLayerShard(options ...ShardOption) (Layer, error) {
+	s := &layerShard{
+		vnodes: 100,
+		shards: make(map[string]Layer),
+	}
+	for _, option := range options {
+		option(s)
+	}
+	if s.vnodes <= 0 {
+		return nil, errors.New("virtual nodes must be positive")
+	}
+	names := make([]string, 0, len(s.shards))
+	for name := range s.shards {
+		names = append(names, name)
+	}
+	s.ring = newHashRing(s.vnodes, names...)
+	return s, nil
+}
+
+// ShardOf returns the name of shard which has the key
+func ShardOf(l Layer, key interface{}) (string, error) {
+	s, ok := l.(*layerShard)
+	if !ok {
+		return "", errors.New("not LayerShard")
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	name := s.ring.owner(shardKey(key))
+	if name == "" {
+		return "", errors.New("no shard")
+	}
+	return name, nil
+}
+
+// AddShard adds the shard to LayerShard.
+// Keys moved to the shard are migrated if WithMigration is set.
+func AddShard(ctx context.Context, l Layer, name string, shard Layer) error {
+	s, ok := l.(*layerShard)
+	if !ok {
+		return errors.New("not LayerShard")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.shards[name]; ok {
+		return errors.New("shard already exists")
+	}
+	if s.migrate && !s.running {
+		return errors.New("migration requires started LayerShard")
+	}
+	if w, ok := shard.(watchable); ok {
+		w.setHub(s.hub)
+	}
+	if s.running {
+		err := startLayer(shard)
+		if err != nil {
+			return err
+		}
+	}
+
+	shards := make(map[string]Layer, len(s.shards)+1)
+	for n, l := range s.shards {
+		shards[n] = l
+	}
+	shards[name] = shard
+	sources := s.shards
+	if !s.migrate {
+		sources = nil
+	}
+	err := s.rebalance(ctx, s.ring.with(name), shards, sources)
+	if _, added := s.shards[name]; !added && s.running {
+		stopLayer(shard)
+	}
+	return err
+}
+
+// RemoveShard removes the shard from LayerShard.
+// Keys in the shard are migrated if WithMigration is set.
+func RemoveShard(ctx context.Context, l Layer, name string) error {
+	s, ok := l.(*layerShard)
+	if !ok {
+		return errors.New("not LayerShard")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	shard, ok := s.shards[name]
+	if !ok {
+		return errors.New("shard not found")
+	}
+	if s.migrate && !s.running {
+		return errors.New("migration requires started LayerShard")
+	}
+
+	shards := make(map[string]Layer, len(s.shards))
+	for n, l := range s.shards {
+		if n != name {
+			shards[n] = l
+		}
+	}
+	var sources map[string]Layer
+	if s.migrate {
+		sources = map[string]Layer{name: shard}
+	}
+	err := s.rebalance(ctx, s.ring.without(name), shards, sources)
+	if err != nil {
+		return err
+	}
+	if s.running {
+		return stopLayer(shard)
+	}
+	return nil
+}
+
+// migration is a key copied to its new shard
+type migration struct {
+	key  string
+	from Layer
+	to   Layer
+}
+
+// rebalance copies keys in sources to their shard in ring, and replace ring and shards.
+// If copy failed, copied keys are removed and ring is not changed.
+// Copied keys are removed from sources after ring is changed, it is best-effort
+// because the keys left in sources are not owned by them anymore.
+func (s *layerShard) rebalance(ctx context.Context, ring *hashRing, shards map[string]Layer, sources map[string]Layer) error {
+	moved := []migration{}
+	for name, from := range sources {
+		m, err := copyKeys(ctx, name, from, ring, shards)
+		moved = append(moved, m...)
+		if err != nil {
+			// ctx may be already canceled
+			for _, m := range moved {
+				m.to.RemoveContext(context.Background(), m.key)
+			}
+			return err
+		}
+	}
+	s.ring = ring
+	s.shards = shards
+	for _, m := range moved {
+		m.from.RemoveContext(context.Background(), m.key)
+	}
+	return nil
+}
+
+// copyKeys copies keys of the shard which is owned by another shard in ring
+func copyKeys(ctx context.Context, name string, from Layer, ring *hashRing, shards map[string]Layer) ([]migration, error) {
+	moved := []migration{}
+	r := ScanRange{Limit: 100}
+	for {
+		page, err := from.Scan(ctx, r)
+		if err != nil {
+			return moved, err
+		}
+		for _, key := range page.Keys {
+			owner := ring.owner(key)
+			if owner == name {
+				continue
+			}
+			value, err := from.GetContext(ctx, key)
+			if _, ok := err.(*KeyNotFoundError); ok {
+				continue
+			}
+			if err != nil {
+				return moved, err
+			}
+			to := shards[owner]
+			err = to.SetContext(ctx, key, value)
+			if err != nil {
+				return moved, err
+			}
+			moved = append(moved, migration{key: key, from: from, to: to})
+		}
+		if page.Next == "" {
+			return moved, nil
+		}
+		r.After = page.Next
+	}
+}
+
+// shardKey returns the string to hash the key
+func shardKey(key interface{}) string {
+	if s, ok := key.(string); ok {
+		return s
+	}
+	return fmt.Sprint(key)
+}
+
+// shard returns the shard of the key, it must be called with lock
+func (s *layerShard) shard(key interface{}) (Layer, error) {
+	if _, ok := key.(string); !ok && s.migrate {
+		return nil, errors.New("migration requires string key")
+	}
+	name := s.ring.owner(shardKey(key))
+	if name == "" {
+		return nil, errors.New("no shard")
+	}
+	return s.shards[name], nil
+}
+
+// group groups the keys by their shard, it must be called with lock
+func (s *layerShard) group(keys []interface{}) (map[Layer][]interface{}, error) {
+	groups := make(map[Layer][]interface{})
+	for _, key := range keys {
+		l, err := s.shard(key)
+		if err != nil {
+			return nil, err
+		}
+		groups[l] = append(groups[l], key)
+	}
+	return groups, nil
+}
+
+// Set set the value to the shard of the key
+func (s *layerShard) Set(key interface{}, value interface{}) error {
+	return s.SetContext(context.Background(), key, value)
+}
+
+// SetContext set the value to the shard of the key
+func (s *layerShard) SetContext(ctx context.Context, key interface{}, value interface{}) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	l, err := s.shard(key)
+	if err != nil {
+		return err
+	}
+	return l.SetContext(ctx, key, value)
+}
+
+// SetWithTTL set the value to the shard of the key
+func (s *layerShard) SetWithTTL(ctx context.Context, key interface{}, value interface{}, ttl time.Duration) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	l, err := s.shard(key)
+	if err != nil {
+		return err
+	}
+	return l.SetWithTTL(ctx, key, value, ttl)
+}
+
+// Get get the value from the shard of the key
+func (s *layerShard) Get(key interface{}) (value interface{}, err error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext get the value from the shard of the key
+func (s *layerShard) GetContext(ctx context.Context, key interface{}) (value interface{}, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	l, err := s.shard(key)
+	if err != nil {
+		return nil, err
+	}
+	return l.GetContext(ctx, key)
+}
+
+// Remove remove the key from its shard
+func (s *layerShard) Remove(key interface{}) error {
+	return s.RemoveContext(context.Background(), key)
+}
+
+// RemoveContext remove the key from its shard
+func (s *layerShard) RemoveContext(ctx context.Context, key interface{}) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	l, err := s.shard(key)
+	if err != nil {
+		return err
+	}
+	return l.RemoveContext(ctx, key)
+}
+
+// GetMulti get the values from the shards of the keys
+func (s *layerShard) GetMulti(ctx context.Context, keys []interface{}) (map[interface{}]interface{}, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	groups, err := s.group(keys)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[interface{}]interface{}, len(keys))
+	for l, keys := range groups {
+		v, err := l.GetMulti(ctx, keys)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range v {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+// SetMulti set the values to the shards of the keys
+func (s *layerShard) SetMulti(ctx context.Context, values map[interface{}]interface{}) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	groups := make(map[Layer]map[interface{}]interface{})
+	for key, value := range values {
+		l, err := s.shard(key)
+		if err != nil {
+			return err
+		}
+		if groups[l] == nil {
+			groups[l] = make(map[interface{}]interface{})
+		}
+		groups[l][key] = value
+	}
+	for l, values := range groups {
+		err := l.SetMulti(ctx, values)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveMulti remove the keys from their shards
+func (s *layerShard) RemoveMulti(ctx context.Context, keys []interface{}) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	groups, err := s.group(keys)
+	if err != nil {
+		return err
+	}
+	for l, keys := range groups {
+		err := l.RemoveMulti(ctx, keys)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scan scan keys of all shards
+func (s *layerShard) Scan(ctx context.Context, r ScanRange) (*ScanPage, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	pages := make([]*ScanPage, 0, len(s.shards))
+	for _, l := range s.shards {
+		page, err := l.Scan(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, page)
+	}
+	return mergePages(r, pages...), nil
+}
+
+// GetVersion get the value and its version from the shard of the key
+func (s *layerShard) GetVersion(ctx context.Context, key interface{}) (value interface{}, version string, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	l, err := s.shard(key)
+	if err != nil {
+		return nil, "", err
+	}
+	return l.GetVersion(ctx, key)
+}
+
+// SetIfAbsent set the value to the shard of the key, if the key doesn't exist
+func (s *layerShard) SetIfAbsent(ctx context.Context, key interface{}, value interface{}) (version string, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	l, err := s.shard(key)
+	if err != nil {
+		return "", err
+	}
+	return l.SetIfAbsent(ctx, key, value)
+}
+
+// CompareAndSwap set the value to the shard of the key, if the version is matched
+func (s *layerShard) CompareAndSwap(ctx context.Context, key interface{}, value interface{}, version string) (newVersion string, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	l, err := s.shard(key)
+	if err != nil {
+		return "", err
+	}
+	return l.CompareAndSwap(ctx, key, value, version)
+}
+
+// RemoveIfVersion remove the key from its shard, if the version is matched
+func (s *layerShard) RemoveIfVersion(ctx context.Context, key interface{}, version string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	l, err := s.shard(key)
+	if err != nil {
+		return err
+	}
+	return l.RemoveIfVersion(ctx, key, version)
+}
+
+// Sync all shards
+func (s *layerShard) Sync() error {
+	return s.SyncContext(context.Background())
+}
+
+// SyncContext all shards
+func (s *layerShard) SyncContext(ctx context.Context) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, l := range s.shards {
+		err := l.SyncContext(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *layerShard) setHub(h *watchHub) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.hub = h
+	for _, l := range s.shards {
+		if w, ok := l.(watchable); ok {
+			w.setHub(h)
+		}
+	}
+}
+
+func (s *layerShard) setNext(l Layer) error {
+	return errors.New("shard layer must be the bottom of Stack")
+}
+
+func (s *layerShard) start() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, l := range s.shards {
+		err := startLayer(l)
+		if err != nil {
+			return err
+		}
+	}
+	s.running = true
+	return nil
+}
+
+func (s *layerShard) stop() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.running = false
+	for _, l := range s.shards {
+		err := stopLayer(l)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startLayer starts the layer, or all layers if it is Stack
+func startLayer(l Layer) error {
+	if s, ok := l.(*Stack); ok {
+		return s.Start()
+	}
+	return l.start()
+}
+
+// stopLayer stops the layer, or all layers if it is Stack
+func stopLayer(l Layer) error {
+	if s, ok := l.(*Stack); ok {
+		return s.Stop()
+	}
+	return l.stop()
+}
@@ -0,0 +1,185 @@
+package transparent_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/juntaki/transparent"
+	"github.com/juntaki/transparent/test"
+)
+
+func newShardStack(t *testing.T, options ...transparent.ShardOption) (*transparent.Stack, transparent.Layer) {
+	shard, err := transparent.NewLayerShard(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := transparent.NewStack()
+	s.Stack(shard)
+	s.Start()
+	return s, shard
+}
+
+func TestShard(t *testing.T) {
+	sources := map[string]transparent.Layer{
+		"a": test.NewSource(0),
+		"b": test.NewSource(0),
+		"c": test.NewSource(0),
+	}
+	options := []transparent.ShardOption{}
+	for name, source := range sources {
+		options = append(options, transparent.WithShard(name, source))
+	}
+	s, shard := newShardStack(t, options...)
+	defer s.Stop()
+
+	test.BasicStackFunc(t, s)
+	test.MultiStackFunc(t, s)
+	test.ScanStackFunc(t, s)
+	test.VersionStackFunc(t, s)
+
+	// Keys are stored only in their shard
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		s.Set(key, []byte("value"))
+		name, err := transparent.ShardOf(shard, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n, source := range sources {
+			_, err := source.Get(key)
+			if (err == nil) != (n == name) {
+				t.Error(key, n, err)
+			}
+		}
+	}
+
+	empty, _ := newShardStack(t)
+	defer empty.Stop()
+	err := empty.Set("key", []byte("value"))
+	if err == nil {
+		t.Error("set without shard")
+	}
+	err = s.Stack(test.NewSource(0))
+	if err == nil {
+		t.Error("layer is stacked on shard")
+	}
+}
+
+func TestShardMigration(t *testing.T) {
+	a, b, c := test.NewSource(0), test.NewSource(0), test.NewSource(0)
+	s, shard := newShardStack(t, transparent.WithShard("a", a), transparent.WithShard("b", b),
+		transparent.WithMigration())
+	defer s.Stop()
+
+	owners := map[string]string{}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		s.Set(key, []byte(key))
+		owners[key], _ = transparent.ShardOf(shard, key)
+	}
+	check := func() {
+		for key := range owners {
+			value, err := s.Get(key)
+			if err != nil || string(value.([]byte)) != key {
+				t.Error(key, value, err)
+			}
+		}
+	}
+
+	// Migration scans keys as string
+	err := s.Set(1, []byte("value"))
+	if err == nil {
+		t.Error("non-string key is set with migration")
+	}
+
+	ctx := context.Background()
+	err = transparent.AddShard(ctx, shard, "c", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+	moved := 0
+	for key, owner := range owners {
+		name, _ := transparent.ShardOf(shard, key)
+		if name == owner {
+			continue
+		}
+		// Keys move only to the new shard
+		moved++
+		if name != "c" {
+			t.Error(key, owner, name)
+		}
+		_, err := c.Get(key)
+		if err != nil {
+			t.Error(key, err)
+		}
+		from := map[string]transparent.Layer{"a": a, "b": b}[owner]
+		_, err = from.Get(key)
+		if err == nil {
+			t.Error(key, "is not removed from", owner)
+		}
+	}
+	if moved == 0 || moved > 60 {
+		t.Error("moved", moved)
+	}
+
+	err = transparent.RemoveShard(ctx, shard, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+	page, err := a.Scan(ctx, transparent.ScanRange{})
+	if err != nil || len(page.Keys) != 0 {
+		t.Error(err, page)
+	}
+
+	err = transparent.AddShard(ctx, shard, "b", a)
+	if err == nil {
+		t.Error("duplicated shard is added")
+	}
+	err = transparent.RemoveShard(ctx, shard, "a")
+	if err == nil {
+		t.Error("removed shard is removed again")
+	}
+}
+
+// unremovable is Layer which fails Remove
+type unremovable struct {
+	transparent.Layer
+}
+
+func (u *unremovable) RemoveContext(ctx context.Context, key interface{}) error {
+	return errors.New("remove failed")
+}
+
+func TestShardMigrationCleanup(t *testing.T) {
+	a := &unremovable{test.NewSource(0)}
+	s, shard := newShardStack(t, transparent.WithShard("a", a), transparent.WithMigration())
+	defer s.Stop()
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		s.Set(key, []byte(key))
+	}
+
+	// Failure to remove copied keys doesn't fail the new ring
+	err := transparent.AddShard(context.Background(), shard, "b", test.NewSource(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := 0
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		value, err := s.Get(key)
+		if err != nil || string(value.([]byte)) != key {
+			t.Error(key, value, err)
+		}
+		if name, _ := transparent.ShardOf(shard, key); name == "b" {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Error("no key is moved")
+	}
+}
@@ -2,26 +2,35 @@ package simple
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/gob"
 	"fmt"
 	"reflect"
+	"time"
 
 	"github.com/juntaki/transparent"
 	"github.com/pkg/errors"
 )
 
+// StorageWrapper encodes any key and value to string and []byte
+// for the simple storage.
 type StorageWrapper struct {
 	transparent.BackendStorage
 }
 
 // Get is file read
 func (f *StorageWrapper) Get(k interface{}) (interface{}, error) {
+	return f.GetContext(context.Background(), k)
+}
+
+// GetContext is file read
+func (f *StorageWrapper) GetContext(ctx context.Context, k interface{}) (interface{}, error) {
 	key, err := f.encodeKey(k)
 	if err != nil {
 		return nil, err
 	}
-	v, err := f.BackendStorage.Get(key)
+	v, err := f.get(ctx, key)
 	if err != nil {
 		_, ok := err.(*transparent.KeyNotFoundError)
 		if ok {
@@ -38,6 +47,11 @@ func (f *StorageWrapper) Get(k interface{}) (interface{}, error) {
 
 // Add is file write
 func (f *StorageWrapper) Add(k interface{}, v interface{}) error {
+	return f.AddContext(context.Background(), k, v)
+}
+
+// AddContext is file write
+func (f *StorageWrapper) AddContext(ctx context.Context, k interface{}, v interface{}) error {
 	key, err := f.encodeKey(k)
 	if err != nil {
 		return err
@@ -46,26 +60,135 @@ func (f *StorageWrapper) Add(k interface{}, v interface{}) error {
 	if err != nil {
 		return err
 	}
-	err = f.BackendStorage.Add(key, data)
+	err = f.add(ctx, key, data)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// AddWithTTL is file write, it expires after ttl
+func (f *StorageWrapper) AddWithTTL(ctx context.Context, k interface{}, v interface{}, ttl time.Duration) error {
+	s, ok := f.BackendStorage.(transparent.BackendStorageTTL)
+	if !ok {
+		return errors.New("storage doesn't support TTL")
+	}
+	key, err := f.encodeKey(k)
+	if err != nil {
+		return err
+	}
+	data, err := f.encodeValue(v)
+	if err != nil {
+		return err
+	}
+	return s.AddWithTTL(ctx, key, data, ttl)
+}
+
 // Remove is file unlink
 func (f *StorageWrapper) Remove(k interface{}) error {
+	return f.RemoveContext(context.Background(), k)
+}
+
+// RemoveContext is file unlink
+func (f *StorageWrapper) RemoveContext(ctx context.Context, k interface{}) error {
 	key, err := f.encodeKey(k)
 	if err != nil {
 		return err
 	}
-	err = f.BackendStorage.Remove(key)
+	err = f.remove(ctx, key)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// GetMulti is read of multiple keys
+func (f *StorageWrapper) GetMulti(ctx context.Context, ks []interface{}) (map[interface{}]interface{}, error) {
+	original := make(map[interface{}]interface{}, len(ks))
+	keys := make([]interface{}, 0, len(ks))
+	for _, k := range ks {
+		key, err := f.encodeKey(k)
+		if err != nil {
+			return nil, err
+		}
+		original[key] = k
+		keys = append(keys, key)
+	}
+	vs, err := transparent.NewBackendStorageMulti(f.BackendStorage).GetMulti(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[interface{}]interface{}, len(vs))
+	for key, v := range vs {
+		data, err := f.decodeValue(v.([]byte))
+		if err != nil {
+			return nil, err
+		}
+		values[original[key]] = data
+	}
+	return values, nil
+}
+
+// AddMulti is write of multiple keys
+func (f *StorageWrapper) AddMulti(ctx context.Context, vs map[interface{}]interface{}) error {
+	values := make(map[interface{}]interface{}, len(vs))
+	for k, v := range vs {
+		key, err := f.encodeKey(k)
+		if err != nil {
+			return err
+		}
+		data, err := f.encodeValue(v)
+		if err != nil {
+			return err
+		}
+		values[key] = data
+	}
+	return transparent.NewBackendStorageMulti(f.BackendStorage).AddMulti(ctx, values)
+}
+
+// RemoveMulti is unlink of multiple keys
+func (f *StorageWrapper) RemoveMulti(ctx context.Context, ks []interface{}) error {
+	keys := make([]interface{}, 0, len(ks))
+	for _, k := range ks {
+		key, err := f.encodeKey(k)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	return transparent.NewBackendStorageMulti(f.BackendStorage).RemoveMulti(ctx, keys)
+}
+
+func (f *StorageWrapper) get(ctx context.Context, key string) (interface{}, error) {
+	if s, ok := f.BackendStorage.(transparent.BackendStorageContext); ok {
+		return s.GetContext(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.BackendStorage.Get(key)
+}
+
+func (f *StorageWrapper) add(ctx context.Context, key string, data []byte) error {
+	if s, ok := f.BackendStorage.(transparent.BackendStorageContext); ok {
+		return s.AddContext(ctx, key, data)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return f.BackendStorage.Add(key, data)
+}
+
+func (f *StorageWrapper) remove(ctx context.Context, key string) error {
+	if s, ok := f.BackendStorage.(transparent.BackendStorageContext); ok {
+		return s.RemoveContext(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return f.BackendStorage.Remove(key)
+}
+
 func (f *StorageWrapper) encodeKey(k interface{}) (string, error) {
 	gob.Register(k)
 	buf := new(bytes.Buffer)
@@ -0,0 +1,47 @@
+package transparent
+
+import (
+	"context"
+	"sync"
+)
+
+// flightGroup deduplicates concurrent calls of the same key
+type flightGroup struct {
+	lock  sync.Mutex
+	calls map[interface{}]*flight
+}
+
+type flight struct {
+	done  chan bool
+	value interface{}
+	err   error
+}
+
+// do calls fn, or waits for fn in flight of the same key and shares its result.
+// shared is true if the result is shared from another call.
+func (g *flightGroup) do(ctx context.Context, key interface{}, fn func() (interface{}, error)) (value interface{}, err error, shared bool) {
+	g.lock.Lock()
+	if g.calls == nil {
+		g.calls = make(map[interface{}]*flight)
+	}
+	if f, ok := g.calls[key]; ok {
+		g.lock.Unlock()
+		select {
+		case <-f.done:
+			return f.value, f.err, true
+		case <-ctx.Done():
+			return nil, ctx.Err(), true
+		}
+	}
+	f := &flight{done: make(chan bool)}
+	g.calls[key] = f
+	g.lock.Unlock()
+
+	f.value, f.err = fn()
+
+	g.lock.Lock()
+	delete(g.calls, key)
+	g.lock.Unlock()
+	close(f.done)
+	return f.value, f.err, false
+}
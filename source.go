@@ -1,9 +1,14 @@
 package transparent
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"time"
+)
 
 type layerSource struct {
 	Storage BackendStorage
+	hub     *watchHub
 }
 
 // NewLayerSource returns LayerSource.
@@ -19,21 +24,140 @@ func NewLayerSource(storage BackendStorage) (Layer, error) {
 
 // Set set new value to storage.
 func (s *layerSource) Set(key interface{}, value interface{}) (err error) {
-	err = s.Storage.Add(key, value)
+	return s.SetContext(context.Background(), key, value)
+}
+
+// SetContext set new value to storage.
+func (s *layerSource) SetContext(ctx context.Context, key interface{}, value interface{}) (err error) {
+	err = add(ctx, s.Storage, key, value)
 	if err != nil {
 		return err
 	}
+	s.hub.notify(s, MessageSet, key, value)
+	return nil
+}
+
+// SetWithTTL set new value to storage, it expires after ttl.
+func (s *layerSource) SetWithTTL(ctx context.Context, key interface{}, value interface{}, ttl time.Duration) error {
+	if _, err := ExpireAt(ttl); err != nil {
+		return err
+	}
+	err := addWithTTL(ctx, s.Storage, key, value, ttl)
+	if err != nil {
+		return err
+	}
+	s.hub.notify(s, MessageSet, key, value)
 	return nil
 }
 
 // Get value from storage
 func (s *layerSource) Get(key interface{}) (value interface{}, err error) {
-	return s.Storage.Get(key)
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext value from storage
+func (s *layerSource) GetContext(ctx context.Context, key interface{}) (value interface{}, err error) {
+	return get(ctx, s.Storage, key)
 }
 
 // Remove value
 func (s *layerSource) Remove(key interface{}) (err error) {
-	return s.Storage.Remove(key)
+	return s.RemoveContext(context.Background(), key)
+}
+
+// RemoveContext value
+func (s *layerSource) RemoveContext(ctx context.Context, key interface{}) (err error) {
+	err = remove(ctx, s.Storage, key)
+	if err != nil {
+		return err
+	}
+	s.hub.notify(s, MessageRemove, key, nil)
+	return nil
+}
+
+// GetMulti values from storage
+func (s *layerSource) GetMulti(ctx context.Context, keys []interface{}) (map[interface{}]interface{}, error) {
+	return NewBackendStorageMulti(s.Storage).GetMulti(ctx, keys)
+}
+
+// SetMulti set new values to storage
+func (s *layerSource) SetMulti(ctx context.Context, values map[interface{}]interface{}) error {
+	err := NewBackendStorageMulti(s.Storage).AddMulti(ctx, values)
+	if err != nil {
+		return err
+	}
+	for key, value := range values {
+		s.hub.notify(s, MessageSet, key, value)
+	}
+	return nil
+}
+
+// RemoveMulti values
+func (s *layerSource) RemoveMulti(ctx context.Context, keys []interface{}) error {
+	err := NewBackendStorageMulti(s.Storage).RemoveMulti(ctx, keys)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		s.hub.notify(s, MessageRemove, key, nil)
+	}
+	return nil
+}
+
+// Scan keys in storage
+func (s *layerSource) Scan(ctx context.Context, r ScanRange) (*ScanPage, error) {
+	return scan(ctx, s.Storage, r)
+}
+
+// GetVersion value and its version from storage
+func (s *layerSource) GetVersion(ctx context.Context, key interface{}) (interface{}, string, error) {
+	storage, err := versionStorage(s.Storage)
+	if err != nil {
+		return nil, "", err
+	}
+	return storage.GetVersion(ctx, key)
+}
+
+// SetIfAbsent set new value to storage, if the key doesn't exist
+func (s *layerSource) SetIfAbsent(ctx context.Context, key interface{}, value interface{}) (string, error) {
+	storage, err := versionStorage(s.Storage)
+	if err != nil {
+		return "", err
+	}
+	version, err := storage.AddIfAbsent(ctx, key, value)
+	if err != nil {
+		return "", err
+	}
+	s.hub.notify(s, MessageSet, key, value)
+	return version, nil
+}
+
+// CompareAndSwap set new value to storage, if the version is matched
+func (s *layerSource) CompareAndSwap(ctx context.Context, key interface{}, value interface{}, version string) (string, error) {
+	storage, err := versionStorage(s.Storage)
+	if err != nil {
+		return "", err
+	}
+	newVersion, err := storage.AddIfVersion(ctx, key, value, version)
+	if err != nil {
+		return "", err
+	}
+	s.hub.notify(s, MessageSet, key, value)
+	return newVersion, nil
+}
+
+// RemoveIfVersion remove value, if the version is matched
+func (s *layerSource) RemoveIfVersion(ctx context.Context, key interface{}, version string) error {
+	storage, err := versionStorage(s.Storage)
+	if err != nil {
+		return err
+	}
+	err = storage.RemoveIfVersion(ctx, key, version)
+	if err != nil {
+		return err
+	}
+	s.hub.notify(s, MessageRemove, key, nil)
+	return nil
 }
 
 // Sync do nothing
@@ -41,6 +165,15 @@ func (s *layerSource) Sync() error {
 	return nil
 }
 
+// SyncContext do nothing
+func (s *layerSource) SyncContext(ctx context.Context) error {
+	return nil
+}
+
+func (s *layerSource) setHub(h *watchHub) {
+	s.hub = h
+}
+
 func (s *layerSource) setNext(next Layer) error {
 	return errors.New("don't set next layer")
 }
@@ -1,9 +1,12 @@
 package test
 
 import (
+	"context"
+	"fmt"
 	"reflect"
 	"runtime/debug"
 	"testing"
+	"time"
 
 	"github.com/juntaki/transparent"
 	"github.com/juntaki/transparent/simple"
@@ -66,6 +69,321 @@ func BasicStorageFunc(t *testing.T, storage transparent.BackendStorage) {
 	}
 }
 
+// TTLStorageFunc is AddWithTTL and Get after expiration
+func TTLStorageFunc(t *testing.T, storage transparent.BackendStorage) {
+	ttlStorage, ok := storage.(transparent.BackendStorageTTL)
+	if !ok {
+		t.Fatal("TTL is not supported")
+	}
+	err := ttlStorage.AddWithTTL(context.Background(), "ttl", []byte("value"), 0)
+	if err == nil {
+		t.Error("ttl which is not positive is accepted")
+	}
+	err = ttlStorage.AddWithTTL(context.Background(), "ttl", []byte("value"), 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := storage.Get("ttl")
+	if err != nil || string(value.([]byte)) != "value" {
+		t.Fatal(err, value)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	value, err = storage.Get("ttl")
+	if _, ok := err.(*transparent.KeyNotFoundError); !ok {
+		t.Error(err, value)
+	}
+}
+
+// TTLStackFunc is SetWithTTL and Get after expiration
+func TTLStackFunc(t *testing.T, s *transparent.Stack) {
+	err := s.SetWithTTL(context.Background(), "ttl", []byte("value"), 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := s.Get("ttl")
+	if err != nil || string(value.([]byte)) != "value" {
+		t.Fatal(err, value)
+	}
+	err = s.Sync()
+	if err != nil {
+		t.Error(err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	value, err = s.Get("ttl")
+	if _, ok := err.(*transparent.KeyNotFoundError); !ok {
+		t.Error(err, value)
+	}
+}
+
+// MultiStorageFunc is GetMulti, AddMulti and RemoveMulti
+func MultiStorageFunc(t *testing.T, storage transparent.BackendStorage) {
+	ctx := context.Background()
+	multiStorage, ok := storage.(transparent.BackendStorageMulti)
+	if !ok {
+		t.Fatal("multi-key operation is not supported")
+	}
+	err := multiStorage.AddMulti(ctx, map[interface{}]interface{}{
+		"multi1": []byte("value1"),
+		"multi2": []byte("value2"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := multiStorage.GetMulti(ctx, []interface{}{"multi1", "multi2", "multi3"})
+	if err != nil || len(values) != 2 ||
+		string(values["multi1"].([]byte)) != "value1" ||
+		string(values["multi2"].([]byte)) != "value2" {
+		t.Fatal(err, values)
+	}
+
+	err = multiStorage.RemoveMulti(ctx, []interface{}{"multi1", "multi2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err = multiStorage.GetMulti(ctx, []interface{}{"multi1", "multi2"})
+	if err != nil || len(values) != 0 {
+		t.Error(err, values)
+	}
+}
+
+// MultiStackFunc is SetMulti, GetMulti and RemoveMulti
+func MultiStackFunc(t *testing.T, s *transparent.Stack) {
+	ctx := context.Background()
+	err := s.SetMulti(ctx, map[interface{}]interface{}{
+		"multi1": []byte("value1"),
+		"multi2": []byte("value2"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Sync()
+	if err != nil {
+		t.Error(err)
+	}
+	values, err := s.GetMulti(ctx, []interface{}{"multi1", "multi2", "multi3"})
+	if err != nil || len(values) != 2 ||
+		string(values["multi1"].([]byte)) != "value1" ||
+		string(values["multi2"].([]byte)) != "value2" {
+		t.Fatal(err, values)
+	}
+	value, err := s.Get("multi2")
+	if err != nil || string(value.([]byte)) != "value2" {
+		t.Error(err, value)
+	}
+
+	err = s.RemoveMulti(ctx, []interface{}{"multi1", "multi2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err = s.GetMulti(ctx, []interface{}{"multi1", "multi2"})
+	if err != nil || len(values) != 0 {
+		t.Error(err, values)
+	}
+}
+
+// ScanStorageFunc is Scan with prefix, range and pagination
+func ScanStorageFunc(t *testing.T, storage transparent.BackendStorage) {
+	ctx := context.Background()
+	scanStorage, ok := storage.(transparent.BackendStorageScan)
+	if !ok {
+		t.Fatal("scan is not supported")
+	}
+	keys := []string{"scan-a", "scan-b", "scan-c", "other"}
+	for _, key := range keys {
+		err := storage.Add(key, []byte("value"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer storage.Remove(key)
+	}
+
+	page, err := scanStorage.Scan(ctx, transparent.ScanRange{Prefix: "scan-", Limit: 2})
+	if err != nil || !reflect.DeepEqual(page.Keys, []string{"scan-a", "scan-b"}) || page.Next != "scan-b" {
+		t.Fatal(err, page)
+	}
+	page, err = scanStorage.Scan(ctx, transparent.ScanRange{Prefix: "scan-", After: page.Next, Limit: 2})
+	if err != nil || !reflect.DeepEqual(page.Keys, []string{"scan-c"}) || page.Next != "" {
+		t.Fatal(err, page)
+	}
+	page, err = scanStorage.Scan(ctx, transparent.ScanRange{After: "scan-a", Before: "scan-c"})
+	if err != nil || !reflect.DeepEqual(page.Keys, []string{"scan-b"}) || page.Next != "" {
+		t.Fatal(err, page)
+	}
+}
+
+// ScanStackFunc is Iterate keys across layers
+func ScanStackFunc(t *testing.T, s *transparent.Stack) {
+	keys := []string{"scan-a", "scan-b", "scan-c"}
+	for _, key := range keys {
+		err := s.Set(key, []byte("value"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Remove(key)
+	}
+	scanned := []string{}
+	it := s.Iterate(context.Background(), transparent.ScanRange{Prefix: "scan-", Limit: 2})
+	for it.Next() {
+		scanned = append(scanned, it.Key())
+	}
+	if it.Err() != nil || !reflect.DeepEqual(scanned, keys) {
+		t.Error(it.Err(), scanned)
+	}
+}
+
+// VersionStorageFunc is conditional Add and Remove
+func VersionStorageFunc(t *testing.T, storage transparent.BackendStorage) {
+	ctx := context.Background()
+	versionStorage, ok := storage.(transparent.BackendStorageVersion)
+	if !ok {
+		t.Fatal("version is not supported")
+	}
+	version1, err := versionStorage.AddIfAbsent(ctx, "version", []byte("value1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = versionStorage.AddIfAbsent(ctx, "version", []byte("value2"))
+	if _, ok := err.(*transparent.VersionConflictError); !ok {
+		t.Fatal(err)
+	}
+	value, version, err := versionStorage.GetVersion(ctx, "version")
+	if err != nil || string(value.([]byte)) != "value1" || version != version1 {
+		t.Fatal(err, value, version)
+	}
+
+	_, err = versionStorage.AddIfVersion(ctx, "version", []byte("value2"), "invalid")
+	if _, ok := err.(*transparent.VersionConflictError); !ok {
+		t.Fatal(err)
+	}
+	version2, err := versionStorage.AddIfVersion(ctx, "version", []byte("value2"), version1)
+	if err != nil || version2 == version1 {
+		t.Fatal(err, version2)
+	}
+
+	err = versionStorage.RemoveIfVersion(ctx, "version", version1)
+	if _, ok := err.(*transparent.VersionConflictError); !ok {
+		t.Fatal(err)
+	}
+	err = versionStorage.RemoveIfVersion(ctx, "version", version2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = storage.Get("version")
+	if _, ok := err.(*transparent.KeyNotFoundError); !ok {
+		t.Error(err)
+	}
+}
+
+// VersionStackFunc is conditional Set and Remove
+func VersionStackFunc(t *testing.T, s *transparent.Stack) {
+	ctx := context.Background()
+	version1, err := s.SetIfAbsent(ctx, "version", []byte("value1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.SetIfAbsent(ctx, "version", []byte("value2"))
+	if _, ok := err.(*transparent.VersionConflictError); !ok {
+		t.Fatal(err)
+	}
+	version2, err := s.CompareAndSwap(ctx, "version", []byte("value2"), version1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.CompareAndSwap(ctx, "version", []byte("value3"), version1)
+	if _, ok := err.(*transparent.VersionConflictError); !ok {
+		t.Fatal(err)
+	}
+	value, version, err := s.GetVersion(ctx, "version")
+	if err != nil || string(value.([]byte)) != "value2" || version != version2 {
+		t.Fatal(err, value, version)
+	}
+	err = s.RemoveIfVersion(ctx, "version", version2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Get("version")
+	if _, ok := err.(*transparent.KeyNotFoundError); !ok {
+		t.Error(err)
+	}
+}
+
+// TransactionStackFunc is multi-key transaction, and conflicted one which is not applied
+func TransactionStackFunc(t *testing.T, s *transparent.Stack) {
+	ctx := context.Background()
+	err := s.Set("tx1", []byte("value1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, version, err := s.GetVersion(ctx, "tx1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := s.Begin()
+	tx.CompareAndSwap("tx1", []byte("value2"), version)
+	tx.Set("tx2", []byte("value2"))
+	err = tx.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"tx1", "tx2"} {
+		value, err := s.Get(key)
+		if err != nil || string(value.([]byte)) != "value2" {
+			t.Error(key, err, value)
+		}
+	}
+
+	// Stale version aborts all operations
+	tx = s.Begin()
+	tx.Remove("tx2")
+	tx.CompareAndSwap("tx1", []byte("value3"), version)
+	err = tx.Commit(ctx)
+	if _, ok := err.(*transparent.VersionConflictError); !ok {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"tx1", "tx2"} {
+		value, err := s.Get(key)
+		if err != nil || string(value.([]byte)) != "value2" {
+			t.Error(key, err, value)
+		}
+	}
+	s.Remove("tx1")
+	s.Remove("tx2")
+}
+
+// ReadModeStackFunc is Get of the value Set by writer, from reader by each ReadMode.
+// reader should be another node of the same consensus.
+func ReadModeStackFunc(t *testing.T, writer, reader *transparent.Stack) {
+	for _, mode := range []transparent.ReadMode{transparent.ReadIndex, transparent.ReadLease} {
+		ctx := transparent.WithReadMode(context.Background(), mode)
+		for i := 0; i < 10; i++ {
+			expected := fmt.Sprint("value", mode, i)
+			err := writer.Set("read", []byte(expected))
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, err := reader.GetContext(ctx, "read")
+			if err != nil || string(value.([]byte)) != expected {
+				t.Fatal(mode, err, value)
+			}
+		}
+	}
+
+	// ReadMode of Stack
+	reader.SetReadMode(transparent.ReadIndex)
+	defer reader.SetReadMode(transparent.ReadLocal)
+	err := writer.Set("read", []byte("stack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := reader.Get("read")
+	if err != nil || string(value.([]byte)) != "stack" {
+		t.Fatal(err, value)
+	}
+	writer.Remove("read")
+}
+
 // BasicStackFunc is Get Remove and Sync
 func BasicStackFunc(t *testing.T, s *transparent.Stack) {
 	err := s.Set("test", []byte("value"))
@@ -96,6 +414,33 @@ func BasicStackFunc(t *testing.T, s *transparent.Stack) {
 	}
 }
 
+// ContextStackFunc is Set and Get with done context.
+// Stack should be stacked on slow source, such as NewSource(100)
+func ContextStackFunc(t *testing.T, s *transparent.Stack) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := s.SetContext(ctx, "context", []byte("value"))
+	if err != context.Canceled {
+		t.Error(err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	value, err := s.GetContext(ctx, "context")
+	if err != context.DeadlineExceeded {
+		t.Error(err, value)
+	}
+
+	err = s.SetContext(context.Background(), "context", []byte("value"))
+	if err != nil {
+		t.Error(err)
+	}
+	err = s.SyncContext(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+}
+
 // BasicCacheFunc is test for transparent.Cache
 func BasicCacheFunc(t *testing.T, c transparent.Layer) {
 	s := NewSource(0)
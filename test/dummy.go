@@ -2,6 +2,8 @@
 package test
 
 import (
+	"context"
+	"strconv"
 	"sync"
 	"time"
 
@@ -9,45 +11,256 @@ import (
 )
 
 type storage struct {
-	lock sync.RWMutex
-	list map[interface{}]interface{}
-	wait time.Duration
+	lock     sync.RWMutex
+	list     map[interface{}]interface{}
+	expire   map[interface{}]time.Time
+	versions map[interface{}]string
+	version  uint64 // Last version of value
+	wait     time.Duration
 }
 
 // NewStorage returns Storage
 func NewStorage(wait time.Duration) transparent.BackendStorage {
 	return &storage{
-		list: make(map[interface{}]interface{}, 0),
-		wait: wait,
+		list:     make(map[interface{}]interface{}, 0),
+		expire:   make(map[interface{}]time.Time, 0),
+		versions: make(map[interface{}]string, 0),
+		wait:     wait,
 	}
 }
 
 // Get returns value from map
 func (d *storage) Get(k interface{}) (interface{}, error) {
-	time.Sleep(d.wait * time.Millisecond)
+	return d.GetContext(context.Background(), k)
+}
+
+// GetContext returns value from map
+func (d *storage) GetContext(ctx context.Context, k interface{}) (interface{}, error) {
+	err := d.sleep(ctx)
+	if err != nil {
+		return nil, err
+	}
 	d.lock.RLock()
 	defer d.lock.RUnlock()
+	return d.get(k)
+}
+
+func (d *storage) get(k interface{}) (interface{}, error) {
 	value, ok := d.list[k]
+	if expire, ok := d.expire[k]; ok && expire.Before(time.Now()) {
+		return nil, &transparent.KeyNotFoundError{Key: k}
+	}
 	if !ok {
 		return nil, &transparent.KeyNotFoundError{Key: k}
 	}
 	return value, nil
 }
 
+// bump changes version of the key
+func (d *storage) bump(k interface{}) string {
+	d.version++
+	d.versions[k] = strconv.FormatUint(d.version, 10)
+	return d.versions[k]
+}
+
 // Add insert value to map
 func (d *storage) Add(k interface{}, v interface{}) error {
-	time.Sleep(d.wait * time.Millisecond)
+	return d.AddContext(context.Background(), k, v)
+}
+
+// AddContext insert value to map
+func (d *storage) AddContext(ctx context.Context, k interface{}, v interface{}) error {
+	err := d.sleep(ctx)
+	if err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.list[k] = v
+	delete(d.expire, k)
+	d.bump(k)
+	return nil
+}
+
+// AddWithTTL insert value to map, it expires after ttl
+func (d *storage) AddWithTTL(ctx context.Context, k interface{}, v interface{}, ttl time.Duration) error {
+	expire, err := transparent.ExpireAt(ttl)
+	if err != nil {
+		return err
+	}
+	err = d.sleep(ctx)
+	if err != nil {
+		return err
+	}
 
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	d.list[k] = v
+	d.expire[k] = expire
+	d.bump(k)
 	return nil
 }
 
 // Remove deletes key from map
 func (d *storage) Remove(k interface{}) error {
+	return d.RemoveContext(context.Background(), k)
+}
+
+// RemoveContext deletes key from map
+func (d *storage) RemoveContext(ctx context.Context, k interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	delete(d.list, k)
+	delete(d.expire, k)
+	delete(d.versions, k)
+	return nil
+}
+
+// GetMulti returns values from map
+func (d *storage) GetMulti(ctx context.Context, keys []interface{}) (map[interface{}]interface{}, error) {
+	err := d.sleep(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	values := make(map[interface{}]interface{}, len(keys))
+	for _, k := range keys {
+		value, ok := d.list[k]
+		if expire, expiring := d.expire[k]; !ok || expiring && expire.Before(time.Now()) {
+			continue
+		}
+		values[k] = value
+	}
+	return values, nil
+}
+
+// AddMulti insert values to map
+func (d *storage) AddMulti(ctx context.Context, values map[interface{}]interface{}) error {
+	err := d.sleep(ctx)
+	if err != nil {
+		return err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for k, v := range values {
+		d.list[k] = v
+		delete(d.expire, k)
+		d.bump(k)
+	}
 	return nil
 }
+
+// RemoveMulti deletes keys from map
+func (d *storage) RemoveMulti(ctx context.Context, keys []interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, k := range keys {
+		delete(d.list, k)
+		delete(d.expire, k)
+		delete(d.versions, k)
+	}
+	return nil
+}
+
+// Scan string keys in map
+func (d *storage) Scan(ctx context.Context, r transparent.ScanRange) (*transparent.ScanPage, error) {
+	err := d.sleep(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	keys := make([]string, 0, len(d.list))
+	for k := range d.list {
+		key, ok := k.(string)
+		if !ok {
+			continue
+		}
+		if expire, ok := d.expire[k]; ok && expire.Before(time.Now()) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return transparent.ScanKeys(keys, r), nil
+}
+
+// GetVersion returns value and its version from map
+func (d *storage) GetVersion(ctx context.Context, k interface{}) (interface{}, string, error) {
+	err := d.sleep(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	value, err := d.get(k)
+	if err != nil {
+		return nil, "", err
+	}
+	return value, d.versions[k], nil
+}
+
+// AddIfAbsent insert value to map if the key doesn't exist
+func (d *storage) AddIfAbsent(ctx context.Context, k interface{}, v interface{}) (string, error) {
+	err := d.sleep(ctx)
+	if err != nil {
+		return "", err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, err := d.get(k); err == nil {
+		return "", &transparent.VersionConflictError{Key: k}
+	}
+	d.list[k] = v
+	delete(d.expire, k)
+	return d.bump(k), nil
+}
+
+// AddIfVersion insert value to map if the version is matched
+func (d *storage) AddIfVersion(ctx context.Context, k interface{}, v interface{}, version string) (string, error) {
+	err := d.sleep(ctx)
+	if err != nil {
+		return "", err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, err := d.get(k); err != nil || d.versions[k] != version {
+		return "", &transparent.VersionConflictError{Key: k}
+	}
+	d.list[k] = v
+	delete(d.expire, k)
+	return d.bump(k), nil
+}
+
+// RemoveIfVersion deletes key from map if the version is matched
+func (d *storage) RemoveIfVersion(ctx context.Context, k interface{}, version string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, err := d.get(k); err != nil || d.versions[k] != version {
+		return &transparent.VersionConflictError{Key: k}
+	}
+	delete(d.list, k)
+	delete(d.expire, k)
+	delete(d.versions, k)
+	return nil
+}
+
+// sleep waits d.wait milliseconds, unless ctx is done
+func (d *storage) sleep(ctx context.Context) error {
+	select {
+	case <-time.After(d.wait * time.Millisecond):
+		return ctx.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
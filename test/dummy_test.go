@@ -9,9 +9,22 @@ import (
 func TestDummy(t *testing.T) {
 	ds := NewStorage(0)
 	BasicStorageFunc(t, ds)
+	TTLStorageFunc(t, ds)
+	MultiStorageFunc(t, ds)
+	ScanStorageFunc(t, ds)
+	VersionStorageFunc(t, ds)
 
 	l := NewSource(1)
 	s := transparent.NewStack()
 	s.Stack(l)
 	BasicStackFunc(t, s)
+	ScanStackFunc(t, s)
+	VersionStackFunc(t, s)
+}
+
+func TestDummyContext(t *testing.T) {
+	l := NewSource(100)
+	s := transparent.NewStack()
+	s.Stack(l)
+	ContextStackFunc(t, s)
 }
@@ -0,0 +1,94 @@
+package transparent
+
+import (
+	"context"
+	"errors"
+)
+
+// Transaction is the set of writes, which is applied atomically by Commit.
+// Conditional writes are validated on Commit, and if any version is not matched,
+// no write is applied and Commit returns VersionConflictError.
+type Transaction struct {
+	stack      *Stack
+	operations []*Message
+}
+
+// transactional is Layer which can commit Transaction
+type transactional interface {
+	commitTransaction(ctx context.Context, operations []*Message) error
+}
+
+// Begin returns new Transaction of the Stack.
+// It is committed by the top layer, which must be consensus or cache on consensus.
+func (s *Stack) Begin() *Transaction {
+	return &Transaction{stack: s}
+}
+
+// Set adds Set of the key-value to the transaction
+func (t *Transaction) Set(key interface{}, value interface{}) {
+	t.operations = append(t.operations, &Message{Key: key, Value: value, Message: MessageSet})
+}
+
+// Remove adds Remove of the key to the transaction
+func (t *Transaction) Remove(key interface{}) {
+	t.operations = append(t.operations, &Message{Key: key, Message: MessageRemove})
+}
+
+// CompareAndSwap adds Set of the key-value to the transaction, if the version is matched on Commit
+func (t *Transaction) CompareAndSwap(key interface{}, value interface{}, version string) {
+	t.operations = append(t.operations, &Message{Key: key, Value: value, Message: MessageSet, Version: version})
+}
+
+// RemoveIfVersion adds Remove of the key to the transaction, if the version is matched on Commit
+func (t *Transaction) RemoveIfVersion(key interface{}, version string) {
+	t.operations = append(t.operations, &Message{Key: key, Message: MessageRemove, Version: version})
+}
+
+// Commit applies all writes atomically, in the added order
+func (t *Transaction) Commit(ctx context.Context) error {
+	if len(t.operations) == 0 {
+		return nil
+	}
+	if t.stack.Layer == nil {
+		return errors.New("no layer in Stack")
+	}
+	return commitTransaction(ctx, t.stack.Layer, t.operations)
+}
+
+func commitTransaction(ctx context.Context, l Layer, operations []*Message) error {
+	if t, ok := l.(transactional); ok {
+		return t.commitTransaction(ctx, operations)
+	}
+	return errors.New("layer doesn't support transaction")
+}
+
+// applyTransaction applies the operations to the layer, versions are validated before.
+// If any operation is failed, the values before the transaction are restored without TTL.
+func applyTransaction(ctx context.Context, l Layer, operations []*Message) error {
+	var err error
+	undo := []*Message{}
+	for _, op := range operations {
+		restore := &Message{Key: op.Key, Message: MessageSet}
+		restore.Value, err = l.GetContext(ctx, op.Key)
+		if _, ok := err.(*KeyNotFoundError); ok {
+			restore.Message = MessageRemove
+		} else if err != nil {
+			rollback(ctx, l, undo)
+			return err
+		}
+		err = apply(ctx, l, op.Key, op)
+		if err != nil {
+			rollback(ctx, l, undo)
+			return err
+		}
+		undo = append(undo, restore)
+	}
+	return nil
+}
+
+// rollback applies undo operations in reverse order
+func rollback(ctx context.Context, l Layer, undo []*Message) {
+	for i := len(undo) - 1; i >= 0; i-- {
+		apply(ctx, l, undo[i].Key, undo[i])
+	}
+}
@@ -1,10 +1,15 @@
 package transparent
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"time"
+)
 
 type layerReceiver struct {
 	Receiver BackendReceiver
 	next     Layer
+	hub      *watchHub
 }
 
 // NewLayerReceiver returns LayerReceiver.
@@ -24,21 +29,90 @@ func (r *layerReceiver) Set(key interface{}, value interface{}) error {
 	return errors.New("don't send Set")
 }
 
+// SetContext is not allowed, operation should be transfered from Transmitter.
+func (r *layerReceiver) SetContext(ctx context.Context, key interface{}, value interface{}) error {
+	return errors.New("don't send Set")
+}
+
+// SetWithTTL is not allowed, operation should be transfered from Transmitter.
+func (r *layerReceiver) SetWithTTL(ctx context.Context, key interface{}, value interface{}, ttl time.Duration) error {
+	return errors.New("don't send Set")
+}
+
 // Get is not allowed, operation should be transfered from Transmitter.
 func (r *layerReceiver) Get(key interface{}) (value interface{}, err error) {
 	return nil, errors.New("don't send Get")
 }
 
+// GetContext is not allowed, operation should be transfered from Transmitter.
+func (r *layerReceiver) GetContext(ctx context.Context, key interface{}) (value interface{}, err error) {
+	return nil, errors.New("don't send Get")
+}
+
 // Remove is not allowed, operation should be transfered from Transmitter.
 func (r *layerReceiver) Remove(key interface{}) error {
 	return errors.New("don't send Remove")
 }
 
+// RemoveContext is not allowed, operation should be transfered from Transmitter.
+func (r *layerReceiver) RemoveContext(ctx context.Context, key interface{}) error {
+	return errors.New("don't send Remove")
+}
+
+// GetMulti is not allowed, operation should be transfered from Transmitter.
+func (r *layerReceiver) GetMulti(ctx context.Context, keys []interface{}) (map[interface{}]interface{}, error) {
+	return nil, errors.New("don't send Get")
+}
+
+// SetMulti is not allowed, operation should be transfered from Transmitter.
+func (r *layerReceiver) SetMulti(ctx context.Context, values map[interface{}]interface{}) error {
+	return errors.New("don't send Set")
+}
+
+// RemoveMulti is not allowed, operation should be transfered from Transmitter.
+func (r *layerReceiver) RemoveMulti(ctx context.Context, keys []interface{}) error {
+	return errors.New("don't send Remove")
+}
+
+// Scan is not allowed, operation should be transfered from Transmitter.
+func (r *layerReceiver) Scan(ctx context.Context, sr ScanRange) (*ScanPage, error) {
+	return nil, errors.New("don't send Scan")
+}
+
+// GetVersion is not allowed, operation should be transfered from Transmitter.
+func (r *layerReceiver) GetVersion(ctx context.Context, key interface{}) (interface{}, string, error) {
+	return nil, "", errors.New("don't send Get")
+}
+
+// SetIfAbsent is not allowed, operation should be transfered from Transmitter.
+func (r *layerReceiver) SetIfAbsent(ctx context.Context, key interface{}, value interface{}) (string, error) {
+	return "", errors.New("don't send Set")
+}
+
+// CompareAndSwap is not allowed, operation should be transfered from Transmitter.
+func (r *layerReceiver) CompareAndSwap(ctx context.Context, key interface{}, value interface{}, version string) (string, error) {
+	return "", errors.New("don't send Set")
+}
+
+// RemoveIfVersion is not allowed, operation should be transfered from Transmitter.
+func (r *layerReceiver) RemoveIfVersion(ctx context.Context, key interface{}, version string) error {
+	return errors.New("don't send Remove")
+}
+
 // Sync is not allowed, operation should be transfered from Transmitter.
 func (r *layerReceiver) Sync() error {
 	return errors.New("don't send Sync")
 }
 
+// SyncContext is not allowed, operation should be transfered from Transmitter.
+func (r *layerReceiver) SyncContext(ctx context.Context) error {
+	return errors.New("don't send Sync")
+}
+
+func (r *layerReceiver) setHub(h *watchHub) {
+	r.hub = h
+}
+
 func (r *layerReceiver) setNext(l Layer) error {
 	r.next = l
 	return nil
@@ -58,15 +132,23 @@ func (r *layerReceiver) callback(m *Message) (*Message, error) {
 	switch m.Message {
 	case MessageSet:
 		message.Key = m.Key
-		err = r.next.Set(m.Key, m.Value)
+		err = apply(context.Background(), r.next, m.Key, m)
+		if err == nil {
+			r.hub.notify(r, MessageSet, m.Key, m.Value)
+		}
 	case MessageGet:
 		message.Key = m.Key
 		message.Value, err = r.next.Get(m.Key)
 	case MessageRemove:
 		message.Key = m.Key
 		err = r.next.Remove(m.Key)
+		if err == nil {
+			r.hub.notify(r, MessageRemove, m.Key, nil)
+		}
 	case MessageSync:
 		err = r.next.Sync()
+	case MessageBatch:
+		message.Batch, err = r.batch(context.Background(), m.Batch)
 	default:
 		err = errors.New("unknown message")
 	}
@@ -76,6 +158,73 @@ func (r *layerReceiver) callback(m *Message) (*Message, error) {
 	return &message, nil
 }
 
+// batch applies operations to next layer by multi-key methods.
+// Consecutive operations of the same type are applied at once, to keep the order.
+// It returns the results of Get.
+func (r *layerReceiver) batch(ctx context.Context, operations []*Message) ([]*Message, error) {
+	replies := []*Message{}
+	for i := 0; i < len(operations); {
+		// Find consecutive operations of the same type
+		j := i + 1
+		for j < len(operations) && operations[j].Message == operations[i].Message &&
+			operations[j].Expire.IsZero() && operations[i].Expire.IsZero() {
+			j++
+		}
+		run := operations[i:j]
+		i = j
+
+		switch run[0].Message {
+		case MessageGet:
+			keys := make([]interface{}, 0, len(run))
+			for _, o := range run {
+				keys = append(keys, o.Key)
+			}
+			values, err := r.next.GetMulti(ctx, keys)
+			if err != nil {
+				return nil, err
+			}
+			for key, value := range values {
+				replies = append(replies, &Message{Message: MessageGet, Key: key, Value: value})
+			}
+		case MessageSet:
+			if !run[0].Expire.IsZero() {
+				err := apply(ctx, r.next, run[0].Key, run[0])
+				if err != nil {
+					return nil, err
+				}
+				r.hub.notify(r, MessageSet, run[0].Key, run[0].Value)
+				continue
+			}
+			values := make(map[interface{}]interface{}, len(run))
+			for _, o := range run {
+				values[o.Key] = o.Value
+			}
+			err := r.next.SetMulti(ctx, values)
+			if err != nil {
+				return nil, err
+			}
+			for _, o := range run {
+				r.hub.notify(r, MessageSet, o.Key, o.Value)
+			}
+		case MessageRemove:
+			keys := make([]interface{}, 0, len(run))
+			for _, o := range run {
+				keys = append(keys, o.Key)
+			}
+			err := r.next.RemoveMulti(ctx, keys)
+			if err != nil {
+				return nil, err
+			}
+			for _, o := range run {
+				r.hub.notify(r, MessageRemove, o.Key, nil)
+			}
+		default:
+			return nil, errors.New("unknown message in batch")
+		}
+	}
+	return replies, nil
+}
+
 type layerTransmitter struct {
 	Transmitter BackendTransmitter
 }
@@ -92,12 +241,36 @@ func NewLayerTransmitter(Transmitter BackendTransmitter) Layer {
 
 // Set convert key-value to Message and Request it.
 func (r *layerTransmitter) Set(key interface{}, value interface{}) error {
+	return r.SetContext(context.Background(), key, value)
+}
+
+// SetContext convert key-value to Message and Request it.
+func (r *layerTransmitter) SetContext(ctx context.Context, key interface{}, value interface{}) error {
 	operation := &Message{
 		Message: MessageSet,
 		Key:     key,
 		Value:   value,
 	}
-	_, err := r.Transmitter.Request(operation)
+	_, err := request(ctx, r.Transmitter, operation)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetWithTTL convert key-value and expiration time to Message and Request it.
+func (r *layerTransmitter) SetWithTTL(ctx context.Context, key interface{}, value interface{}, ttl time.Duration) error {
+	expire, err := ExpireAt(ttl)
+	if err != nil {
+		return err
+	}
+	operation := &Message{
+		Message: MessageSet,
+		Key:     key,
+		Value:   value,
+		Expire:  expire,
+	}
+	_, err = request(ctx, r.Transmitter, operation)
 	if err != nil {
 		return err
 	}
@@ -106,12 +279,17 @@ func (r *layerTransmitter) Set(key interface{}, value interface{}) error {
 
 // Get convert key to Message and Request it.
 func (r *layerTransmitter) Get(key interface{}) (value interface{}, err error) {
+	return r.GetContext(context.Background(), key)
+}
+
+// GetContext convert key to Message and Request it.
+func (r *layerTransmitter) GetContext(ctx context.Context, key interface{}) (value interface{}, err error) {
 	operation := &Message{
 		Message: MessageGet,
 		Key:     key,
 	}
 
-	feature, err := r.Transmitter.Request(operation)
+	feature, err := request(ctx, r.Transmitter, operation)
 	if err != nil {
 		return nil, err
 	}
@@ -121,23 +299,95 @@ func (r *layerTransmitter) Get(key interface{}) (value interface{}, err error) {
 
 // Remove convert key to Message and Request it.
 func (r *layerTransmitter) Remove(key interface{}) error {
+	return r.RemoveContext(context.Background(), key)
+}
+
+// RemoveContext convert key to Message and Request it.
+func (r *layerTransmitter) RemoveContext(ctx context.Context, key interface{}) error {
 	operation := &Message{
 		Message: MessageRemove,
 		Key:     key,
 	}
-	_, err := r.Transmitter.Request(operation)
+	_, err := request(ctx, r.Transmitter, operation)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// GetMulti convert keys to Messages and Request them at once.
+func (r *layerTransmitter) GetMulti(ctx context.Context, keys []interface{}) (map[interface{}]interface{}, error) {
+	operations := make([]*Message, 0, len(keys))
+	for _, key := range keys {
+		operations = append(operations, &Message{Message: MessageGet, Key: key})
+	}
+	replies, err := requestBatch(ctx, r.Transmitter, operations)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[interface{}]interface{}, len(replies))
+	for _, reply := range replies {
+		values[reply.Key] = reply.Value
+	}
+	return values, nil
+}
+
+// SetMulti convert key-values to Messages and Request them at once.
+func (r *layerTransmitter) SetMulti(ctx context.Context, values map[interface{}]interface{}) error {
+	operations := make([]*Message, 0, len(values))
+	for key, value := range values {
+		operations = append(operations, &Message{Message: MessageSet, Key: key, Value: value})
+	}
+	_, err := requestBatch(ctx, r.Transmitter, operations)
+	return err
+}
+
+// RemoveMulti convert keys to Messages and Request them at once.
+func (r *layerTransmitter) RemoveMulti(ctx context.Context, keys []interface{}) error {
+	operations := make([]*Message, 0, len(keys))
+	for _, key := range keys {
+		operations = append(operations, &Message{Message: MessageRemove, Key: key})
+	}
+	_, err := requestBatch(ctx, r.Transmitter, operations)
+	return err
+}
+
+// Scan is not supported by Transmitter.
+func (r *layerTransmitter) Scan(ctx context.Context, sr ScanRange) (*ScanPage, error) {
+	return nil, errors.New("transmitter doesn't support Scan")
+}
+
+// GetVersion is not supported by Transmitter.
+func (r *layerTransmitter) GetVersion(ctx context.Context, key interface{}) (interface{}, string, error) {
+	return nil, "", errors.New("transmitter doesn't support version")
+}
+
+// SetIfAbsent is not supported by Transmitter.
+func (r *layerTransmitter) SetIfAbsent(ctx context.Context, key interface{}, value interface{}) (string, error) {
+	return "", errors.New("transmitter doesn't support version")
+}
+
+// CompareAndSwap is not supported by Transmitter.
+func (r *layerTransmitter) CompareAndSwap(ctx context.Context, key interface{}, value interface{}, version string) (string, error) {
+	return "", errors.New("transmitter doesn't support version")
+}
+
+// RemoveIfVersion is not supported by Transmitter.
+func (r *layerTransmitter) RemoveIfVersion(ctx context.Context, key interface{}, version string) error {
+	return errors.New("transmitter doesn't support version")
+}
+
 // Sync makes Message and Request it.
 func (r *layerTransmitter) Sync() error {
+	return r.SyncContext(context.Background())
+}
+
+// SyncContext makes Message and Request it.
+func (r *layerTransmitter) SyncContext(ctx context.Context) error {
 	operation := &Message{
 		Message: MessageSync,
 	}
-	_, err := r.Transmitter.Request(operation)
+	_, err := request(ctx, r.Transmitter, operation)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,16 @@
+package transfer
+
+import (
+	"github.com/juntaki/transparent"
+)
+
+// NewSimpleLayerInvalidation returns Invalidation layer.
+// It receives invalidations at serverAddr, and publishes them to peerAddrs.
+// Peers are named by their address.
+func NewSimpleLayerInvalidation(serverAddr string, peerAddrs ...string) (transparent.Layer, error) {
+	options := []transparent.InvalidationOption{}
+	for _, addr := range peerAddrs {
+		options = append(options, transparent.WithPeer(addr, NewSimpleTransmitter(addr)))
+	}
+	return transparent.NewLayerInvalidation(NewSimpleReceiver(serverAddr), options...)
+}
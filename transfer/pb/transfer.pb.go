@@ -40,6 +40,9 @@ const (
 	MessageType_Get    MessageType = 1
 	MessageType_Remove MessageType = 2
 	MessageType_Sync   MessageType = 3
+	MessageType_Batch  MessageType = 4
+	// Eviction of the key from cache
+	MessageType_Invalidate MessageType = 5
 )
 
 var MessageType_name = map[int32]string{
@@ -47,12 +50,16 @@ var MessageType_name = map[int32]string{
 	1: "Get",
 	2: "Remove",
 	3: "Sync",
+	4: "Batch",
+	5: "Invalidate",
 }
 var MessageType_value = map[string]int32{
-	"Set":    0,
-	"Get":    1,
-	"Remove": 2,
-	"Sync":   3,
+	"Set":        0,
+	"Get":        1,
+	"Remove":     2,
+	"Sync":       3,
+	"Batch":      4,
+	"Invalidate": 5,
 }
 
 func (x MessageType) String() string {
@@ -64,6 +71,10 @@ type Message struct {
 	MessageType MessageType `protobuf:"varint,1,opt,name=messageType,enum=transfer.MessageType" json:"messageType,omitempty"`
 	Key         string      `protobuf:"bytes,2,opt,name=key" json:"key,omitempty"`
 	Value       []byte      `protobuf:"bytes,3,opt,name=value,proto3" json:"value,omitempty"`
+	// Expiration time in unix nano, 0 if the key never expires
+	Expire int64 `protobuf:"varint,4,opt,name=expire" json:"expire,omitempty"`
+	// Operations of Batch
+	Batch []*Message `protobuf:"bytes,5,rep,name=batch" json:"batch,omitempty"`
 }
 
 func (m *Message) Reset()                    { *m = Message{} }
@@ -92,6 +103,20 @@ func (m *Message) GetValue() []byte {
 	return nil
 }
 
+func (m *Message) GetExpire() int64 {
+	if m != nil {
+		return m.Expire
+	}
+	return 0
+}
+
+func (m *Message) GetBatch() []*Message {
+	if m != nil {
+		return m.Batch
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*Message)(nil), "transfer.Message")
 	proto.RegisterEnum("transfer.MessageType", MessageType_name, MessageType_value)
@@ -172,17 +197,21 @@ var _Transfer_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("transfer.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 192 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xe2, 0xe2, 0x2b, 0x29, 0x4a, 0xcc,
-	0x2b, 0x4e, 0x4b, 0x2d, 0xd2, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0xe2, 0x80, 0xf1, 0x95, 0xb2,
-	0xb8, 0xd8, 0x7d, 0x53, 0x8b, 0x8b, 0x13, 0xd3, 0x53, 0x85, 0xcc, 0xb9, 0xb8, 0x73, 0x21, 0xcc,
-	0x90, 0xca, 0x82, 0x54, 0x09, 0x46, 0x05, 0x46, 0x0d, 0x3e, 0x23, 0x51, 0x3d, 0xb8, 0x56, 0x24,
-	0xc9, 0x20, 0x64, 0x95, 0x42, 0x02, 0x5c, 0xcc, 0xd9, 0xa9, 0x95, 0x12, 0x4c, 0x0a, 0x8c, 0x1a,
-	0x9c, 0x41, 0x20, 0xa6, 0x90, 0x08, 0x17, 0x6b, 0x59, 0x62, 0x4e, 0x69, 0xaa, 0x04, 0xb3, 0x02,
-	0xa3, 0x06, 0x4f, 0x10, 0x84, 0xa3, 0x65, 0x8a, 0x62, 0x81, 0x10, 0x3b, 0x17, 0x73, 0x70, 0x6a,
-	0x89, 0x00, 0x03, 0x88, 0xe1, 0x9e, 0x5a, 0x22, 0xc0, 0x28, 0xc4, 0xc5, 0xc5, 0x16, 0x94, 0x9a,
-	0x9b, 0x5f, 0x96, 0x2a, 0xc0, 0x24, 0xc4, 0xc1, 0xc5, 0x12, 0x5c, 0x99, 0x97, 0x2c, 0xc0, 0x6c,
-	0x64, 0xcb, 0xc5, 0x11, 0x02, 0x75, 0x83, 0x90, 0x21, 0x17, 0x7b, 0x50, 0x6a, 0x61, 0x69, 0x6a,
-	0x71, 0x89, 0x90, 0x20, 0xc2, 0x65, 0x50, 0x1f, 0x48, 0x61, 0x0a, 0x29, 0x31, 0x24, 0xb1, 0x81,
-	0xbd, 0x6c, 0x0c, 0x08, 0x00, 0x00, 0xff, 0xff, 0x39, 0xd0, 0xab, 0xda, 0x04, 0x01, 0x00, 0x00,
+	// 249 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x64, 0x90, 0x31, 0x4f, 0xc3, 0x30,
+	0x14, 0x84, 0xeb, 0x3a, 0x4e, 0xd2, 0x57, 0x14, 0x99, 0x27, 0x40, 0x16, 0x93, 0xd5, 0x05, 0x8b,
+	0xa1, 0x12, 0x61, 0x60, 0x62, 0x61, 0x41, 0x0c, 0x48, 0xc8, 0xed, 0x1f, 0x70, 0xcb, 0x03, 0x2a,
+	0xda, 0x24, 0x24, 0x6e, 0x44, 0x7e, 0x13, 0x7f, 0x12, 0x85, 0x04, 0x68, 0xd5, 0xed, 0xce, 0xe7,
+	0xd3, 0x7d, 0x7a, 0x90, 0xf8, 0xd2, 0x65, 0xd5, 0x0b, 0x95, 0xd3, 0xa2, 0xcc, 0x7d, 0x8e, 0xf1,
+	0xaf, 0x9f, 0x7c, 0x31, 0x88, 0x1e, 0xa9, 0xaa, 0xdc, 0x2b, 0xe1, 0x0d, 0x8c, 0x37, 0x9d, 0x9c,
+	0x37, 0x05, 0x29, 0xa6, 0x99, 0x49, 0xd2, 0xd3, 0xe9, 0x5f, 0x77, 0x27, 0xb4, 0xbb, 0x3f, 0x51,
+	0x02, 0x7f, 0xa7, 0x46, 0x0d, 0x35, 0x33, 0x23, 0xdb, 0x4a, 0x3c, 0x01, 0x51, 0xbb, 0xf5, 0x96,
+	0x14, 0xd7, 0xcc, 0x1c, 0xd9, 0xce, 0xe0, 0x19, 0x84, 0xf4, 0x59, 0xac, 0x4a, 0x52, 0x81, 0x66,
+	0x86, 0xdb, 0xde, 0xe1, 0x05, 0x88, 0x85, 0xf3, 0xcb, 0x37, 0x25, 0x34, 0x37, 0xe3, 0xf4, 0xf8,
+	0x7f, 0xb2, 0x47, 0xb3, 0x5d, 0x7e, 0xf9, 0xb4, 0x47, 0x88, 0x11, 0xf0, 0x19, 0x79, 0x39, 0x68,
+	0xc5, 0x3d, 0x79, 0xc9, 0x10, 0x20, 0xb4, 0xb4, 0xc9, 0x6b, 0x92, 0x43, 0x8c, 0x21, 0x98, 0x35,
+	0xd9, 0x52, 0x72, 0x1c, 0x81, 0xb8, 0x6b, 0xfb, 0x32, 0xc0, 0x04, 0xe0, 0x21, 0xab, 0xdd, 0x7a,
+	0xf5, 0xec, 0x3c, 0x49, 0x91, 0xde, 0x42, 0x3c, 0xef, 0xc7, 0xf0, 0x0a, 0x22, 0x4b, 0x1f, 0x5b,
+	0xaa, 0x3c, 0x1e, 0x22, 0x9c, 0x1f, 0x3e, 0x4d, 0x06, 0x8b, 0xf0, 0xe7, 0x9e, 0xd7, 0xdf, 0x03,
+	0x00, 0x43, 0x71, 0x62, 0x15, 0x61, 0x01, 0x00, 0x00,
 }
@@ -9,6 +9,7 @@ import (
 
 	pb "github.com/juntaki/transparent/transfer/pb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 type receiver struct {
@@ -43,6 +44,9 @@ func (r *receiver) Start() error {
 }
 
 func (r *receiver) Stop() error {
+	if r.grpcServer != nil {
+		r.grpcServer.Stop()
+	}
 	return nil
 }
 
@@ -63,6 +67,9 @@ func (t *server) Request(c context.Context, m *pb.Message) (*pb.Message, error)
 	}
 	res, err := t.callback(decoded)
 	if err != nil {
+		if _, ok := err.(*transparent.KeyNotFoundError); ok {
+			return nil, grpc.Errorf(codes.NotFound, "%s", err)
+		}
 		return nil, err
 	}
 	message, err := t.convertSendMessage(res)
@@ -0,0 +1,14 @@
+package transfer
+
+import (
+	"github.com/juntaki/transparent"
+)
+
+// NewSimpleLayerReplication returns Replication layer, which replicates keys to serverAddrs.
+func NewSimpleLayerReplication(serverAddrs []string, options ...transparent.ReplicationOption) (transparent.Layer, error) {
+	replicas := []transparent.Layer{}
+	for _, addr := range serverAddrs {
+		replicas = append(replicas, NewSimpleLayerTransmitter(addr))
+	}
+	return transparent.NewLayerReplication(replicas, options...)
+}
@@ -0,0 +1,15 @@
+package transfer
+
+import (
+	"github.com/juntaki/transparent"
+)
+
+// NewSimpleLayerShard returns Shard layer, which distributes keys to serverAddrs.
+// Shards are named by their address.
+func NewSimpleLayerShard(serverAddrs ...string) (transparent.Layer, error) {
+	options := []transparent.ShardOption{}
+	for _, addr := range serverAddrs {
+		options = append(options, transparent.WithShard(addr, NewSimpleLayerTransmitter(addr)))
+	}
+	return transparent.NewLayerShard(options...)
+}
@@ -1,9 +1,13 @@
 package transfer
 
 import (
+	"context"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/juntaki/transparent"
+	"github.com/juntaki/transparent/lru"
 	"github.com/juntaki/transparent/test"
 )
 
@@ -16,8 +20,126 @@ func TestTransfer(t *testing.T) {
 	s.Stack(r)
 	s.Start()
 
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	events := s.Watch(ctx, "watch")
+
 	tra := NewSimpleLayerTransmitter(serverAddr)
 
 	test.BasicTransmitterFunc(t, tra)
+
+	stack := transparent.NewStack()
+	stack.Stack(tra)
+	stack.Start()
+	test.TTLStackFunc(t, stack)
+	test.MultiStackFunc(t, stack)
+
+	// Receiver reports operations from another node
+	err := stack.Set("watch", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := false
+	for e := range events {
+		if e.Layer == r {
+			if e.Key != "watch" || e.Message != transparent.MessageSet {
+				t.Error(e)
+			}
+			received = true
+			break
+		}
+	}
+	if !received {
+		t.Error("event from receiver is not received")
+	}
+	stack.Stop()
 	s.Stop()
 }
+
+func TestInvalidation(t *testing.T) {
+	storage := test.NewStorage(0)
+	node := func(addr string, peer string) *transparent.Stack {
+		source, err := transparent.NewLayerSource(storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		invalidation, err := NewSimpleLayerInvalidation(addr, peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache, err := transparent.NewLayerCache(10, lru.NewStorage(10),
+			transparent.WithWritePolicy(transparent.WriteThrough))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := transparent.NewStack()
+		s.Stack(source)
+		s.Stack(invalidation)
+		s.Stack(cache)
+		s.Start()
+		return s
+	}
+	a := node("localhost:8081", "localhost:8082")
+	defer a.Stop()
+	b := node("localhost:8082", "localhost:8081")
+	defer b.Stop()
+
+	a.Set("key", []byte("old"))
+	b.Get("key")
+	a.Set("key", []byte("new"))
+	// The first request may fail until the connection to b is ready
+	for i := 0; ; i++ {
+		value, err := b.Get("key")
+		if err == nil && reflect.DeepEqual(value, []byte("new")) {
+			break
+		}
+		if i == 500 {
+			t.Fatal("invalidation is not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShard(t *testing.T) {
+	addrs := []string{"localhost:8083", "localhost:8084"}
+	for _, addr := range addrs {
+		s := transparent.NewStack()
+		s.Stack(test.NewSource(0))
+		s.Stack(NewSimpleLayerReceiver(addr))
+		s.Start()
+		defer s.Stop()
+	}
+
+	shard, err := NewSimpleLayerShard(addrs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stack := transparent.NewStack()
+	stack.Stack(shard)
+	stack.Start()
+	defer stack.Stop()
+	test.BasicStackFunc(t, stack)
+	test.MultiStackFunc(t, stack)
+}
+
+func TestReplication(t *testing.T) {
+	addrs := []string{"localhost:8085", "localhost:8086", "localhost:8087"}
+	for _, addr := range addrs {
+		s := transparent.NewStack()
+		s.Stack(test.NewSource(0))
+		s.Stack(NewSimpleLayerReceiver(addr))
+		s.Start()
+		defer s.Stop()
+	}
+
+	replication, err := NewSimpleLayerReplication(addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stack := transparent.NewStack()
+	stack.Stack(replication)
+	stack.Start()
+	defer stack.Stop()
+	test.BasicStackFunc(t, stack)
+	test.TTLStackFunc(t, stack)
+}
@@ -3,11 +3,13 @@ package transfer
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/juntaki/transparent"
 	"github.com/juntaki/transparent/simple"
 	pb "github.com/juntaki/transparent/transfer/pb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 type transmitter struct {
@@ -32,11 +34,21 @@ func NewSimpleTransmitter(serverAddr string) transparent.BackendTransmitter {
 }
 
 func (t *transmitter) Request(m *transparent.Message) (*transparent.Message, error) {
+	return t.RequestContext(context.Background(), m)
+}
+
+func (t *transmitter) RequestContext(ctx context.Context, m *transparent.Message) (*transparent.Message, error) {
 	message, err := t.convertSendMessage(m)
 	if err != nil {
 		return nil, err
 	}
-	r, err := t.client.Request(context.Background(), message)
+	r, err := t.client.Request(ctx, message)
+	if err != nil {
+		if grpc.Code(err) == codes.NotFound {
+			return nil, &transparent.KeyNotFoundError{Key: m.Key}
+		}
+		return nil, err
+	}
 	response, err := t.convertReceiveMessage(r)
 	if err != nil {
 		return nil, err
@@ -44,6 +56,18 @@ func (t *transmitter) Request(m *transparent.Message) (*transparent.Message, err
 	return response, nil
 }
 
+// RequestBatch sends operations in a Batch message, and returns the replies of Get
+func (t *transmitter) RequestBatch(ctx context.Context, operations []*transparent.Message) ([]*transparent.Message, error) {
+	response, err := t.RequestContext(ctx, &transparent.Message{
+		Message: transparent.MessageBatch,
+		Batch:   operations,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response.Batch, nil
+}
+
 func (t *transmitter) Start() error {
 	conn, err := grpc.Dial(t.serverAddr, grpc.WithInsecure())
 	t.conn = conn
@@ -83,6 +107,16 @@ func (t *converter) convertSendMessage(m *transparent.Message) (*pb.Message, err
 		}
 		converted.Value = valueBytes
 	}
+	if !m.Expire.IsZero() {
+		converted.Expire = m.Expire.UnixNano()
+	}
+	for _, operation := range m.Batch {
+		c, err := t.convertSendMessage(operation)
+		if err != nil {
+			return nil, err
+		}
+		converted.Batch = append(converted.Batch, c)
+	}
 	switch m.Message {
 	case transparent.MessageSet:
 		converted.MessageType = pb.MessageType_Set
@@ -92,6 +126,10 @@ func (t *converter) convertSendMessage(m *transparent.Message) (*pb.Message, err
 		converted.MessageType = pb.MessageType_Remove
 	case transparent.MessageSync:
 		converted.MessageType = pb.MessageType_Sync
+	case transparent.MessageBatch:
+		converted.MessageType = pb.MessageType_Batch
+	case transparent.MessageInvalidate:
+		converted.MessageType = pb.MessageType_Invalidate
 	default:
 		return nil, errors.New("Unknown type")
 	}
@@ -106,6 +144,16 @@ func (t *converter) convertReceiveMessage(m *pb.Message) (*transparent.Message,
 	var converted transparent.Message
 	converted.Key = m.Key
 	converted.Value = m.Value
+	if m.Expire != 0 {
+		converted.Expire = time.Unix(0, m.Expire)
+	}
+	for _, operation := range m.Batch {
+		c, err := t.convertReceiveMessage(operation)
+		if err != nil {
+			return nil, err
+		}
+		converted.Batch = append(converted.Batch, c)
+	}
 	switch m.MessageType {
 	case pb.MessageType_Set:
 		converted.Message = transparent.MessageSet
@@ -115,6 +163,10 @@ func (t *converter) convertReceiveMessage(m *pb.Message) (*transparent.Message,
 		converted.Message = transparent.MessageRemove
 	case pb.MessageType_Sync:
 		converted.Message = transparent.MessageSync
+	case pb.MessageType_Batch:
+		converted.Message = transparent.MessageBatch
+	case pb.MessageType_Invalidate:
+		converted.Message = transparent.MessageInvalidate
 	default:
 		return nil, errors.New("Unknown type")
 	}
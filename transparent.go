@@ -4,16 +4,26 @@
 // See subpackage for implementation.
 package transparent
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
 // Stack is stacked layer
 type Stack struct {
 	Layer
-	all []Layer
+	all      []Layer
+	hub      *watchHub
+	readMode ReadMode
 }
 
 // NewStack returns Stack
 func NewStack() *Stack {
 	return &Stack{
 		all: []Layer{},
+		hub: newWatchHub(),
 	}
 }
 
@@ -25,6 +35,19 @@ func (s *Stack) Stack(l Layer) error {
 			return err
 		}
 	}
+	if w, ok := l.(watchable); ok {
+		w.setHub(s.hub)
+	}
+	if r, ok := l.(readModer); ok {
+		r.setReadMode(s.readMode)
+	}
+	if e, ok := l.(evictable); ok {
+		for _, below := range s.all {
+			if i, ok := below.(*layerInvalidation); ok {
+				i.above = append(i.above, e)
+			}
+		}
+	}
 	s.Layer = l
 	s.all = append(s.all, l)
 	return nil
@@ -53,11 +76,31 @@ func (s *Stack) Stop() error {
 }
 
 // Layer is stackable function
+// GetMulti doesn't include keys not found in the result.
+// Scan merges keys in the layer and its next layers.
+// Conditional operations are applied to the bottom layer synchronously,
+// and return VersionConflictError if the version is not matched.
+// The Context variants abort the operation when ctx is done.
+// The others are same as calling them with context.Background().
+// Methods added later take ctx as the first argument and have no variant.
 type Layer interface {
 	Set(key interface{}, value interface{}) error
 	Get(key interface{}) (value interface{}, err error)
 	Remove(key interface{}) error
 	Sync() error
+	SetContext(ctx context.Context, key interface{}, value interface{}) error
+	GetContext(ctx context.Context, key interface{}) (value interface{}, err error)
+	RemoveContext(ctx context.Context, key interface{}) error
+	SyncContext(ctx context.Context) error
+	SetWithTTL(ctx context.Context, key interface{}, value interface{}, ttl time.Duration) error
+	GetMulti(ctx context.Context, keys []interface{}) (map[interface{}]interface{}, error)
+	SetMulti(ctx context.Context, values map[interface{}]interface{}) error
+	RemoveMulti(ctx context.Context, keys []interface{}) error
+	Scan(ctx context.Context, r ScanRange) (*ScanPage, error)
+	GetVersion(ctx context.Context, key interface{}) (value interface{}, version string, err error)
+	SetIfAbsent(ctx context.Context, key interface{}, value interface{}) (version string, err error)
+	CompareAndSwap(ctx context.Context, key interface{}, value interface{}, version string) (newVersion string, err error)
+	RemoveIfVersion(ctx context.Context, key interface{}, version string) error
 	setNext(Layer) error
 	start() error
 	stop() error
@@ -72,6 +115,9 @@ const (
 	MessageGet
 	MessageRemove
 	MessageSync
+	MessageBatch       // Operations in Batch
+	MessageInvalidate  // Eviction of the key from cache
+	MessageTransaction // Operations in Batch applied atomically
 )
 
 // Message is layer operation
@@ -80,6 +126,75 @@ type Message struct {
 	Value   interface{}
 	Message MessageType
 	UUID    string
+	Expire  time.Time  // Zero if the key never expires
+	Batch   []*Message // Operations of MessageBatch and MessageTransaction
+	Version string     // Expected version of the operation in MessageTransaction, empty if unconditional
+}
+
+// apply Set or Remove operation to the layer
+// If Set is already expired, the key is removed.
+func apply(ctx context.Context, l Layer, key interface{}, m *Message) error {
+	switch m.Message {
+	case MessageSet:
+		if m.Expire.IsZero() {
+			return l.SetContext(ctx, key, m.Value)
+		}
+		ttl := time.Until(m.Expire)
+		if ttl <= 0 {
+			return l.RemoveContext(ctx, key)
+		}
+		return l.SetWithTTL(ctx, key, m.Value, ttl)
+	case MessageRemove:
+		return l.RemoveContext(ctx, key)
+	}
+	return errors.New("unknown message")
+}
+
+// getEach gets each key from the layer, it is fallback of GetMulti
+func getEach(ctx context.Context, l Layer, keys []interface{}) (map[interface{}]interface{}, error) {
+	values := make(map[interface{}]interface{}, len(keys))
+	for _, key := range keys {
+		value, err := l.GetContext(ctx, key)
+		if err != nil {
+			if _, ok := err.(*KeyNotFoundError); ok {
+				continue
+			}
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// setEach sets each key-value to the layer, it is fallback of SetMulti
+func setEach(ctx context.Context, l Layer, values map[interface{}]interface{}) error {
+	for key, value := range values {
+		err := l.SetContext(ctx, key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeEach removes each key from the layer, it is fallback of RemoveMulti
+func removeEach(ctx context.Context, l Layer, keys []interface{}) error {
+	for _, key := range keys {
+		err := l.RemoveContext(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExpireAt returns expiration time after ttl, ttl must be positive.
+// BackendStorageTTL validates ttl by it.
+func ExpireAt(ttl time.Duration) (time.Time, error) {
+	if ttl <= 0 {
+		return time.Time{}, errors.New("ttl must be positive")
+	}
+	return time.Now().Add(ttl), nil
 }
 
 // KeyNotFoundError means specified key is not found in the layer
@@ -88,3 +203,21 @@ type KeyNotFoundError struct {
 }
 
 func (e *KeyNotFoundError) Error() string { return "requested key is not found" }
+
+// FlushError means buffered operation is failed to apply to the next layer
+type FlushError struct {
+	Key     interface{}
+	Message MessageType
+	Err     error
+}
+
+func (e *FlushError) Error() string {
+	return fmt.Sprintf("failed to flush key %v: %s", e.Key, e.Err)
+}
+
+// FlushErrors is all FlushError since the last Sync
+type FlushErrors []*FlushError
+
+func (e FlushErrors) Error() string {
+	return fmt.Sprintf("%d operations failed to flush, first error: %s", len(e), e[0])
+}
@@ -0,0 +1,138 @@
+package twopc
+
+import (
+	"sync"
+
+	"github.com/juntaki/transparent/internal/logfile"
+	"github.com/pkg/errors"
+)
+
+// Log is durable store of the state of requests.
+// Coodinator and Participant recover in-doubt requests from it after crash.
+type Log interface {
+	// Append stores the record, it must be durable when returned.
+	Append(record *Record) error
+	// Records returns all records in appended order.
+	Records() ([]*Record, error)
+	// Compact removes the records of requests before requestID.
+	Compact(requestID uint64) error
+}
+
+// Record is the state transition of a request
+type Record struct {
+	RequestID uint64
+	State     State
+	Payload   []byte // VoteRequest payload, only for stateWait and stateReady
+	// Participants which may be ready, only for stateCommit of Coodinator.
+	// The commit is kept until they ACK it.
+	Participants []uint64
+}
+
+// memoryLog is Log which doesn't survive the process
+type memoryLog struct {
+	lock    sync.Mutex
+	records []*Record
+}
+
+// NewMemoryLog returns Log in memory.
+// It recovers only Coodinator or Participant restarted in the same process.
+func NewMemoryLog() Log {
+	return &memoryLog{}
+}
+
+func (l *memoryLog) Append(record *Record) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.records = append(l.records, record)
+	return nil
+}
+
+func (l *memoryLog) Records() ([]*Record, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]*Record{}, l.records...), nil
+}
+
+func (l *memoryLog) Compact(requestID uint64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.records = compact(l.records, requestID)
+	return nil
+}
+
+func compact(records []*Record, requestID uint64) []*Record {
+	remain := []*Record{}
+	for _, r := range records {
+		if r.RequestID >= requestID {
+			remain = append(remain, r)
+		}
+	}
+	return remain
+}
+
+// fileLog is append-only file of records.
+// Each record is gob encoded Record in logfile.
+type fileLog struct {
+	lock    sync.Mutex
+	file    *logfile.File
+	records []*Record
+}
+
+// NewFileLog opens the file and reads records left by the last process
+func NewFileLog(filename string) (Log, error) {
+	file, records, err := logfile.Open("2PC log", filename)
+	if err != nil {
+		return nil, err
+	}
+	l := &fileLog{file: file}
+	for _, data := range records {
+		record := &Record{}
+		err = logfile.Decode(data, record)
+		if err != nil {
+			file.Close()
+			return nil, errors.Wrapf(err, "failed to decode 2PC log. filename = %s", filename)
+		}
+		l.records = append(l.records, record)
+	}
+	return l, nil
+}
+
+func (l *fileLog) Append(record *Record) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	data, err := logfile.Encode(record)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode 2PC log")
+	}
+	err = l.file.Append(data)
+	if err != nil {
+		return err
+	}
+	l.records = append(l.records, record)
+	return nil
+}
+
+func (l *fileLog) Records() ([]*Record, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]*Record{}, l.records...), nil
+}
+
+func (l *fileLog) Compact(requestID uint64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	records := compact(l.records, requestID)
+	if len(records) == len(l.records) {
+		return nil
+	}
+	data := make([][]byte, 0, len(records))
+	for _, r := range records {
+		b, err := logfile.Encode(r)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode 2PC log")
+		}
+		data = append(data, b)
+	}
+	l.records = records
+	return l.file.Rewrite(data)
+}
@@ -12,6 +12,8 @@ It has these top-level messages:
 	Message
 	EmptyMessage
 	SetRequest
+	SetResponse
+	ReadIndexResponse
 */
 package twopcpb
 
@@ -45,16 +47,32 @@ const (
 	MessageType_GlobalAbort   MessageType = 4
 	MessageType_GlobalRequest MessageType = 5
 	MessageType_ACK           MessageType = 6
+	// Three phase commit
+	MessageType_CanCommit    MessageType = 7
+	MessageType_PreCommit    MessageType = 8
+	MessageType_PreCommitACK MessageType = 9
+	MessageType_DoCommit     MessageType = 10
+	// Membership
+	MessageType_Heartbeat MessageType = 11
+	MessageType_Join      MessageType = 12
+	MessageType_Leave     MessageType = 13
 )
 
 var MessageType_name = map[int32]string{
-	0: "VoteRequest",
-	1: "VoteCommit",
-	2: "VoteAbort",
-	3: "GlobalCommit",
-	4: "GlobalAbort",
-	5: "GlobalRequest",
-	6: "ACK",
+	0:  "VoteRequest",
+	1:  "VoteCommit",
+	2:  "VoteAbort",
+	3:  "GlobalCommit",
+	4:  "GlobalAbort",
+	5:  "GlobalRequest",
+	6:  "ACK",
+	7:  "CanCommit",
+	8:  "PreCommit",
+	9:  "PreCommitACK",
+	10: "DoCommit",
+	11: "Heartbeat",
+	12: "Join",
+	13: "Leave",
 }
 var MessageType_value = map[string]int32{
 	"VoteRequest":   0,
@@ -64,6 +82,13 @@ var MessageType_value = map[string]int32{
 	"GlobalAbort":   4,
 	"GlobalRequest": 5,
 	"ACK":           6,
+	"CanCommit":     7,
+	"PreCommit":     8,
+	"PreCommitACK":  9,
+	"DoCommit":      10,
+	"Heartbeat":     11,
+	"Join":          12,
+	"Leave":         13,
 }
 
 func (x MessageType) String() string {
@@ -136,10 +161,61 @@ func (m *SetRequest) GetPayload() []byte {
 	return nil
 }
 
+type SetResponse struct {
+	RequestID uint64 `protobuf:"varint,1,opt,name=requestID" json:"requestID,omitempty"`
+	Committed bool   `protobuf:"varint,2,opt,name=committed" json:"committed,omitempty"`
+	// Reason of abort
+	Reason string `protobuf:"bytes,3,opt,name=reason" json:"reason,omitempty"`
+}
+
+func (m *SetResponse) Reset()                    { *m = SetResponse{} }
+func (m *SetResponse) String() string            { return proto.CompactTextString(m) }
+func (*SetResponse) ProtoMessage()               {}
+func (*SetResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+func (m *SetResponse) GetRequestID() uint64 {
+	if m != nil {
+		return m.RequestID
+	}
+	return 0
+}
+
+func (m *SetResponse) GetCommitted() bool {
+	if m != nil {
+		return m.Committed
+	}
+	return false
+}
+
+func (m *SetResponse) GetReason() string {
+	if m != nil {
+		return m.Reason
+	}
+	return ""
+}
+
+type ReadIndexResponse struct {
+	RequestID uint64 `protobuf:"varint,1,opt,name=requestID" json:"requestID,omitempty"`
+}
+
+func (m *ReadIndexResponse) Reset()                    { *m = ReadIndexResponse{} }
+func (m *ReadIndexResponse) String() string            { return proto.CompactTextString(m) }
+func (*ReadIndexResponse) ProtoMessage()               {}
+func (*ReadIndexResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+func (m *ReadIndexResponse) GetRequestID() uint64 {
+	if m != nil {
+		return m.RequestID
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*Message)(nil), "twopcpb.Message")
 	proto.RegisterType((*EmptyMessage)(nil), "twopcpb.EmptyMessage")
 	proto.RegisterType((*SetRequest)(nil), "twopcpb.SetRequest")
+	proto.RegisterType((*SetResponse)(nil), "twopcpb.SetResponse")
+	proto.RegisterType((*ReadIndexResponse)(nil), "twopcpb.ReadIndexResponse")
 	proto.RegisterEnum("twopcpb.MessageType", MessageType_name, MessageType_value)
 }
 
@@ -155,7 +231,8 @@ const _ = grpc.SupportPackageIsVersion4
 
 type ClusterClient interface {
 	Connection(ctx context.Context, opts ...grpc.CallOption) (Cluster_ConnectionClient, error)
-	Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*EmptyMessage, error)
+	Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*SetResponse, error)
+	ReadIndex(ctx context.Context, in *EmptyMessage, opts ...grpc.CallOption) (*ReadIndexResponse, error)
 }
 
 type clusterClient struct {
@@ -197,8 +274,8 @@ func (x *clusterConnectionClient) Recv() (*Message, error) {
 	return m, nil
 }
 
-func (c *clusterClient) Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*EmptyMessage, error) {
-	out := new(EmptyMessage)
+func (c *clusterClient) Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*SetResponse, error) {
+	out := new(SetResponse)
 	err := grpc.Invoke(ctx, "/twopcpb.Cluster/Set", in, out, c.cc, opts...)
 	if err != nil {
 		return nil, err
@@ -206,11 +283,21 @@ func (c *clusterClient) Set(ctx context.Context, in *SetRequest, opts ...grpc.Ca
 	return out, nil
 }
 
+func (c *clusterClient) ReadIndex(ctx context.Context, in *EmptyMessage, opts ...grpc.CallOption) (*ReadIndexResponse, error) {
+	out := new(ReadIndexResponse)
+	err := grpc.Invoke(ctx, "/twopcpb.Cluster/ReadIndex", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Server API for Cluster service
 
 type ClusterServer interface {
 	Connection(Cluster_ConnectionServer) error
-	Set(context.Context, *SetRequest) (*EmptyMessage, error)
+	Set(context.Context, *SetRequest) (*SetResponse, error)
+	ReadIndex(context.Context, *EmptyMessage) (*ReadIndexResponse, error)
 }
 
 func RegisterClusterServer(s *grpc.Server, srv ClusterServer) {
@@ -261,6 +348,24 @@ func _Cluster_Set_Handler(srv interface{}, ctx context.Context, dec func(interfa
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Cluster_ReadIndex_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EmptyMessage)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClusterServer).ReadIndex(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/twopcpb.Cluster/ReadIndex",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClusterServer).ReadIndex(ctx, req.(*EmptyMessage))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _Cluster_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "twopcpb.Cluster",
 	HandlerType: (*ClusterServer)(nil),
@@ -269,6 +374,10 @@ var _Cluster_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Set",
 			Handler:    _Cluster_Set_Handler,
 		},
+		{
+			MethodName: "ReadIndex",
+			Handler:    _Cluster_ReadIndex_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -284,24 +393,32 @@ var _Cluster_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("2pc.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 300 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x64, 0x91, 0xc1, 0x4b, 0x84, 0x40,
-	0x14, 0xc6, 0x77, 0xd6, 0x6d, 0xcd, 0xb7, 0xae, 0x4d, 0xaf, 0x02, 0x91, 0x0e, 0xe2, 0x21, 0xa4,
-	0x83, 0x84, 0x0b, 0x7b, 0x5f, 0x2c, 0x22, 0xa2, 0x8b, 0x1b, 0xdd, 0xd5, 0x86, 0x10, 0xd4, 0x99,
-	0x74, 0xb6, 0x10, 0xfa, 0x37, 0xfa, 0x7f, 0xc3, 0xd5, 0x75, 0x95, 0x8e, 0xdf, 0x6f, 0xbe, 0xef,
-	0xe3, 0xbd, 0x37, 0xa0, 0xf9, 0x22, 0xf1, 0x44, 0xc9, 0x25, 0x47, 0x55, 0x7e, 0x73, 0x91, 0x88,
-	0xd8, 0xf9, 0x25, 0xa0, 0xbe, 0xb0, 0xaa, 0x8a, 0x3e, 0x18, 0x5a, 0x70, 0x1a, 0x64, 0x29, 0x2b,
-	0xe4, 0xd3, 0xbd, 0x49, 0x6c, 0xe2, 0xce, 0xc2, 0x5e, 0xe3, 0x1a, 0x16, 0x79, 0x6b, 0x7b, 0xad,
-	0x05, 0x33, 0xa7, 0x36, 0x71, 0x0d, 0xff, 0xd2, 0xeb, 0x6a, 0xbc, 0xc1, 0x5b, 0x38, 0x34, 0xe2,
-	0x35, 0x68, 0x25, 0xfb, 0xdc, 0xb1, 0xaa, 0x29, 0x55, 0xf6, 0xa5, 0x47, 0x80, 0x26, 0xa8, 0x22,
-	0xaa, 0x33, 0x1e, 0xbd, 0x9b, 0x33, 0x9b, 0xb8, 0x7a, 0x78, 0x90, 0x8e, 0x01, 0xfa, 0x43, 0x2e,
-	0x64, 0xdd, 0xcd, 0xe6, 0xdc, 0x00, 0x6c, 0x99, 0x0c, 0xdb, 0xe4, 0x30, 0x47, 0x46, 0xb9, 0xdb,
-	0x9f, 0xd1, 0x9c, 0x78, 0x06, 0x8b, 0x37, 0x2e, 0x59, 0x97, 0xa3, 0x13, 0x34, 0x00, 0x1a, 0x10,
-	0xf0, 0x3c, 0x4f, 0x25, 0x25, 0xb8, 0x04, 0xad, 0xd1, 0x9b, 0x98, 0x97, 0x92, 0x4e, 0x91, 0x82,
-	0xfe, 0x98, 0xf1, 0x38, 0xca, 0x3a, 0x83, 0xd2, 0x34, 0xb4, 0xa4, 0xb5, 0xcc, 0xf0, 0x1c, 0x96,
-	0x2d, 0x38, 0x94, 0x9e, 0xa0, 0x0a, 0xca, 0x26, 0x78, 0xa6, 0x73, 0xff, 0x0b, 0xd4, 0x20, 0xdb,
-	0x55, 0x92, 0x95, 0xb8, 0x06, 0x08, 0x78, 0x51, 0xb0, 0x44, 0xa6, 0xbc, 0x40, 0xda, 0x5f, 0xaa,
-	0x5b, 0xc8, 0xfa, 0x47, 0x9c, 0x89, 0x4b, 0xee, 0x08, 0xae, 0x40, 0xd9, 0x32, 0x89, 0x17, 0xfd,
-	0xf3, 0x71, 0x6d, 0xeb, 0xaa, 0x87, 0xa3, 0xdb, 0x4c, 0xe2, 0xf9, 0xfe, 0x57, 0x57, 0x7f, 0x01,
-	0x00, 0x00, 0xff, 0xff, 0x8d, 0xb7, 0xb1, 0x2e, 0xe2, 0x01, 0x00, 0x00,
+	// 428 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x53, 0x4d, 0x8f, 0xd3, 0x30,
+	0x10, 0xad, 0xb7, 0xdd, 0x26, 0x9e, 0xa6, 0xc5, 0x3b, 0x2c, 0xa8, 0x8a, 0xf6, 0x50, 0xe5, 0x80,
+	0x2a, 0x0e, 0x15, 0x14, 0x69, 0xcf, 0xac, 0xb2, 0x08, 0x96, 0x0f, 0x09, 0x65, 0x11, 0x77, 0xa7,
+	0x1d, 0xa1, 0x4a, 0xa9, 0x6d, 0x12, 0x2f, 0xd0, 0x1f, 0xc2, 0x6f, 0xe1, 0xdf, 0xf0, 0x5b, 0x90,
+	0x13, 0x37, 0x4d, 0x77, 0x2f, 0x1c, 0xdf, 0x9b, 0x37, 0xef, 0xd9, 0x9e, 0x31, 0xf0, 0xa5, 0x59,
+	0x2d, 0x4c, 0xa9, 0xad, 0xc6, 0xc0, 0xfe, 0xd4, 0x66, 0x65, 0xf2, 0xe4, 0x37, 0x83, 0xe0, 0x13,
+	0x55, 0x95, 0xfc, 0x46, 0x18, 0x43, 0x98, 0x16, 0x1b, 0x52, 0xf6, 0xe6, 0x7a, 0xca, 0x66, 0x6c,
+	0x3e, 0xc8, 0x5a, 0x8c, 0x97, 0x30, 0xda, 0x36, 0xb2, 0x2f, 0x3b, 0x43, 0xd3, 0x93, 0x19, 0x9b,
+	0x4f, 0x96, 0xe7, 0x0b, 0x6f, 0xb3, 0xe8, 0xd4, 0xb2, 0xae, 0x10, 0x2f, 0x80, 0x97, 0xf4, 0xfd,
+	0x8e, 0x2a, 0x67, 0xda, 0xaf, 0x4d, 0x0f, 0x04, 0x4e, 0x21, 0x30, 0x72, 0x57, 0x68, 0xb9, 0x9e,
+	0x0e, 0x66, 0x6c, 0x1e, 0x65, 0x7b, 0x98, 0x4c, 0x20, 0x7a, 0xb3, 0x35, 0x76, 0xe7, 0xcf, 0x96,
+	0x3c, 0x03, 0xb8, 0x25, 0x9b, 0x35, 0x9d, 0xdd, 0x3e, 0x76, 0xdc, 0x27, 0x61, 0x54, 0xeb, 0x2a,
+	0xa3, 0x55, 0x75, 0x2f, 0x9e, 0xdd, 0x8f, 0xbf, 0x00, 0xbe, 0xd2, 0xdb, 0xed, 0xc6, 0x5a, 0x5a,
+	0xd7, 0x57, 0x0a, 0xb3, 0x03, 0x81, 0x4f, 0x61, 0x58, 0x92, 0xac, 0xb4, 0xaa, 0xcf, 0xcd, 0x33,
+	0x8f, 0x92, 0x97, 0x70, 0x96, 0x91, 0x5c, 0xdf, 0xa8, 0x35, 0xfd, 0xfa, 0xbf, 0xa0, 0xe7, 0x7f,
+	0xd9, 0xd1, 0xf3, 0xe1, 0x23, 0x18, 0x7d, 0xd5, 0x96, 0xfc, 0x75, 0x44, 0x0f, 0x27, 0x00, 0x8e,
+	0x48, 0xeb, 0x70, 0xc1, 0x70, 0x0c, 0xdc, 0xe1, 0xab, 0x5c, 0x97, 0x56, 0x9c, 0xa0, 0x80, 0xe8,
+	0x6d, 0xa1, 0x73, 0x59, 0x78, 0x41, 0xdf, 0x39, 0x34, 0x4c, 0x23, 0x19, 0xe0, 0x19, 0x8c, 0x1b,
+	0x62, 0x6f, 0x7a, 0x8a, 0x01, 0xf4, 0xaf, 0xd2, 0x0f, 0x62, 0xe8, 0xdc, 0x52, 0xa9, 0x7c, 0x6f,
+	0xe0, 0xe0, 0xe7, 0x72, 0x9f, 0x15, 0x3a, 0xf3, 0x16, 0x3a, 0x3d, 0xc7, 0x08, 0xc2, 0x6b, 0xed,
+	0xeb, 0xe0, 0xe4, 0xef, 0x48, 0x96, 0x36, 0x27, 0x69, 0xc5, 0x08, 0x43, 0x18, 0xbc, 0xd7, 0x1b,
+	0x25, 0x22, 0xe4, 0x70, 0xfa, 0x91, 0xe4, 0x0f, 0x12, 0xe3, 0xe5, 0x1f, 0x06, 0x41, 0x5a, 0xdc,
+	0x55, 0x96, 0x4a, 0xbc, 0x04, 0x48, 0xb5, 0x52, 0xb4, 0xb2, 0x1b, 0xad, 0x50, 0xb4, 0x3b, 0xe2,
+	0x47, 0x19, 0x3f, 0x60, 0x92, 0xde, 0x9c, 0xbd, 0x60, 0xb8, 0x84, 0xfe, 0x2d, 0x59, 0x7c, 0xdc,
+	0x96, 0x0f, 0x03, 0x8f, 0xcf, 0x8f, 0xc9, 0xe6, 0xd1, 0x93, 0x1e, 0xbe, 0x06, 0xde, 0xce, 0x02,
+	0x9f, 0xb4, 0xa2, 0xee, 0xea, 0xc4, 0x71, 0x4b, 0x3f, 0x18, 0x5b, 0xd2, 0xcb, 0x87, 0xf5, 0x87,
+	0x78, 0xf5, 0x6f, 0x00, 0x10, 0x37, 0xbe, 0x03, 0x1d, 0x03, 0x00, 0x00,
 }
@@ -1,18 +1,22 @@
-//Package twopc is two phase commit implements for key-value store
+// Package twopc is two phase commit implements for key-value store
 package twopc
 
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
 	"fmt"
-	"io"
+	"math/rand"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/context"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 
 	"github.com/juntaki/transparent"
 	pb "github.com/juntaki/transparent/twopc/pb"
@@ -27,14 +31,15 @@ func init() {
 
 func debugPrintln(level int, a ...interface{}) (n int, err error) {
 	if DebugLevel >= level {
-		return fmt.Println(a)
+		return fmt.Println(a...)
 	}
 	return 0, nil
 }
 
-type state int
+// State of a request, which is stored in Log
+type State int
 
-func (s state) String() string {
+func (s State) String() string {
 	switch s {
 	case stateInit:
 		return "Init"
@@ -46,49 +51,256 @@ func (s state) String() string {
 		return "Abort"
 	case stateCommit:
 		return "Commit"
+	case stateEnd:
+		return "End"
+	case statePreCommit:
+		return "PreCommit"
 	}
 	panic("Unknown value")
 }
 
 const (
-	stateInit  state = iota + 1
+	stateInit  State = iota + 1
 	stateWait        // Coodinator only
 	stateReady       // Participant only
 	stateAbort
 	stateCommit
+	stateEnd       // Coodinator only, all ACKs are received
+	statePreCommit // Three phase commit only, commit is decided
 )
 
 type member string
 
+// Option is optional setting of Coodinator and Participant
+type Option func(o *options)
+
+type options struct {
+	log         Log
+	threePhase  bool
+	heartbeat   time.Duration
+	historySize int
+	concurrency int
+	batchSize   int
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		heartbeat:   time.Second,
+		historySize: 1000,
+		concurrency: 1,
+		batchSize:   1,
+	}
+	for _, option := range opts {
+		option(&o)
+	}
+	return o
+}
+
+// WithLog makes the state of requests durable.
+// Restarted Coodinator and Participant with the same Log recover in-doubt requests.
+// Coodinator keeps a commit in Log until all participants asked to vote ACK it, or join after it.
+func WithLog(log Log) Option {
+	return func(o *options) {
+		o.log = log
+	}
+}
+
+// WithThreePhase makes Coodinator use three phase commit, CanCommit / PreCommit / DoCommit.
+// Participant which received PreCommit commits after timeout, even if Coodinator fails.
+// Participant ignores it, it follows the messages from Coodinator.
+func WithThreePhase() Option {
+	return func(o *options) {
+		o.threePhase = true
+	}
+}
+
+// WithHeartbeat sets the interval of heartbeat from Participant, default is 1 second.
+// Coodinator removes the participant silent for 3 intervals from quorum.
+func WithHeartbeat(interval time.Duration) Option {
+	return func(o *options) {
+		o.heartbeat = interval
+	}
+}
+
+// WithHistory sets the number of committed requests kept by Coodinator, default is 1000.
+// Reconnected participant catches up on the requests committed while it was away.
+// Participant away for more requests is rejected, Request returns the error, and it must be restarted with synced data.
+func WithHistory(n int) Option {
+	return func(o *options) {
+		o.historySize = n
+	}
+}
+
+// WithConcurrency sets the number of requests voted at the same time, default is 1.
+// Requests of the same key are not voted at the same time, and all decisions are sent in order.
+// Participant ignores it.
+func WithConcurrency(n int) Option {
+	return func(o *options) {
+		o.concurrency = n
+	}
+}
+
+// WithBatch sets the max number of queued Set and Remove requests voted in a round, default is 1.
+// Batched requests are committed or aborted together.
+// Participant ignores it.
+func WithBatch(n int) Option {
+	return func(o *options) {
+		o.batchSize = n
+	}
+}
+
+// record appends the state to Log if any
+func (o *options) record(requestID uint64, s State, payload []byte) error {
+	return o.append(&Record{RequestID: requestID, State: s, Payload: payload})
+}
+
+// append the record to Log if any
+func (o *options) append(record *Record) error {
+	if o.log == nil {
+		return nil
+	}
+	return o.log.Append(record)
+}
+
+// compact removes the records before requestID from Log if any
+func (o *options) compact(requestID uint64) {
+	if o.log == nil {
+		return
+	}
+	err := o.log.Compact(requestID)
+	if err != nil {
+		debugPrintln(1, "Compact error", err)
+	}
+}
+
 // Coodinator distribute vote request
 type Coodinator struct {
-	lock    sync.RWMutex
-	in      chan *pb.Message
-	out     map[uint64]chan *pb.Message
-	request chan *pb.SetRequest
-	summary map[uint64]*pb.Message
-	ack     map[uint64]*pb.Message
-	timeout time.Duration
-	status  state
-	current uint64
-}
-
-// NewCoodinator returns started Coodinator
-func NewCoodinator(serverAddr string) (*Coodinator, error) {
+	options
+	lock       sync.RWMutex
+	in         chan *pb.Message
+	out        map[uint64]*connection
+	request    chan *proposal
+	rounds     map[uint64]*round          // Requests in progress
+	decisions  map[uint64]State           // Decided requests, which participants may ask
+	unacked    map[uint64]map[uint64]bool // Commits not ACKed by participants which may be ready
+	history    []*pb.Message              // Committed requests, oldest first
+	horizon    uint64                     // Requests before it may be committed, but not in history
+	changed    chan bool                  // Notified when participant is removed
+	progress   chan bool                  // Notified when a round is decided or finished
+	timeout    time.Duration
+	current    uint64 // ID of the next request
+	committed  uint64 // ID of the last committed request
+	grpcServer *grpc.Server
+	done       chan bool
+}
+
+// connection is sender to a participant
+type connection struct {
+	out      chan *pb.Message
+	finish   chan bool
+	kick     chan bool // Closed when the participant is removed
+	kickOnce sync.Once
+	seen     atomic.Int64 // Unix nano of the last message
+}
+
+func (conn *connection) remove() {
+	conn.kickOnce.Do(func() {
+		close(conn.kick)
+	})
+}
+
+// NewCoodinator returns started Coodinator.
+// It resumes in-doubt requests in Log, if WithLog is given.
+func NewCoodinator(serverAddr string, opts ...Option) (*Coodinator, error) {
 	c := &Coodinator{
-		timeout: 1000,
-		in:      make(chan *pb.Message, 1),
-		lock:    sync.RWMutex{},
-		out:     make(map[uint64]chan *pb.Message),
-		request: make(chan *pb.SetRequest, 10),
-		status:  stateInit,
+		timeout:   1000,
+		in:        make(chan *pb.Message, 1),
+		lock:      sync.RWMutex{},
+		out:       make(map[uint64]*connection),
+		request:   make(chan *proposal, 10),
+		rounds:    make(map[uint64]*round),
+		decisions: make(map[uint64]State),
+		unacked:   make(map[uint64]map[uint64]bool),
+		changed:   make(chan bool, 1),
+		progress:  make(chan bool, 1),
+		done:      make(chan bool),
+		options:   newOptions(opts),
 	}
+	err := c.recover()
+	if err != nil {
+		return nil, err
+	}
+	// Next to the recovered requests
+	c.current++
 	started := make(chan error)
 	go c.start(serverAddr, started)
-	err := <-started
+	err = <-started
 	return c, err
 }
 
+// recover reads Log, and decides the requests which were not decided before crash
+func (c *Coodinator) recover() error {
+	if c.log == nil {
+		return nil
+	}
+	records, err := c.log.Records()
+	if err != nil {
+		return err
+	}
+	last := make(map[uint64]*Record)
+	payloads := make(map[uint64][]byte)
+	for i, r := range records {
+		last[r.RequestID] = r
+		if r.RequestID > c.current {
+			c.current = r.RequestID
+		}
+		if r.State == stateWait {
+			payloads[r.RequestID] = r.Payload
+		}
+		if i == 0 || r.RequestID < c.horizon {
+			// Records before it are compacted
+			c.horizon = r.RequestID
+		}
+	}
+	for requestID, r := range last {
+		s := r.State
+		switch s {
+		case stateWait:
+			// Participants may be ready, but no one committed. Presumed abort.
+			err = c.record(requestID, stateAbort, nil)
+			if err != nil {
+				return err
+			}
+			c.decisions[requestID] = stateAbort
+		case stateCommit, stateAbort:
+			// Participants ask the decision
+			c.decisions[requestID] = s
+		}
+		if s == stateCommit && len(r.Participants) > 0 {
+			// Kept until they ACK, or join after it
+			c.unacked[requestID] = make(map[uint64]bool, len(r.Participants))
+			for _, clientID := range r.Participants {
+				c.unacked[requestID][clientID] = true
+			}
+		}
+		if s == stateCommit && requestID > c.committed {
+			c.committed = requestID
+		}
+	}
+	// Commits in Log are caught up from history again
+	ids := []uint64{}
+	for requestID, s := range c.decisions {
+		if s == stateCommit && payloads[requestID] != nil {
+			ids = append(ids, requestID)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, requestID := range ids {
+		c.remember(requestID, payloads[requestID])
+	}
+	return nil
+}
+
 // StartServ Starts cluster coodinator
 func (c *Coodinator) start(address string, started chan error) {
 	lis, err := net.Listen("tcp", address)
@@ -96,12 +308,21 @@ func (c *Coodinator) start(address string, started chan error) {
 		started <- err
 		return
 	}
-	grpcServer := grpc.NewServer()
-	pb.RegisterClusterServer(grpcServer, c)
+	c.grpcServer = grpc.NewServer()
+	pb.RegisterClusterServer(c.grpcServer, c)
 
 	go c.run()
+	go c.dispatch()
+	go c.monitor()
 	started <- nil
-	grpcServer.Serve(lis)
+	c.grpcServer.Serve(lis)
+}
+
+// Stop stops Coodinator.
+// New Coodinator with the same Log resumes in-doubt requests.
+func (c *Coodinator) Stop() {
+	close(c.done)
+	c.grpcServer.Stop()
 }
 
 // SetTimeout change timeout default is 1000 milliseconds
@@ -109,201 +330,909 @@ func (c *Coodinator) SetTimeout(millisecond time.Duration) {
 	c.timeout = millisecond
 }
 
-// Set accepts request from any client
-func (c *Coodinator) Set(ctx context.Context, req *pb.SetRequest) (*pb.EmptyMessage, error) {
-	c.request <- req
-	return &pb.EmptyMessage{}, nil
+// Set accepts request from any client, and returns the decision of it
+func (c *Coodinator) Set(ctx context.Context, req *pb.SetRequest) (*pb.SetResponse, error) {
+	p := &proposal{
+		request: req,
+		result:  make(chan *pb.SetResponse, 1),
+	}
+	select {
+	case c.request <- p:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, errors.New("coodinator is stopped")
+	}
+	select {
+	case res := <-p.result:
+		return res, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, errors.New("coodinator is stopped")
+	}
+}
+
+// ReadIndex returns ID of the last committed request.
+// Participant which finished the requests until it reads the latest value.
+func (c *Coodinator) ReadIndex(ctx context.Context, m *pb.EmptyMessage) (*pb.ReadIndexResponse, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return &pb.ReadIndexResponse{RequestID: c.committed}, nil
 }
 
-// Connection start and keep connection for each client
+// Connection start and keep connection for each client.
+// Participant joins with the clientID of the last connection, or 0 for new one,
+// and catches up on the requests committed since the request ID of Join.
 func (c *Coodinator) Connection(stream pb.Cluster_ConnectionServer) error {
-	// Assign clientID and tell current request ID
-	clientID := uint64(len(c.out))
+	join, err := stream.Recv()
+	if err != nil {
+		debugPrintln(5, err)
+		return err
+	}
+	debugPrintln(5, "Server:Recv", join)
+	if join.MessageType != pb.MessageType_Join {
+		return errors.New("participant must join first")
+	}
+
+	conn := &connection{
+		out:    make(chan *pb.Message, 1),
+		finish: make(chan bool),
+		kick:   make(chan bool),
+	}
+	conn.seen.Store(time.Now().UnixNano())
 	c.lock.Lock()
-	m := &pb.Message{
+	missed, err := c.catchUp(join.RequestID)
+	if err != nil {
+		c.lock.Unlock()
+		debugPrintln(1, err)
+		return err
+	}
+	clientID := join.ClientID
+	if old, ok := c.out[clientID]; ok {
+		// Reconnected before the old connection is detected as dead, leave doesn't delete the new one
+		old.remove()
+		delete(c.out, clientID)
+	}
+	for clientID == 0 || c.out[clientID] != nil {
+		clientID = rand.Uint64()
+	}
+	c.out[clientID] = conn
+	// Participant joined after the commits is not in doubt of them
+	finished := c.joined(join.ClientID, join.RequestID)
+	// Tell clientID and the next request ID after catch up, and the requests being voted
+	messages := append(missed, c.voting()...)
+	messages = append(messages, &pb.Message{
 		ClientID:    clientID,
 		MessageType: pb.MessageType_ACK,
 		RequestID:   c.current,
-	}
-	c.out[clientID] = make(chan *pb.Message, 1)
+	})
 	c.lock.Unlock()
-	debugPrintln(5, "Server:Send", m)
-	if err := stream.Send(m); err != nil {
-		debugPrintln(5, err)
-		return err
+	for _, requestID := range finished {
+		c.end(requestID)
 	}
+	defer c.leave(clientID, conn)
+	defer close(conn.finish)
+
+	// Sender, it keeps receiving until finish not to block broadcast
+	go func() {
+		for _, m := range messages {
+			debugPrintln(5, "Server:Send", m)
+			if err := stream.Send(m); err != nil {
+				debugPrintln(5, err)
+			}
+		}
+		for {
+			select {
+			case m := <-conn.out:
+				debugPrintln(5, "Server:Send", m)
+				if err := stream.Send(m); err != nil {
+					debugPrintln(5, err)
+				}
+			case <-conn.finish:
+				return
+			}
+		}
+	}()
 
 	// Receiver
-	recv := make(chan bool)
-	go func(stream pb.Cluster_ConnectionServer, finish chan bool) {
+	recv := make(chan *pb.Message)
+	go func() {
+		defer close(recv)
 		for {
 			in, err := stream.Recv()
 			debugPrintln(5, "Server:Recv", in)
-			if err == io.EOF {
-				break
-			}
 			if err != nil {
 				debugPrintln(5, err)
-				break
+				return
+			}
+			select {
+			case recv <- in:
+			case <-conn.finish:
+				return
 			}
-			c.in <- in
 		}
-		finish <- true
+	}()
+
+	for {
+		select {
+		case in, ok := <-recv:
+			if !ok {
+				return nil
+			}
+			conn.seen.Store(time.Now().UnixNano())
+			in.ClientID = clientID
+			switch in.MessageType {
+			case pb.MessageType_Heartbeat:
+				// Participant renews its lease by the reply
+				select {
+				case conn.out <- &pb.Message{MessageType: pb.MessageType_Heartbeat, RequestID: in.RequestID}:
+				case <-conn.kick:
+					return nil
+				case <-c.done:
+					return nil
+				}
+			case pb.MessageType_Leave:
+				return nil
+			case pb.MessageType_GlobalRequest:
+				c.answer(in)
+			default:
+				select {
+				case c.in <- in:
+				case <-conn.kick:
+					return nil
+				case <-c.done:
+					return nil
+				}
+			}
+		case <-conn.kick:
+			debugPrintln(5, "Server:Remove", clientID)
+			return nil
+		case <-c.done:
+			return nil
+		}
+	}
+}
+
+// leave removes the participant from quorum
+func (c *Coodinator) leave(clientID uint64, conn *connection) {
+	c.lock.Lock()
+	if c.out[clientID] == conn {
+		delete(c.out, clientID)
+	}
+	c.lock.Unlock()
+	select {
+	case c.changed <- true:
+	default:
+	}
+}
+
+// monitor removes the participants without heartbeat
+func (c *Coodinator) monitor() {
+	ticker := time.NewTicker(c.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			deadline := time.Now().Add(-3 * c.heartbeat).UnixNano()
+			c.lock.RLock()
+			for _, conn := range c.out {
+				if conn.seen.Load() < deadline {
+					conn.remove()
+				}
+			}
+			c.lock.RUnlock()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Members returns clientIDs of connected participants
+func (c *Coodinator) Members() []uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	members := make([]uint64, 0, len(c.out))
+	for clientID := range c.out {
+		members = append(members, clientID)
+	}
+	return members
+}
+
+// catchUp returns the requests committed since requestID, which is the next request of participant.
+// New participant, whose requestID is 0, starts from the current request.
+// It returns error if the requests may be committed, but not in history.
+func (c *Coodinator) catchUp(requestID uint64) ([]*pb.Message, error) {
+	messages := []*pb.Message{}
+	if requestID == 0 || requestID >= c.current {
+		return messages, nil
+	}
+	if requestID < c.horizon {
+		return nil, grpc.Errorf(codes.FailedPrecondition,
+			"history is not enough to catch up from request %d, participant must be resynced", requestID)
+	}
+	for _, m := range c.history {
+		if m.RequestID >= requestID {
+			messages = append(messages, m)
+		}
+	}
+	return messages, nil
+}
+
+// answer the decision to participant, which is ready and waiting for it
+func (c *Coodinator) answer(m *pb.Message) {
+	c.lock.RLock()
+	decision, ok := c.decisions[m.RequestID]
+	var payload []byte
+	for _, h := range c.history {
+		if h.RequestID == m.RequestID {
+			decision, ok, payload = stateCommit, true, h.Payload
+		}
+	}
+	if !ok {
+		if r, active := c.rounds[m.RequestID]; active && r.status == stateWait {
+			// Not decided yet, participant will ask again
+			c.lock.RUnlock()
+			return
+		}
+		// No record of commit. Presumed abort.
+		decision = stateAbort
+	}
+	messageType := pb.MessageType_GlobalAbort
+	if decision == stateCommit {
+		messageType = pb.MessageType_GlobalCommit
+	}
+	conn, ok := c.out[m.ClientID]
+	c.lock.RUnlock()
+	if !ok {
 		return
-	}(stream, recv)
+	}
+	// Payload is attached for participant which voted without quorum
+	c.send(conn, &pb.Message{
+		MessageType: messageType,
+		RequestID:   m.RequestID,
+		Payload:     payload,
+	})
+}
+
+func (c *Coodinator) run() {
+	var last *round
+	var next *proposal // Request which is not batched with the last round
+	for {
+		p := next
+		next = nil
+		if p == nil {
+			select {
+			case p = <-c.request:
+			case <-c.done:
+				return
+			}
+		}
+		proposals := []*proposal{p}
+		written := batchKeys(p.request)
+		if written != nil {
+		batch:
+			for len(proposals) < c.batchSize {
+				select {
+				case more := <-c.request:
+					keys := batchKeys(more.request)
+					if keys == nil || conflict(written, keys) {
+						// Requests of the same key are voted in order
+						next = more
+						break batch
+					}
+					proposals = append(proposals, more)
+					written = append(written, keys...)
+				default:
+					break batch
+				}
+			}
+		}
+		for _, r := range newRounds(proposals) {
+			if !c.acquire(r) {
+				return
+			}
+			voted := c.begin(r)
+			go c.process(r, last, voted)
+			last = r
+		}
+	}
+}
+
+// acquire waits until the round can be voted with the rounds in progress
+func (c *Coodinator) acquire(r *round) bool {
+	for !c.ready(r) {
+		select {
+		case <-c.progress:
+		case <-c.done:
+			return false
+		}
+	}
+	return true
+}
+
+// ready returns true if there is room for the round, and no round of the same keys is being decided
+func (c *Coodinator) ready(r *round) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if len(c.rounds) >= c.concurrency {
+		return false
+	}
+	for _, other := range c.rounds {
+		if !other.isPublished() && conflict(r.keys, other.keys) {
+			return false
+		}
+	}
+	return true
+}
+
+// notify wakes up run waiting for rounds
+func (c *Coodinator) notify() {
+	select {
+	case c.progress <- true:
+	default:
+	}
+}
+
+// begin assigns request ID to the round, and asks participants to vote
+func (c *Coodinator) begin(r *round) (voted bool) {
+	c.lock.Lock()
+	r.requestID = c.current
+	c.current++
+	c.rounds[r.requestID] = r
+	c.lock.Unlock()
+
+	// Request ID must be durable before participants see it
+	err := c.record(r.requestID, stateWait, r.payload)
+	if err != nil {
+		debugPrintln(1, "Log error", err)
+		return false
+	}
+	// Participants joined after this are not asked, they follow the decision
+	c.lock.Lock()
+	conns := c.connections()
+	r.quorum = make(map[uint64]bool, len(conns))
+	for clientID := range conns {
+		r.quorum[clientID] = true
+	}
+	c.lock.Unlock()
+	c.sendAll(conns, c.voteMessage(r))
+	return true
+}
+
+// process decides the round after voting, and waits for ACKs
+func (c *Coodinator) process(r *round, prev *round, voted bool) {
+	commit, reason := false, "failed to log request"
+	if voted {
+		commit, reason = c.waitVotes(r)
+	}
+	// Decisions are sent in the order of request ID, so that participants commit in the same order
+	if prev != nil {
+		select {
+		case <-prev.published:
+		case <-c.done:
+			return
+		}
+	}
+	debugPrintln(1, "ServerStatus:", r.requestID, commit)
+	if commit {
+		commit = c.globalcommit(r)
+		if !commit {
+			reason = "failed to log decision"
+		}
+	} else {
+		c.globalAbort(r)
+	}
+	close(r.published)
+	c.notify()
+	r.reply(commit, reason)
+	acked := c.wait(r, pb.MessageType_ACK)
+	c.lock.Lock()
+	delete(c.rounds, r.requestID)
+	if commit {
+		// Removed participants may be ready, the commit is kept until they ACK
+		for clientID := range r.responses[pb.MessageType_ACK] {
+			delete(c.unacked[r.requestID], clientID)
+		}
+		acked = len(c.unacked[r.requestID]) == 0
+		if acked {
+			delete(c.unacked, r.requestID)
+		}
+	}
+	c.lock.Unlock()
+	if acked {
+		c.end(r.requestID)
+	}
+	c.notify()
+}
+
+// voteMessage returns VoteRequest of the round
+func (c *Coodinator) voteMessage(r *round) *pb.Message {
+	message := &pb.Message{
+		MessageType: pb.MessageType_VoteRequest,
+		RequestID:   r.requestID,
+		Payload:     r.payload,
+	}
+	if c.threePhase {
+		message.MessageType = pb.MessageType_CanCommit
+	}
+	return message
+}
+
+// voting returns VoteRequests of the rounds whose decision is not sent yet.
+// Participant joined while voting follows the decision.
+func (c *Coodinator) voting() []*pb.Message {
+	ids := []uint64{}
+	for requestID, r := range c.rounds {
+		if r.quorum != nil && !r.isPublished() {
+			ids = append(ids, requestID)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	messages := []*pb.Message{}
+	for _, requestID := range ids {
+		messages = append(messages, c.voteMessage(c.rounds[requestID]))
+	}
+	return messages
+}
+
+// dispatch passes the responses of participants to the rounds
+func (c *Coodinator) dispatch() {
+	for {
+		select {
+		case m := <-c.in:
+			c.lock.Lock()
+			r, ok := c.rounds[m.RequestID]
+			if ok {
+				if r.responses[m.MessageType] == nil {
+					r.responses[m.MessageType] = make(map[uint64]*pb.Message)
+				}
+				r.responses[m.MessageType][m.ClientID] = m
+			}
+			finished := !ok && m.MessageType == pb.MessageType_ACK && c.acknowledge(m.RequestID, m.ClientID)
+			c.lock.Unlock()
+			if ok {
+				r.notify()
+			}
+			if finished {
+				c.end(m.RequestID)
+			}
+		case <-c.changed:
+			c.lock.RLock()
+			for _, r := range c.rounds {
+				r.notify()
+			}
+			c.lock.RUnlock()
+		case <-c.done:
+			return
+		}
+	}
+}
 
-	// Sender
-	send := make(chan bool)
-	go func(stream pb.Cluster_ConnectionServer, clientID uint64, finish chan bool) {
+// complete returns true if all participants in quorum responded by any of the types, except removed ones
+func (c *Coodinator) complete(r *round, types []pb.MessageType) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for clientID := range r.quorum {
+		if _, ok := c.out[clientID]; !ok {
+			continue
+		}
+		responded := false
+		for _, t := range types {
+			if r.responses[t][clientID] != nil {
+				responded = true
+			}
+		}
+		if !responded {
+			return false
+		}
+	}
+	return true
+}
+
+// wait waits for the response of the types from all participants in quorum
+func (c *Coodinator) wait(r *round, types ...pb.MessageType) (ok bool) {
+	timeout := time.After(time.Millisecond * c.timeout)
+	for !c.complete(r, types) {
+		select {
+		case <-r.changed:
+		case <-timeout:
+			debugPrintln(5, "Server:Timeout", r.requestID, types)
+			return false
+		}
+	}
+	return true
+}
+
+// waitVotes waits for the votes, and returns true if all participants in quorum vote commit.
+// Otherwise, the reason of abort is returned.
+func (c *Coodinator) waitVotes(r *round) (commit bool, reason string) {
+	if !c.wait(r, pb.MessageType_VoteCommit, pb.MessageType_VoteAbort) {
+		return false, "timeout waiting for votes"
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for clientID, m := range r.responses[pb.MessageType_VoteAbort] {
+		if r.quorum[clientID] {
+			debugPrintln(5, "Server:Get VoteAbort")
+			return false, fmt.Sprintf("participant %d voted abort: %s", clientID, m.Payload)
+		}
+	}
+	return true, ""
+}
+
+func (c *Coodinator) setStatus(r *round, s State) {
+	c.lock.Lock()
+	r.status = s
+	c.lock.Unlock()
+}
+
+func (c *Coodinator) send(conn *connection, m *pb.Message) {
+	select {
+	case conn.out <- m:
+	case <-conn.finish:
+	}
+}
+
+// broadcast sends the message to all participants
+func (c *Coodinator) broadcast(m *pb.Message) {
+	c.lock.RLock()
+	conns := c.connections()
+	c.lock.RUnlock()
+	c.sendAll(conns, m)
+}
+
+// connections returns the connections of participants, it is called with lock
+func (c *Coodinator) connections() map[uint64]*connection {
+	conns := make(map[uint64]*connection, len(c.out))
+	for clientID, conn := range c.out {
+		conns[clientID] = conn
+	}
+	return conns
+}
+
+// sendAll sends the message to the connections.
+// It is called without lock, because slow participant blocks until its sender catches up.
+func (c *Coodinator) sendAll(conns map[uint64]*connection, m *pb.Message) {
+	for _, conn := range conns {
+		c.send(conn, m)
+	}
+}
+
+// decide logs and keeps the decision, participants may ask it later.
+// Commit which is not logged is aborted.
+// Committed payload is kept in history for catch up.
+func (c *Coodinator) decide(r *round, decision State) State {
+	record := &Record{RequestID: r.requestID, State: decision}
+	var voters map[uint64]bool
+	if decision == stateCommit {
+		// Participants which may be ready, including the ones whose vote is lost
 		c.lock.RLock()
-		sendChannel := c.out[clientID]
-		c.lock.RUnlock()
-		for {
-			m := <-sendChannel
-			debugPrintln(5, "Server:Send", m)
-			if err := stream.Send(m); err != nil {
-				debugPrintln(5, err)
-				break
+		voters = make(map[uint64]bool, len(r.quorum))
+		for clientID := range r.quorum {
+			if r.responses[pb.MessageType_VoteAbort][clientID] == nil {
+				voters[clientID] = true
+				record.Participants = append(record.Participants, clientID)
 			}
 		}
-		finish <- true
-		return
-	}(stream, clientID, send)
+		c.lock.RUnlock()
+	}
+	err := c.append(record)
+	if err != nil {
+		debugPrintln(1, "Log error", err)
+		decision = stateAbort
+	}
+	c.lock.Lock()
+	r.status = decision
+	c.decisions[r.requestID] = decision
+	if decision == stateCommit {
+		c.committed = r.requestID
+		c.unacked[r.requestID] = voters
+	}
+	if decision == stateCommit {
+		c.remember(r.requestID, r.payload)
+	}
+	c.lock.Unlock()
+	return decision
+}
 
-	<-recv
-	<-send
-	return nil
+// remember keeps the commit in history with lock, requests before dropped one can't be caught up
+func (c *Coodinator) remember(requestID uint64, payload []byte) {
+	c.history = append(c.history, &pb.Message{
+		MessageType: pb.MessageType_GlobalCommit,
+		RequestID:   requestID,
+		Payload:     payload,
+	})
+	if len(c.history) > c.historySize {
+		dropped := c.history[len(c.history)-c.historySize-1]
+		c.history = c.history[len(c.history)-c.historySize:]
+		if dropped.RequestID >= c.horizon {
+			c.horizon = dropped.RequestID + 1
+		}
+	}
+}
+
+// globalcommit decides commit, and tells it to participants.
+// In three phase commit, PreCommit is acknowledged before DoCommit.
+// Payload is attached for participants which missed VoteRequest.
+// It returns false if the commit is not logged, and aborted.
+func (c *Coodinator) globalcommit(r *round) bool {
+	if c.decide(r, stateCommit) != stateCommit {
+		c.broadcast(&pb.Message{
+			MessageType: pb.MessageType_GlobalAbort,
+			RequestID:   r.requestID,
+		})
+		return false
+	}
+	messageType := pb.MessageType_GlobalCommit
+	if c.threePhase {
+		c.setStatus(r, statePreCommit)
+		c.broadcast(&pb.Message{
+			MessageType: pb.MessageType_PreCommit,
+			RequestID:   r.requestID,
+		})
+		// Commit is already decided, participant without ACK asks it later
+		c.wait(r, pb.MessageType_PreCommitACK)
+		c.setStatus(r, stateCommit)
+		messageType = pb.MessageType_DoCommit
+	}
+	m := &pb.Message{
+		MessageType: messageType,
+		RequestID:   r.requestID,
+		Payload:     r.payload,
+	}
+	c.broadcast(m)
+	return true
+}
+
+func (c *Coodinator) globalAbort(r *round) {
+	m := &pb.Message{
+		MessageType: pb.MessageType_GlobalAbort,
+		RequestID:   r.requestID,
+	}
+	c.decide(r, stateAbort)
+	c.broadcast(m)
+}
+
+// acknowledge removes the participant from the commit not ACKed, with lock.
+// It returns true if all participants ACKed the commit.
+func (c *Coodinator) acknowledge(requestID uint64, clientID uint64) bool {
+	pending, ok := c.unacked[requestID]
+	if !ok || !pending[clientID] {
+		return false
+	}
+	delete(pending, clientID)
+	if len(pending) > 0 {
+		return false
+	}
+	delete(c.unacked, requestID)
+	return true
 }
 
-func (c *Coodinator) run() {
-	for {
-		c.initialize()
-		debugPrintln(1, "ServerStatus:", c.status)
-		select {
-		case r := <-c.request:
-			commit := c.voteRequest(r)
-			debugPrintln(1, "ServerStatus:", c.status)
-			if commit {
-				c.globalcommit()
-			} else {
-				c.globalAbort()
-			}
-			debugPrintln(1, "ServerStatus:", c.status)
-			c.waitsendACK()
+// joined acknowledges the commits before requestID, which is the oldest request not finished by the participant.
+// It returns the commits ACKed by all participants.
+func (c *Coodinator) joined(clientID uint64, requestID uint64) []uint64 {
+	finished := []uint64{}
+	for id := range c.unacked {
+		if id < requestID && c.acknowledge(id, clientID) {
+			finished = append(finished, id)
 		}
 	}
+	return finished
 }
 
-func (c *Coodinator) initialize() {
+// end forgets the decision after all participants ACK.
+// Decisions older than the rounds in progress and the commits not ACKed are also forgotten, connected participants
+// have no in-doubt request before them, and commits are still answered from history.
+func (c *Coodinator) end(requestID uint64) {
+	err := c.record(requestID, stateEnd, nil)
+	if err != nil {
+		debugPrintln(1, "Log error", err)
+		return
+	}
 	c.lock.Lock()
-	c.status = stateInit
-	c.summary = make(map[uint64]*pb.Message)
-	c.ack = make(map[uint64]*pb.Message)
-	c.current++
+	oldest := requestID
+	for id := range c.rounds {
+		if id < oldest {
+			oldest = id
+		}
+	}
+	for id := range c.unacked {
+		if id < oldest {
+			oldest = id
+		}
+	}
+	for id := range c.decisions {
+		if id < oldest || id == requestID {
+			delete(c.decisions, id)
+		}
+	}
 	c.lock.Unlock()
+	// Keep the rounds in progress, and the last request to recover current request ID
+	c.compact(oldest)
 }
 
-func (c *Coodinator) broadcast(m *pb.Message) {
-	for _, channel := range c.out {
-		channel <- m
+// round is a request in progress.
+// Rounds of different keys are voted at the same time, and decided in the order of request ID.
+type round struct {
+	requestID uint64
+	payload   []byte
+	proposals []*proposal // Requests of clients, which are replied the decision
+	keys      []string    // Keys written by the request, nil if it conflicts with any request
+	status    State
+	quorum    map[uint64]bool                           // Participants asked to vote
+	responses map[pb.MessageType]map[uint64]*pb.Message // Responses of clients by the type
+	changed   chan bool                                 // Notified when response is received, or participant is removed
+	published chan bool                                 // Closed when the decision is sent to participants
+}
+
+// proposal is a request from client, waiting for the decision
+type proposal struct {
+	request *pb.SetRequest
+	result  chan *pb.SetResponse
+}
+
+func newRound(payload []byte, proposals ...*proposal) *round {
+	return &round{
+		payload:   payload,
+		proposals: proposals,
+		status:    stateWait,
+		responses: make(map[pb.MessageType]map[uint64]*pb.Message),
+		changed:   make(chan bool, 1),
+		published: make(chan bool),
 	}
 }
 
-func (c *Coodinator) globalcommit() {
-	m := &pb.Message{
-		MessageType: pb.MessageType_GlobalCommit,
-		RequestID:   c.current,
+// newRounds returns the rounds of requests.
+// Batched requests are sent as a MessageBatch in a round, and applied in order.
+func newRounds(proposals []*proposal) []*round {
+	operations := []*transparent.Message{}
+	for _, p := range proposals {
+		operation, err := decode(p.request.Payload)
+		if err != nil {
+			// Unknown request is ordered with all requests
+			operation = nil
+		}
+		operations = append(operations, operation)
 	}
-	c.status = stateCommit
-	c.broadcast(m)
+	if len(proposals) > 1 {
+		batch := &transparent.Message{
+			Message: transparent.MessageBatch,
+			Batch:   operations,
+		}
+		req, err := encode(batch)
+		if err == nil {
+			r := newRound(req.Payload, proposals...)
+			r.keys = keys(batch)
+			return []*round{r}
+		}
+		debugPrintln(1, "Encode error", err)
+	}
+	rounds := []*round{}
+	for i, p := range proposals {
+		r := newRound(p.request.Payload, p)
+		if operations[i] != nil {
+			r.keys = keys(operations[i])
+		}
+		rounds = append(rounds, r)
+	}
+	return rounds
 }
 
-func (c *Coodinator) globalAbort() {
-	m := &pb.Message{
-		MessageType: pb.MessageType_GlobalAbort,
-		RequestID:   c.current,
+func (r *round) notify() {
+	select {
+	case r.changed <- true:
+	default:
 	}
-	c.status = stateAbort
-	c.broadcast(m)
 }
 
-func (c *Coodinator) waitsendACK() (ok bool) {
-	ok = true
-	for {
-		select {
-		case v := <-c.in:
-			if v.MessageType != pb.MessageType_ACK &&
-				v.RequestID != c.current {
-				break
-			}
-			c.ack[v.ClientID] = v
-			debugPrintln(5, "ack total", len(c.out), "current", len(c.ack))
-			if len(c.out) == len(c.ack) {
-				return
-			}
-		case <-time.After(time.Millisecond * c.timeout):
-			debugPrintln(5, "Timeout")
-			ok = false
-			return
+// reply tells the decision to the clients of the round
+func (r *round) reply(committed bool, reason string) {
+	for _, p := range r.proposals {
+		p.result <- &pb.SetResponse{
+			RequestID: r.requestID,
+			Committed: committed,
+			Reason:    reason,
 		}
 	}
 }
 
-func (c *Coodinator) voteRequest(r *pb.SetRequest) (commit bool) {
-	c.status = stateWait
+func (r *round) isPublished() bool {
+	select {
+	case <-r.published:
+		return true
+	default:
+		return false
+	}
+}
 
-	message := &pb.Message{
-		MessageType: pb.MessageType_VoteRequest,
-		RequestID:   c.current,
-		Payload:     r.Payload,
+// keys returns the keys written by the operation, or nil if unknown
+func keys(operation *transparent.Message) []string {
+	switch operation.Message {
+	case transparent.MessageSet, transparent.MessageRemove:
+		return []string{fmt.Sprint(operation.Key)}
+	case transparent.MessageTransaction, transparent.MessageBatch:
+		keys := []string{}
+		for _, op := range operation.Batch {
+			keys = append(keys, fmt.Sprint(op.Key))
+		}
+		return keys
 	}
-	c.broadcast(message)
-	commit = true
-	for {
-		select {
-		case v := <-c.in:
-			if v.MessageType != pb.MessageType_VoteCommit &&
-				v.MessageType != pb.MessageType_VoteAbort &&
-				v.RequestID != c.current {
-				break
-			} else if v.MessageType == pb.MessageType_VoteAbort {
-				debugPrintln(5, "Server:Get VoteAbort")
-				commit = false
-			}
-			c.summary[v.ClientID] = v
-			debugPrintln(5, "vote total", len(c.out), "current", len(c.summary))
-			if len(c.out) == len(c.summary) {
-				return
-			}
-		case <-time.After(time.Millisecond * c.timeout):
-			debugPrintln(5, "Server:Timeout")
-			commit = false
-			return
+	return nil
+}
+
+// conflict returns true if the requests write the same key
+func conflict(a, b []string) bool {
+	if a == nil || b == nil {
+		return true
+	}
+	written := make(map[string]bool, len(a))
+	for _, key := range a {
+		written[key] = true
+	}
+	for _, key := range b {
+		if written[key] {
+			return true
 		}
 	}
+	return false
+}
+
+// batchKeys returns the keys of the request, or nil if it can't be sent with other requests in a round.
+// Only Set and Remove are batched, failure of others must not abort others.
+func batchKeys(req *pb.SetRequest) []string {
+	operation, err := decode(req.Payload)
+	if err != nil {
+		return nil
+	}
+	if operation.Message != transparent.MessageSet && operation.Message != transparent.MessageRemove {
+		return nil
+	}
+	return keys(operation)
 }
 
-// NewParticipant returns started Participant
-func NewParticipant(serverAddr string) *Participant {
+// NewParticipant returns Participant.
+// It asks the outcome of in-doubt request in Log after Start, if WithLog is given.
+func NewParticipant(serverAddr string, opts ...Option) *Participant {
 	p := &Participant{
 		timeout:    1000, //millisecond
 		serverAddr: serverAddr,
+		options:    newOptions(opts),
 	}
 	return p
 }
 
 // Participant manage its resource
 type Participant struct {
-	in             chan *pb.Message
-	out            chan *pb.Message
-	timeout        time.Duration
-	status         state
-	current        uint64
-	clientID       uint64
-	currentRequest *pb.Message
-	client         pb.ClusterClient
-	committer      func(m *transparent.Message) (*transparent.Message, error)
-	serverAddr     string
+	options
+	lock          sync.Mutex
+	in            chan *pb.Message
+	out           chan *pb.Message
+	done          chan bool
+	timeout       time.Duration
+	current       uint64              // ID of the next request
+	requests      map[uint64]*request // Requests voted, and not finished
+	clientID      uint64
+	joinClientID  uint64    // Copy of clientID for Join, updated by mainLoop
+	joinRequestID uint64    // Copy of the oldest request not finished for Join and read, updated by mainLoop
+	readRequestID uint64    // Copy of current for ReadLease, updated by mainLoop
+	saved         chan bool // Closed and replaced when the copies are updated
+	joined        bool      // ACK of Join is processed, false while disconnected
+	lease         time.Time // Participant votes every request until lease, see ReadLease
+	ping          uint64    // Sequence of the last heartbeat
+	pinged        time.Time // When the last heartbeat is sent
+	client        pb.ClusterClient
+	err           error // Coodinator can't catch up the participant, it must be resynced
+	committer     func(m *transparent.Message) (*transparent.Message, error)
+	preparer      func(m *transparent.Message) error
+	aborter       func(m *transparent.Message)
+	serverAddr    string
+}
+
+// request is voted by Participant, and waiting for the decision
+type request struct {
+	status  State
+	message *pb.Message // VoteRequest
 }
 
 // SetTimeout change timeout default is 1000 milliseconds
@@ -311,90 +1240,235 @@ func (a *Participant) SetTimeout(millisecond time.Duration) {
 	a.timeout = millisecond
 }
 
-// start start participant service
-func (a *Participant) start(serverAddr string, started chan error) {
-	conn, err := grpc.Dial(serverAddr, grpc.WithInsecure())
+// recover reads Log, and restores the requests which are ready
+func (a *Participant) recover() error {
+	a.requests = make(map[uint64]*request)
+	if a.log == nil {
+		return nil
+	}
+	records, err := a.log.Records()
 	if err != nil {
-		started <- err
-		return
+		return err
+	}
+	for _, r := range records {
+		if r.RequestID >= a.current {
+			a.current = r.RequestID + 1
+		}
+		switch r.State {
+		case stateReady:
+			a.requests[r.RequestID] = &request{
+				status: stateReady,
+				message: &pb.Message{
+					MessageType: pb.MessageType_VoteRequest,
+					RequestID:   r.RequestID,
+					Payload:     r.Payload,
+				},
+			}
+		case statePreCommit:
+			if req, ok := a.requests[r.RequestID]; ok {
+				req.status = statePreCommit
+			}
+		default:
+			// The request is finished
+			delete(a.requests, r.RequestID)
+		}
+	}
+	return nil
+}
+
+// save copies the state for Join
+func (a *Participant) save() {
+	a.lock.Lock()
+	a.joinClientID = a.clientID
+	a.joinRequestID = a.oldest()
+	a.readRequestID = a.current
+	close(a.saved)
+	a.saved = make(chan bool)
+	a.lock.Unlock()
+}
+
+// oldest returns ID of the oldest request not finished
+func (a *Participant) oldest() uint64 {
+	oldest := a.current
+	for requestID := range a.requests {
+		if requestID < oldest {
+			oldest = requestID
+		}
+	}
+	return oldest
+}
+
+// ids returns IDs of the requests not finished in order
+func (a *Participant) ids() []uint64 {
+	ids := make([]uint64, 0, len(a.requests))
+	for requestID := range a.requests {
+		ids = append(ids, requestID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// run keeps connection to Coodinator, it reconnects when the connection is lost.
+// The result of the first connection is sent to started.
+func (a *Participant) run(started chan error) {
+	for {
+		err := a.connect(func() {
+			if started != nil {
+				started <- nil
+				started = nil
+			}
+		})
+		if started != nil {
+			started <- err
+			return
+		}
+		debugPrintln(5, "Client:Disconnected", err)
+		if grpc.Code(err) == codes.FailedPrecondition {
+			// Requests are missed, reconnection never catches up
+			a.lock.Lock()
+			a.err = err
+			a.lock.Unlock()
+			return
+		}
+		select {
+		case <-a.done:
+			return
+		case <-time.After(time.Millisecond * a.timeout):
+		}
+	}
+}
+
+// connect to Coodinator, and relay messages until the connection is lost
+func (a *Participant) connect(connected func()) error {
+	conn, err := grpc.Dial(a.serverAddr, grpc.WithInsecure())
+	if err != nil {
+		return err
 	}
 	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	client := pb.NewClusterClient(conn)
-	a.client = client
-	stream, err := client.Connection(context.Background())
+	stream, err := client.Connection(ctx)
 	if err != nil {
-		started <- err
-		return
+		return err
 	}
 
-	// Get ID from server
-	in, err := stream.Recv()
-	debugPrintln(5, "Client:Recv", a.clientID, in)
-	if err == io.EOF {
-		started <- err
-		return
+	// Join with the same clientID, and catch up from the current request
+	a.lock.Lock()
+	join := &pb.Message{
+		MessageType: pb.MessageType_Join,
+		ClientID:    a.joinClientID,
+		RequestID:   a.joinRequestID,
 	}
+	a.lock.Unlock()
+	debugPrintln(5, "Client:Send", join)
+	err = stream.Send(join)
 	if err != nil {
-		started <- err
-		return
-	}
-	if in.MessageType != pb.MessageType_ACK {
-		started <- err
-		return
+		return err
 	}
-	a.current = in.RequestID
-	a.clientID = in.ClientID
-
-	a.in = make(chan *pb.Message, 1)
-	a.out = make(chan *pb.Message, 1)
 
-	// Receiver
-	recv := make(chan bool)
-	go func(stream pb.Cluster_ConnectionClient, finish chan bool) {
+	// Sender, it leaves from Coodinator when stopped
+	go func() {
+		defer cancel()
+		ticker := time.NewTicker(a.heartbeat)
+		defer ticker.Stop()
 		for {
-			in, err := stream.Recv()
-			debugPrintln(5, "Client:Recv", a.clientID, in)
-			if err == io.EOF {
-				started <- err
+			var m *pb.Message
+			select {
+			case m = <-a.out:
+			case <-ticker.C:
+				m = a.heartbeatMessage()
+			case <-a.done:
+				stream.Send(&pb.Message{MessageType: pb.MessageType_Leave})
+				stream.CloseSend()
+				// Wait for Coodinator to close the stream
+				select {
+				case <-ctx.Done():
+				case <-time.After(a.heartbeat):
+				}
 				return
-			}
-			if err != nil {
-				started <- err
+			case <-ctx.Done():
 				return
 			}
-			a.in <- in
-		}
-	}(stream, recv)
-
-	// Sender
-	send := make(chan bool)
-	go func(stream pb.Cluster_ConnectionClient, finish chan bool) {
-		for {
-			m := <-a.out
-			debugPrintln(5, "Client:Send", a.clientID, m)
+			debugPrintln(5, "Client:Send", m)
 			if err := stream.Send(m); err != nil {
-				break
+				debugPrintln(5, err)
 			}
 		}
-		finish <- true
-		return
-	}(stream, recv)
-
-	go a.mainLoop()
+	}()
 
-	started <- nil
-	<-recv
-	<-send
-	stream.CloseSend()
+	// Receiver, messages before ACK are catch up
+	joined := false
+	for {
+		in, err := stream.Recv()
+		debugPrintln(5, "Client:Recv", in)
+		if err != nil {
+			return err
+		}
+		if in.MessageType == pb.MessageType_Heartbeat {
+			a.renew(in.RequestID)
+			continue
+		}
+		select {
+		case a.in <- in:
+		case <-a.done:
+			return nil
+		}
+		if !joined && in.MessageType == pb.MessageType_ACK {
+			joined = true
+			a.lock.Lock()
+			a.client = client
+			a.lock.Unlock()
+			defer func() {
+				a.lock.Lock()
+				a.client = nil
+				a.joined = false
+				a.lease = time.Time{}
+				a.lock.Unlock()
+			}()
+			connected()
+		}
+	}
 }
 
+// Start connects to Coodinator
 func (a *Participant) Start() error {
+	a.in = make(chan *pb.Message, 1)
+	a.out = make(chan *pb.Message, 1)
+	a.done = make(chan bool)
+	a.saved = make(chan bool)
+	err := a.recover()
+	if err != nil {
+		return err
+	}
+	for _, requestID := range a.ids() {
+		// Hold the resources again until the decision
+		err = a.prepare(a.requests[requestID].message)
+		if err != nil {
+			debugPrintln(1, "Prepare error", err)
+		}
+	}
+	a.save()
+	go a.mainLoop()
+
 	started := make(chan error)
-	go a.start(a.serverAddr, started)
-	err := <-started
+	go a.run(started)
+	err = <-started
+	if err != nil {
+		a.Stop()
+	}
 	return err
 }
+
+// Stop leaves from Coodinator, it is removed from quorum immediately
 func (a *Participant) Stop() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	select {
+	case <-a.done:
+	default:
+		close(a.done)
+	}
 	return nil
 }
 
@@ -403,19 +1477,136 @@ func (a *Participant) SetCallback(committer func(m *transparent.Message) (*trans
 	return nil
 }
 
+// SetPrepareCallback sets the function to validate the request before vote.
+// If it returns error, the participant votes abort.
+func (a *Participant) SetPrepareCallback(preparer func(m *transparent.Message) error) error {
+	a.preparer = preparer
+	return nil
+}
+
+// SetAbortCallback sets the function to release the resources held by prepare callback.
+// It is called when the request is aborted after the participant voted commit.
+func (a *Participant) SetAbortCallback(aborter func(m *transparent.Message)) error {
+	a.aborter = aborter
+	return nil
+}
+
+// ReadIndex waits until the requests committed before it are finished by this participant.
+// Reading the next layer after it returns the latest value.
+func (a *Participant) ReadIndex(ctx context.Context) error {
+	a.lock.Lock()
+	client, err := a.client, a.err
+	a.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if client == nil {
+		return errors.New("not connected to coodinator")
+	}
+	res, err := client.ReadIndex(ctx, &pb.EmptyMessage{})
+	if err != nil {
+		return err
+	}
+	return a.waitFinished(ctx, res.RequestID+1)
+}
+
+// ReadLease is ReadIndex without asking Coodinator while the lease is valid.
+// Coodinator removes participant after 3 heartbeats without message, so the participant
+// whose heartbeat is replied votes every request for a heartbeat since it is sent.
+// It waits for the requests already voted.
+// Like lease of Raft, it assumes that delay of messages is shorter than heartbeats.
+func (a *Participant) ReadLease(ctx context.Context) error {
+	a.lock.Lock()
+	valid := time.Now().Before(a.lease)
+	current := a.readRequestID
+	a.lock.Unlock()
+	if !valid {
+		return a.ReadIndex(ctx)
+	}
+	return a.waitFinished(ctx, current)
+}
+
+// heartbeatMessage returns the next heartbeat, Coodinator replies it with the same sequence
+func (a *Participant) heartbeatMessage() *pb.Message {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.ping++
+	a.pinged = time.Now()
+	return &pb.Message{MessageType: pb.MessageType_Heartbeat, RequestID: a.ping}
+}
+
+// renew extends the lease when Coodinator replies the last heartbeat.
+// Coodinator received it after it is sent, so the lease starts from the time sent.
+func (a *Participant) renew(ping uint64) {
+	a.lock.Lock()
+	if a.joined && ping == a.ping {
+		a.lease = a.pinged.Add(a.heartbeat)
+	}
+	a.lock.Unlock()
+}
+
+// waitFinished waits until the requests before requestID are finished
+func (a *Participant) waitFinished(ctx context.Context, requestID uint64) error {
+	for {
+		a.lock.Lock()
+		finished := a.joinRequestID >= requestID
+		saved := a.saved
+		a.lock.Unlock()
+		if finished {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-saved:
+		}
+	}
+}
+
 // Request send request to Coodinator
 func (a *Participant) Request(operation *transparent.Message) (*transparent.Message, error) {
-	request, err := a.encode(operation)
+	return a.RequestContext(context.Background(), operation)
+}
+
+// RequestContext send request to Coodinator, and waits for the decision.
+// AbortedError is returned if the request is aborted.
+func (a *Participant) RequestContext(ctx context.Context, operation *transparent.Message) (*transparent.Message, error) {
+	request, err := encode(operation)
 	if err != nil {
 		debugPrintln(1, "Encode error", err)
 		return nil, err
 	}
 	debugPrintln(1, "Client Set", operation)
-	_, err = a.client.Set(context.Background(), request)
-	return nil, err
+	a.lock.Lock()
+	client, err := a.client, a.err
+	a.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return nil, errors.New("not connected to coodinator")
+	}
+	res, err := client.Set(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if !res.Committed {
+		return nil, &AbortedError{RequestID: res.RequestID, Reason: res.Reason}
+	}
+	return nil, nil
+}
+
+// AbortedError means the request is aborted by Coodinator
+type AbortedError struct {
+	RequestID uint64
+	Reason    string
 }
 
-func (a *Participant) encode(operation *transparent.Message) (*pb.SetRequest, error) {
+func (e *AbortedError) Error() string {
+	return fmt.Sprintf("request %d is aborted: %s", e.RequestID, e.Reason)
+}
+
+func encode(operation *transparent.Message) (*pb.SetRequest, error) {
 	gob.Register(operation)
 	buf := new(bytes.Buffer)
 	encoder := gob.NewEncoder(buf)
@@ -429,8 +1620,20 @@ func (a *Participant) encode(operation *transparent.Message) (*pb.SetRequest, er
 	return request, nil
 }
 
-func (a *Participant) commit() (*transparent.Message, error) {
-	operation, err := a.decode(a.currentRequest.Payload)
+func decode(encoded []byte) (*transparent.Message, error) {
+	var operation transparent.Message
+	buf := bytes.NewBuffer(encoded)
+	encoder := gob.NewDecoder(buf)
+	err := encoder.Decode(&operation)
+	if err != nil {
+		return nil, err
+	}
+	return &operation, nil
+}
+
+// commit applies the payload of the message by callback
+func (a *Participant) commit(m *pb.Message) (*transparent.Message, error) {
+	operation, err := decode(m.Payload)
 	if err != nil {
 		debugPrintln(1, "Decode error", err)
 		return nil, err
@@ -439,94 +1642,219 @@ func (a *Participant) commit() (*transparent.Message, error) {
 	return a.committer(operation)
 }
 
-func (a *Participant) decode(encoded []byte) (*transparent.Message, error) {
-	var operation transparent.Message
-	buf := bytes.NewBuffer(encoded)
-	encoder := gob.NewDecoder(buf)
-	err := encoder.Decode(&operation)
+// prepare validates the request by prepare callback
+func (a *Participant) prepare(m *pb.Message) error {
+	if a.preparer == nil {
+		return nil
+	}
+	operation, err := decode(m.Payload)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &operation, nil
+	return a.preparer(operation)
+}
+
+// abort releases the request prepared by prepare callback
+func (a *Participant) abort(req *request) {
+	if a.aborter == nil {
+		return
+	}
+	operation, err := decode(req.message.Payload)
+	if err != nil {
+		debugPrintln(1, "Decode error", err)
+		return
+	}
+	a.aborter(operation)
 }
 
 func (a *Participant) mainLoop() {
-	a.status = stateInit
 	for {
 		select {
 		case m := <-a.in:
 			switch m.MessageType {
-			case pb.MessageType_VoteRequest:
-				if a.status != stateInit {
-					debugPrintln(5, "Ignore VoteRequest", a.clientID, a.status)
+			case pb.MessageType_ACK:
+				// Joined to Coodinator after catch up
+				a.clientID = m.ClientID
+				if a.current < m.RequestID {
+					// Requests between are not committed, Coodinator rejects Join if they are out of history
+					a.current = m.RequestID
+				}
+				// Decisions may be lost while disconnected
+				for _, requestID := range a.ids() {
+					a.globalRequest(requestID)
+				}
+				// Requests before ACK are known, lease starts by the next heartbeat
+				a.save()
+				a.lock.Lock()
+				a.joined = true
+				a.lock.Unlock()
+			case pb.MessageType_VoteRequest, pb.MessageType_CanCommit:
+				if m.RequestID < a.current || a.requests[m.RequestID] != nil {
+					debugPrintln(5, "Ignore VoteRequest", a.clientID, m.RequestID, a.current)
 					// ignore
 					break
 				}
-				if m.RequestID != a.current {
-					// attendee may miss the last request
-					a.status = stateAbort
-					a.voteAbort(m.RequestID)
+				a.current = m.RequestID + 1
+				req := &request{status: stateReady, message: m}
+				a.requests[m.RequestID] = req
+				err := a.prepare(m)
+				if err == nil {
+					err = a.record(m.RequestID, stateReady, m.Payload)
+					if err != nil {
+						a.abort(req)
+					}
+				}
+				if err != nil {
+					// Wait for GlobalAbort to ACK
+					debugPrintln(1, "Prepare error", err)
+					req.status = stateAbort
+					a.voteAbort(m.RequestID, err)
 					break
 				}
-				a.currentRequest = m
-				a.status = stateReady
+				// Commit of the request is not returned before ReadLease knows it
+				a.save()
 				a.votecommit(m.RequestID)
-			case pb.MessageType_GlobalCommit:
-				if a.status != stateReady ||
-					m.RequestID != a.current {
-					debugPrintln(5, "Ignore globalCommit", a.clientID, a.status, m.RequestID, a.current)
+			case pb.MessageType_PreCommit:
+				req := a.requests[m.RequestID]
+				if req == nil || req.status != stateReady {
+					debugPrintln(5, "Ignore PreCommit", a.clientID, m.RequestID)
 					// ignore
 					break
 				}
-				a.status = stateCommit
-				a.commit()
-				a.sendACK(m.RequestID)
+				err := a.record(m.RequestID, statePreCommit, nil)
+				if err != nil {
+					// Stay ready, the decision is asked after timeout
+					debugPrintln(1, "Log error", err)
+					break
+				}
+				req.status = statePreCommit
+				a.send(&pb.Message{
+					MessageType: pb.MessageType_PreCommitACK,
+					ClientID:    a.clientID,
+					RequestID:   m.RequestID,
+				})
+			case pb.MessageType_GlobalCommit, pb.MessageType_DoCommit:
+				req := a.requests[m.RequestID]
+				if req == nil || req.status == stateAbort {
+					if len(m.Payload) > 0 {
+						// Missed VoteRequest, catch up after reconnection, or voted without quorum
+						a.catchUp(m)
+					}
+					break
+				}
+				a.commit(req.message)
+				a.finish(m.RequestID, stateCommit)
 			case pb.MessageType_GlobalAbort:
-				if a.status != stateReady ||
-					m.RequestID != a.current {
-					debugPrintln(5, "Ignore globalAbort", a.clientID, a.status, m.RequestID, a.current)
+				req := a.requests[m.RequestID]
+				// Abort is never decided after PreCommit
+				if req == nil || req.status == statePreCommit {
+					debugPrintln(5, "Ignore globalAbort", a.clientID, m.RequestID)
 					// ignore
 					break
 				}
-				a.status = stateAbort
-				a.sendACK(m.RequestID)
+				if req.status == stateReady {
+					a.abort(req)
+				}
+				a.finish(m.RequestID, stateAbort)
 			}
 		case <-time.After(time.Millisecond * a.timeout):
 			debugPrintln(5, "Client:Timeout", a.clientID)
-			if a.status == stateReady {
-				a.status = stateInit
-				a.current++
+			for _, requestID := range a.ids() {
+				req := a.requests[requestID]
+				if req.status == statePreCommit {
+					// Coodinator decided commit before PreCommit
+					a.commit(req.message)
+					a.finish(requestID, stateCommit)
+					continue
+				}
+				// Coodinator may have crashed, it must not be decided alone
+				a.globalRequest(requestID)
 			}
+		case <-a.done:
+			return
 		}
+		a.save()
+	}
+}
+
+// catchUp commits the request which is not voted
+func (a *Participant) catchUp(m *pb.Message) {
+	if a.requests[m.RequestID] == nil && m.RequestID < a.current {
+		// Already finished
+		return
+	}
+	a.commit(m)
+	err := a.record(m.RequestID, stateCommit, nil)
+	if err != nil {
+		debugPrintln(1, "Log error", err)
+	}
+	delete(a.requests, m.RequestID)
+	if a.current <= m.RequestID {
+		a.current = m.RequestID + 1
+	}
+	a.compact(a.compactable(m.RequestID))
+}
+
+// finish logs the outcome, and sends ACK
+func (a *Participant) finish(requestID uint64, s State) {
+	err := a.record(requestID, s, nil)
+	if err != nil {
+		debugPrintln(1, "Log error", err)
+	}
+	delete(a.requests, requestID)
+	a.compact(a.compactable(requestID))
+	a.sendACK(requestID)
+}
+
+// compactable returns request ID before which records are not needed.
+// Records of the finished request are kept to recover the next request ID.
+func (a *Participant) compactable(finished uint64) uint64 {
+	if oldest := a.oldest(); oldest < finished {
+		return oldest
 	}
+	return finished
+}
+
+func (a *Participant) send(m *pb.Message) {
+	select {
+	case a.out <- m:
+	case <-a.done:
+	}
+}
+
+// globalRequest asks the decision of the request
+func (a *Participant) globalRequest(requestID uint64) {
+	a.send(&pb.Message{
+		MessageType: pb.MessageType_GlobalRequest,
+		ClientID:    a.clientID,
+		RequestID:   requestID,
+	})
 }
 
 func (a *Participant) votecommit(requestID uint64) {
-	a.out <- &pb.Message{
+	a.send(&pb.Message{
 		MessageType: pb.MessageType_VoteCommit,
 		Payload:     nil,
 		ClientID:    a.clientID,
 		RequestID:   requestID,
-	}
+	})
 }
 
-func (a *Participant) voteAbort(requestID uint64) {
-	a.out <- &pb.Message{
+// voteAbort sends VoteAbort with the error as the reason
+func (a *Participant) voteAbort(requestID uint64, err error) {
+	a.send(&pb.Message{
 		MessageType: pb.MessageType_VoteAbort,
-		Payload:     nil,
+		Payload:     []byte(err.Error()),
 		ClientID:    a.clientID,
 		RequestID:   requestID,
-	}
+	})
 }
 
 func (a *Participant) sendACK(requestID uint64) {
-	a.out <- &pb.Message{
+	a.send(&pb.Message{
 		MessageType: pb.MessageType_ACK,
 		Payload:     nil,
 		ClientID:    a.clientID,
 		RequestID:   requestID,
-	}
-
-	a.current++
-	a.status = stateInit
+	})
 }
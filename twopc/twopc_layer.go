@@ -3,8 +3,8 @@ package twopc
 import "github.com/juntaki/transparent"
 
 // NewConsensus returns Two phase commit consensus layer
-func NewConsensus(serverAddr string) (transparent.Layer, error) {
-	participant := NewParticipant(serverAddr)
+func NewConsensus(serverAddr string, opts ...Option) (transparent.Layer, error) {
+	participant := NewParticipant(serverAddr, opts...)
 	c, err := transparent.NewLayerConsensus(participant)
 	if err != nil {
 		return nil, err
@@ -1,8 +1,12 @@
 package twopc
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"testing"
 
+	"github.com/juntaki/transparent"
 	"github.com/juntaki/transparent/test"
 )
 
@@ -25,3 +29,176 @@ func TestConsensus(t *testing.T) {
 
 	test.BasicConsensusFunc(t, a1, a2)
 }
+
+func TestTransaction(t *testing.T) {
+	serverAddr := "localhost:8892"
+	c, err := NewCoodinator(serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	stacks := []*transparent.Stack{}
+	for i := 0; i < 2; i++ {
+		a, err := NewConsensus(serverAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := transparent.NewStack()
+		s.Stack(test.NewSource(0))
+		s.Stack(a)
+		if i == 1 {
+			// Transaction through cache
+			cache, err := transparent.NewLayerCache(10, test.NewStorage(0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Stack(cache)
+		}
+		err = s.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Stop()
+		stacks = append(stacks, s)
+	}
+	waitMembers(t, c, 2)
+
+	test.TransactionStackFunc(t, stacks[0])
+	test.TransactionStackFunc(t, stacks[1])
+}
+
+func TestPipeline(t *testing.T) {
+	serverAddr := "localhost:8894"
+	c, err := NewCoodinator(serverAddr, WithConcurrency(4), WithBatch(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	stacks := []*transparent.Stack{}
+	for i := 0; i < 2; i++ {
+		a, err := NewConsensus(serverAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := transparent.NewStack()
+		s.Stack(test.NewSource(0))
+		s.Stack(a)
+		err = s.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Stop()
+		stacks = append(stacks, s)
+	}
+	waitMembers(t, c, 2)
+
+	// Concurrent Set are batched, and each of them returns the result
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := stacks[0].Set(fmt.Sprint("key", i), []byte("value"))
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	// Set of the same key is not batched together
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := stacks[0].Set("same", []byte("value"))
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	// Sync is ordered after all requests
+	err = stacks[1].Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		value, err := stacks[1].Get(fmt.Sprint("key", i))
+		if err != nil || string(value.([]byte)) != "value" {
+			t.Error(i, value, err)
+		}
+	}
+
+	test.BasicStackFunc(t, stacks[0])
+	test.TransactionStackFunc(t, stacks[1])
+	test.ReadModeStackFunc(t, stacks[0], stacks[1])
+	test.ReadModeStackFunc(t, stacks[1], stacks[0])
+}
+
+func TestTransactionHistory(t *testing.T) {
+	serverAddr := "localhost:8898"
+	c, err := NewCoodinator(serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	stacks := []*transparent.Stack{}
+	sources := []transparent.Layer{}
+	for i := 0; i < 2; i++ {
+		a, err := NewConsensus(serverAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source := test.NewSource(0)
+		s := transparent.NewStack()
+		s.Stack(source)
+		s.Stack(a)
+		err = s.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Stop()
+		stacks = append(stacks, s)
+		sources = append(sources, source)
+	}
+	waitMembers(t, c, 2)
+
+	// Versions of the next layer differ by local write
+	err = sources[0].Set("local", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stacks[0].Set("key", []byte("value1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stacks {
+		// Commits by the other node are applied
+		err = s.Sync()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, version, err := s.GetVersion(context.Background(), "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx := s.Begin()
+		tx.CompareAndSwap("key", []byte("value2"), version)
+		err = tx.Commit(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, source := range sources {
+		err = stacks[i].Sync()
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := source.Get("key")
+		if err != nil || string(value.([]byte)) != "value2" {
+			t.Error(i, err, value)
+		}
+	}
+}
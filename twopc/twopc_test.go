@@ -1,10 +1,20 @@
 package twopc
 
 import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
 	"github.com/juntaki/transparent"
+	pb "github.com/juntaki/transparent/twopc/pb"
 )
 
 func TestServer(t *testing.T) {
@@ -87,13 +97,12 @@ func TestEncode(t *testing.T) {
 		Value: "testValue",
 	}
 
-	a := Participant{}
-	req, err := a.encode(kv)
+	req, err := encode(kv)
 	if err != nil {
 		t.Error(err)
 	}
 
-	kv2, err := a.decode(req.Payload)
+	kv2, err := decode(req.Payload)
 	if err != nil {
 		t.Error(err)
 	}
@@ -103,3 +112,799 @@ func TestEncode(t *testing.T) {
 	}
 
 }
+
+// recorder is committer which records the committed keys
+type recorder struct {
+	lock sync.Mutex
+	keys []interface{}
+}
+
+func (r *recorder) commit(op *transparent.Message) (*transparent.Message, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.keys = append(r.keys, op.Key)
+	return nil, nil
+}
+
+func (r *recorder) has(key interface{}) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, k := range r.keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// waitCommit waits until the key is committed
+func (r *recorder) waitCommit(t *testing.T, key interface{}) {
+	for i := 0; i < 300; i++ {
+		if r.has(key) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("not committed", key, r.keys)
+}
+
+func TestRecovery(t *testing.T) {
+	serverAddr := "localhost:8889"
+	payload := func(key string) []byte {
+		req, err := encode(&transparent.Message{Key: key, Value: "value"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req.Payload
+	}
+
+	// Coodinator crashed after commit of request 1, and before decision of request 2
+	clog := NewMemoryLog()
+	clog.Append(&Record{RequestID: 1, State: stateWait, Payload: payload("key1")})
+	clog.Append(&Record{RequestID: 1, State: stateCommit})
+	clog.Append(&Record{RequestID: 2, State: stateWait, Payload: payload("key2")})
+	log1 := NewMemoryLog()
+	log1.Append(&Record{RequestID: 1, State: stateReady, Payload: payload("key1")})
+	log2 := NewMemoryLog()
+	log2.Append(&Record{RequestID: 2, State: stateReady, Payload: payload("key2")})
+
+	c, err := NewCoodinator(serverAddr, WithLog(clog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetTimeout(100)
+	r1, r2 := &recorder{}, &recorder{}
+	p1 := NewParticipant(serverAddr, WithLog(log1))
+	p2 := NewParticipant(serverAddr, WithLog(log2))
+	for _, p := range []struct {
+		participant *Participant
+		recorder    *recorder
+	}{{p1, r1}, {p2, r2}} {
+		p.participant.SetTimeout(100)
+		p.participant.SetCallback(p.recorder.commit)
+		err = p.participant.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.participant.Stop()
+	}
+
+	// In-doubt requests are resolved by asking Coodinator
+	r1.waitCommit(t, "key1")
+	time.Sleep(300 * time.Millisecond)
+	if r2.has("key2") {
+		t.Error("undecided request is committed")
+	}
+
+	_, err = p1.Request(&transparent.Message{Key: "key3", Value: "value"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1.waitCommit(t, "key3")
+	r2.waitCommit(t, "key3")
+
+	// Participants reconnect to restarted Coodinator
+	c.Stop()
+	c, err = NewCoodinator(serverAddr, WithLog(clog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	for i := 0; i < 300; i++ {
+		if len(c.Members()) == 2 {
+			_, err = p2.Request(&transparent.Message{Key: "key4", Value: "value"})
+			if err == nil {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1.waitCommit(t, "key4")
+	r2.waitCommit(t, "key4")
+
+	// Log is compacted after ACKs, which may arrive after the decision is returned
+	compacted := func() bool {
+		records, _ := clog.Records()
+		for _, r := range records {
+			if r.RequestID < 4 {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < 300 && !compacted(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !compacted() {
+		records, _ := clog.Records()
+		t.Error("log is not compacted", records)
+	}
+}
+
+func TestFileLog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "2pc.log")
+	l, err := NewFileLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		err = l.Append(&Record{RequestID: i, State: stateReady, Payload: []byte("payload")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = l.Compact(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Append(&Record{RequestID: 3, State: stateCommit})
+
+	l, err = NewFileLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := l.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[0].RequestID != 2 ||
+		string(records[0].Payload) != "payload" || records[2].State != stateCommit {
+		t.Error(records)
+	}
+}
+
+func TestThreePhase(t *testing.T) {
+	serverAddr := "localhost:8890"
+	c, err := NewCoodinator(serverAddr, WithThreePhase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	c.SetTimeout(100)
+
+	r1, r2 := &recorder{}, &recorder{}
+	p1 := NewParticipant(serverAddr)
+	p2 := NewParticipant(serverAddr)
+	for _, p := range []struct {
+		participant *Participant
+		recorder    *recorder
+	}{{p1, r1}, {p2, r2}} {
+		p.participant.SetTimeout(100)
+		p.participant.SetCallback(p.recorder.commit)
+		err = p.participant.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.participant.Stop()
+	}
+
+	_, err = p1.Request(&transparent.Message{Key: "key1", Value: "value"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1.waitCommit(t, "key1")
+	r2.waitCommit(t, "key1")
+}
+
+func TestPreCommitTimeout(t *testing.T) {
+	r := &recorder{}
+	a := &Participant{
+		in:        make(chan *pb.Message, 1),
+		out:       make(chan *pb.Message, 1),
+		done:      make(chan bool),
+		saved:     make(chan bool),
+		timeout:   50,
+		requests:  make(map[uint64]*request),
+		current:   1,
+		committer: r.commit,
+	}
+	go a.mainLoop()
+	defer a.Stop()
+	req, err := encode(&transparent.Message{Key: "key1", Value: "value"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange := func(m *pb.Message, expected pb.MessageType) {
+		a.in <- m
+		select {
+		case reply := <-a.out:
+			if reply.MessageType != expected || reply.RequestID != 1 {
+				t.Fatal(reply)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no reply to", m)
+		}
+	}
+	exchange(&pb.Message{MessageType: pb.MessageType_CanCommit, RequestID: 1, Payload: req.Payload},
+		pb.MessageType_VoteCommit)
+	exchange(&pb.Message{MessageType: pb.MessageType_PreCommit, RequestID: 1},
+		pb.MessageType_PreCommitACK)
+
+	// Coodinator fails after PreCommit, participant commits alone
+	select {
+	case reply := <-a.out:
+		if reply.MessageType != pb.MessageType_ACK {
+			t.Fatal(reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not committed")
+	}
+	if !r.has("key1") {
+		t.Error("not committed")
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	r := &recorder{}
+	aborted := make(chan interface{}, 1)
+	a := &Participant{
+		in:        make(chan *pb.Message, 1),
+		out:       make(chan *pb.Message, 1),
+		done:      make(chan bool),
+		saved:     make(chan bool),
+		timeout:   1000,
+		requests:  make(map[uint64]*request),
+		current:   1,
+		committer: r.commit,
+		preparer: func(m *transparent.Message) error {
+			if m.Key == "invalid" {
+				return errors.New("invalid key")
+			}
+			return nil
+		},
+		aborter: func(m *transparent.Message) {
+			aborted <- m.Key
+		},
+	}
+	go a.mainLoop()
+	defer a.Stop()
+	exchange := func(m *pb.Message, expected pb.MessageType) {
+		a.in <- m
+		select {
+		case reply := <-a.out:
+			if reply.MessageType != expected || reply.RequestID != m.RequestID {
+				t.Fatal(reply)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no reply to", m)
+		}
+	}
+	vote := func(requestID uint64, key string, expected pb.MessageType) {
+		req, err := encode(&transparent.Message{Key: key, Value: "value"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		exchange(&pb.Message{MessageType: pb.MessageType_VoteRequest, RequestID: requestID, Payload: req.Payload},
+			expected)
+	}
+
+	// Rejected by prepare, nothing to release
+	vote(1, "invalid", pb.MessageType_VoteAbort)
+	exchange(&pb.Message{MessageType: pb.MessageType_GlobalAbort, RequestID: 1}, pb.MessageType_ACK)
+
+	// Prepared, and released by abort
+	vote(2, "key1", pb.MessageType_VoteCommit)
+	select {
+	case key := <-aborted:
+		t.Fatal("aborted before decision", key)
+	default:
+	}
+	exchange(&pb.Message{MessageType: pb.MessageType_GlobalAbort, RequestID: 2}, pb.MessageType_ACK)
+	select {
+	case key := <-aborted:
+		if key != "key1" {
+			t.Error(key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not aborted")
+	}
+
+	// Prepared, and committed
+	vote(3, "key2", pb.MessageType_VoteCommit)
+	exchange(&pb.Message{MessageType: pb.MessageType_GlobalCommit, RequestID: 3}, pb.MessageType_ACK)
+	if !r.has("key2") {
+		t.Error("not committed")
+	}
+	select {
+	case key := <-aborted:
+		t.Error("committed request is aborted", key)
+	default:
+	}
+}
+
+func TestOutcome(t *testing.T) {
+	serverAddr := "localhost:8895"
+	c, err := NewCoodinator(serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	r1, r2 := &recorder{}, &recorder{}
+	p1, p2 := NewParticipant(serverAddr), NewParticipant(serverAddr)
+	p1.SetCallback(r1.commit)
+	p2.SetCallback(r2.commit)
+	p2.SetPrepareCallback(func(m *transparent.Message) error {
+		if m.Key == "invalid" {
+			return errors.New("invalid key")
+		}
+		return nil
+	})
+	for _, p := range []*Participant{p1, p2} {
+		err = p.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Stop()
+	}
+	waitMembers(t, c, 2)
+
+	// Request returns after commit is decided
+	_, err = p1.Request(&transparent.Message{Key: "key1", Value: "value"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1.waitCommit(t, "key1")
+	r2.waitCommit(t, "key1")
+
+	// Rejected by another participant, the reason is returned
+	_, err = p1.Request(&transparent.Message{Key: "invalid", Value: "value"})
+	aborted, ok := err.(*AbortedError)
+	if !ok {
+		t.Fatal("not aborted", err)
+	}
+	if !strings.Contains(aborted.Reason, "invalid key") {
+		t.Error(aborted.Reason)
+	}
+	if r1.has("invalid") || r2.has("invalid") {
+		t.Error("aborted request is committed")
+	}
+}
+
+// waitMembers waits until the number of participants becomes n
+func waitMembers(t *testing.T, c *Coodinator, n int) {
+	for i := 0; i < 300; i++ {
+		if len(c.Members()) == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("members", c.Members(), "expected", n)
+}
+
+func TestMembership(t *testing.T) {
+	serverAddr := "localhost:8891"
+	c, err := NewCoodinator(serverAddr, WithHeartbeat(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	c.SetTimeout(5000)
+
+	r1, r2 := &recorder{}, &recorder{}
+	p1 := NewParticipant(serverAddr, WithHeartbeat(50*time.Millisecond))
+	p1.SetCallback(r1.commit)
+	p1.SetTimeout(100)
+	p2 := NewParticipant(serverAddr, WithHeartbeat(50*time.Millisecond))
+	p2.SetCallback(r2.commit)
+	p2.SetTimeout(500)
+	for _, p := range []*Participant{p1, p2} {
+		err = p.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Stop()
+	}
+	waitMembers(t, c, 2)
+
+	// Participant without heartbeat is removed
+	conn, err := grpc.Dial(serverAddr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stream, err := pb.NewClusterClient(conn).Connection(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stream.Send(&pb.Message{MessageType: pb.MessageType_Join})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitMembers(t, c, 3)
+	waitMembers(t, c, 2)
+
+	// Reconnected participant has the same clientID, and catches up
+	p2.lock.Lock()
+	clientID := p2.clientID
+	p2.lock.Unlock()
+	c.lock.RLock()
+	c.out[clientID].remove()
+	c.lock.RUnlock()
+	waitMembers(t, c, 1)
+	_, err = p1.Request(&transparent.Message{Key: "key1", Value: "value"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1.waitCommit(t, "key1")
+	r2.waitCommit(t, "key1")
+	waitMembers(t, c, 2)
+	members := c.Members()
+	if members[0] != clientID && members[1] != clientID {
+		t.Error("clientID is changed", members, clientID)
+	}
+
+	// Left participant doesn't block commit
+	p2.Stop()
+	waitMembers(t, c, 1)
+	start := time.Now()
+	_, err = p1.Request(&transparent.Message{Key: "key2", Value: "value"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1.waitCommit(t, "key2")
+	if time.Since(start) > time.Second {
+		t.Error("commit waits for left participant")
+	}
+}
+
+// journal is committer which records the committed values in order.
+// It also counts the requests prepared at the same time, and batched requests.
+type journal struct {
+	lock     sync.Mutex
+	entries  []string
+	prepared int
+	max      int
+	batches  int
+}
+
+func (j *journal) prepare(op *transparent.Message) error {
+	// Slow prepare makes requests queued
+	time.Sleep(10 * time.Millisecond)
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.prepared++
+	if j.prepared > j.max {
+		j.max = j.prepared
+	}
+	return nil
+}
+
+func (j *journal) commit(op *transparent.Message) (*transparent.Message, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.prepared--
+	ops := []*transparent.Message{op}
+	if op.Message == transparent.MessageBatch {
+		j.batches++
+		ops = op.Batch
+	}
+	for _, o := range ops {
+		j.entries = append(j.entries, fmt.Sprint(o.Key, "=", o.Value))
+	}
+	return nil, nil
+}
+
+func (j *journal) index(entry string) int {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	for i, e := range j.entries {
+		if e == entry {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestConcurrency(t *testing.T) {
+	serverAddr := "localhost:8893"
+	c, err := NewCoodinator(serverAddr, WithConcurrency(8), WithBatch(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	j1, j2 := &journal{}, &journal{}
+	p1 := NewParticipant(serverAddr)
+	p2 := NewParticipant(serverAddr)
+	for _, p := range []struct {
+		participant *Participant
+		journal     *journal
+	}{{p1, j1}, {p2, j2}} {
+		p.participant.SetCallback(p.journal.commit)
+		p.participant.SetPrepareCallback(p.journal.prepare)
+		err = p.participant.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.participant.Stop()
+	}
+	waitMembers(t, c, 2)
+
+	// Request waits for the decision, the keys are requested at the same time
+	for value := 1; value <= 2; value++ {
+		wg := sync.WaitGroup{}
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := p1.Request(&transparent.Message{Key: fmt.Sprint("key", i), Value: value})
+				if err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+	}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprint("key", i)
+		for _, j := range []*journal{j1, j2} {
+			for k := 0; k < 300 && j.index(key+"=2") < 0; k++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			// Requests of the same key are committed in order
+			first, second := j.index(key+"=1"), j.index(key+"=2")
+			if first < 0 || second < first {
+				t.Fatal(key, first, second, j.entries)
+			}
+		}
+	}
+	for _, j := range []*journal{j1, j2} {
+		j.lock.Lock()
+		if j.max < 2 || j.batches == 0 {
+			t.Error("requests are not voted concurrently", j.max, "or batched", j.batches)
+		}
+		j.lock.Unlock()
+	}
+}
+
+// rawParticipant joins Coodinator by the stream, to control the messages
+func rawParticipant(t *testing.T, serverAddr string, join *pb.Message) (pb.Cluster_ConnectionClient, func()) {
+	conn, err := grpc.Dial(serverAddr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := pb.NewClusterClient(conn).Connection(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	join.MessageType = pb.MessageType_Join
+	err = stream.Send(join)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stream, func() { conn.Close() }
+}
+
+// recvMessage receives until the message of the type
+func recvMessage(t *testing.T, stream pb.Cluster_ConnectionClient, messageType pb.MessageType) *pb.Message {
+	for {
+		m, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.MessageType == messageType {
+			return m
+		}
+	}
+}
+
+func TestUnacked(t *testing.T) {
+	serverAddr := "localhost:8896"
+	clog := NewMemoryLog()
+	c, err := NewCoodinator(serverAddr, WithLog(clog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetTimeout(100)
+	r := &recorder{}
+	p := NewParticipant(serverAddr)
+	p.SetCallback(r.commit)
+	p.SetTimeout(100)
+	err = p.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	// Participant votes commit, and is removed before ACK
+	stream, closeStream := rawParticipant(t, serverAddr, &pb.Message{})
+	clientID := recvMessage(t, stream, pb.MessageType_ACK).ClientID
+	waitMembers(t, c, 2)
+	go p.Request(&transparent.Message{Key: "key1", Value: "value"})
+	vote := recvMessage(t, stream, pb.MessageType_VoteRequest)
+	err = stream.Send(&pb.Message{MessageType: pb.MessageType_VoteCommit, RequestID: vote.RequestID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recvMessage(t, stream, pb.MessageType_GlobalCommit)
+	closeStream()
+	r.waitCommit(t, "key1")
+	waitMembers(t, c, 1)
+	for i := 0; i < 300; i++ {
+		c.lock.RLock()
+		finished := len(c.rounds) == 0
+		c.lock.RUnlock()
+		if finished {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Restarted Coodinator still answers commit to the participant
+	c.Stop()
+	c, err = NewCoodinator(serverAddr, WithLog(clog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	stream, closeStream = rawParticipant(t, serverAddr, &pb.Message{ClientID: clientID, RequestID: vote.RequestID})
+	defer closeStream()
+	recvMessage(t, stream, pb.MessageType_ACK)
+	err = stream.Send(&pb.Message{MessageType: pb.MessageType_GlobalRequest, RequestID: vote.RequestID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recvMessage(t, stream, pb.MessageType_GlobalCommit)
+
+	// The commit is forgotten after ACK
+	err = stream.Send(&pb.Message{MessageType: pb.MessageType_ACK, RequestID: vote.RequestID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		c.lock.RLock()
+		_, kept := c.decisions[vote.RequestID]
+		c.lock.RUnlock()
+		if !kept {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("commit is not forgotten after ACK")
+}
+
+func TestCatchUp(t *testing.T) {
+	serverAddr := "localhost:8897"
+	c, err := NewCoodinator(serverAddr, WithHistory(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	c.SetTimeout(100)
+	r := &recorder{}
+	p := NewParticipant(serverAddr)
+	p.SetCallback(r.commit)
+	p.SetTimeout(100)
+	err = p.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	// Reconnected before the old connection is removed, clientID is kept
+	stream, closeStream := rawParticipant(t, serverAddr, &pb.Message{})
+	defer closeStream()
+	clientID := recvMessage(t, stream, pb.MessageType_ACK).ClientID
+	stream, closeStream = rawParticipant(t, serverAddr, &pb.Message{ClientID: clientID})
+	defer closeStream()
+	if ack := recvMessage(t, stream, pb.MessageType_ACK); ack.ClientID != clientID {
+		t.Error("clientID is changed", ack.ClientID, clientID)
+	}
+	waitMembers(t, c, 2)
+
+	for _, key := range []string{"key1", "key2"} {
+		go p.Request(&transparent.Message{Key: key, Value: "value"})
+		vote := recvMessage(t, stream, pb.MessageType_VoteRequest)
+		err = stream.Send(&pb.Message{MessageType: pb.MessageType_VoteCommit, RequestID: vote.RequestID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recvMessage(t, stream, pb.MessageType_GlobalCommit)
+		r.waitCommit(t, key)
+	}
+
+	// Commit in history is caught up, and older one is rejected
+	stream, closeStream = rawParticipant(t, serverAddr, &pb.Message{RequestID: 2})
+	defer closeStream()
+	if m := recvMessage(t, stream, pb.MessageType_GlobalCommit); m.RequestID != 2 {
+		t.Error(m)
+	}
+	stream, closeStream = rawParticipant(t, serverAddr, &pb.Message{RequestID: 1})
+	defer closeStream()
+	_, err = stream.Recv()
+	if grpc.Code(err) != codes.FailedPrecondition {
+		t.Error(err)
+	}
+}
+
+func TestSlowParticipant(t *testing.T) {
+	serverAddr := "localhost:8899"
+	c, err := NewCoodinator(serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	// Participant whose sender doesn't receive
+	conn := &connection{
+		out:    make(chan *pb.Message, 1),
+		finish: make(chan bool),
+		kick:   make(chan bool),
+	}
+	conn.seen.Store(time.Now().UnixNano())
+	conn.out <- &pb.Message{}
+	c.lock.Lock()
+	c.out[1] = conn
+	c.lock.Unlock()
+	sent := make(chan bool)
+	go func() {
+		c.broadcast(&pb.Message{MessageType: pb.MessageType_Heartbeat})
+		close(sent)
+	}()
+	defer close(conn.finish)
+
+	// Lock is not held while blocked
+	locked := make(chan bool)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.lock.Lock()
+		c.lock.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Error("lock is held while sending")
+	}
+	select {
+	case <-sent:
+		t.Error("message is sent to blocked participant")
+	default:
+	}
+}
+
+func TestLease(t *testing.T) {
+	a := &Participant{
+		options: newOptions([]Option{WithHeartbeat(time.Minute)}),
+		joined:  true,
+	}
+
+	// Sent heartbeat doesn't renew the lease until it is replied
+	ping := a.heartbeatMessage()
+	if !a.lease.IsZero() {
+		t.Error("lease is renewed by sent heartbeat")
+	}
+	next := a.heartbeatMessage()
+	a.renew(ping.RequestID)
+	if !a.lease.IsZero() {
+		t.Error("lease is renewed by old reply")
+	}
+	a.renew(next.RequestID)
+	if !a.lease.Equal(a.pinged.Add(time.Minute)) {
+		t.Error(a.lease, a.pinged)
+	}
+}
@@ -0,0 +1,121 @@
+package typed
+
+import (
+	"github.com/juntaki/transparent"
+	"github.com/juntaki/transparent/simple"
+)
+
+// BackendStorage is typed transparent.BackendStorage
+type BackendStorage[K, V any] interface {
+	Get(key K) (value V, err error)
+	Add(key K, value V) error
+	Remove(key K) error
+}
+
+// NewBackendStorage returns transparent.BackendStorage, which wraps typed BackendStorage.
+// Key and value from layer are decoded by the Codecs.
+func NewBackendStorage[K, V, KW, VW any](s BackendStorage[K, V], keys Codec[K, KW], values Codec[V, VW]) transparent.BackendStorage {
+	return &untypedStorage[K, V]{
+		storage: s,
+		keys:    hide(keys),
+		values:  hide(values),
+	}
+}
+
+type untypedStorage[K, V any] struct {
+	storage BackendStorage[K, V]
+	keys    codec[K]
+	values  codec[V]
+}
+
+func (s *untypedStorage[K, V]) Get(key interface{}) (interface{}, error) {
+	k, err := s.decodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	v, err := s.storage.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	return s.values.encode(v)
+}
+
+func (s *untypedStorage[K, V]) Add(key interface{}, value interface{}) error {
+	k, err := s.decodeKey(key)
+	if err != nil {
+		return err
+	}
+	v, err := s.values.decode(value)
+	if err != nil {
+		return err
+	}
+	return s.storage.Add(k, v)
+}
+
+func (s *untypedStorage[K, V]) Remove(key interface{}) error {
+	k, err := s.decodeKey(key)
+	if err != nil {
+		return err
+	}
+	return s.storage.Remove(k)
+}
+
+// decodeKey reports invalid key as StorageInvalidKeyError
+func (s *untypedStorage[K, V]) decodeKey(key interface{}) (K, error) {
+	k, err := s.keys.decode(key)
+	if invalid, ok := err.(*simple.StorageInvalidValueError); ok {
+		return k, &simple.StorageInvalidKeyError{
+			Valid:   invalid.Valid,
+			Invalid: invalid.Invalid,
+		}
+	}
+	return k, err
+}
+
+// WrapBackendStorage returns typed BackendStorage, which wraps transparent.BackendStorage.
+// Key and value are encoded by the Codecs.
+func WrapBackendStorage[K, V, KW, VW any](s transparent.BackendStorage, keys Codec[K, KW], values Codec[V, VW]) BackendStorage[K, V] {
+	return &typedStorage[K, V]{
+		storage: s,
+		keys:    hide(keys),
+		values:  hide(values),
+	}
+}
+
+type typedStorage[K, V any] struct {
+	storage transparent.BackendStorage
+	keys    codec[K]
+	values  codec[V]
+}
+
+func (s *typedStorage[K, V]) Get(key K) (value V, err error) {
+	k, err := s.keys.encode(key)
+	if err != nil {
+		return value, err
+	}
+	v, err := s.storage.Get(k)
+	if err != nil {
+		return value, err
+	}
+	return s.values.decode(v)
+}
+
+func (s *typedStorage[K, V]) Add(key K, value V) error {
+	k, err := s.keys.encode(key)
+	if err != nil {
+		return err
+	}
+	v, err := s.values.encode(value)
+	if err != nil {
+		return err
+	}
+	return s.storage.Add(k, v)
+}
+
+func (s *typedStorage[K, V]) Remove(key K) error {
+	k, err := s.keys.encode(key)
+	if err != nil {
+		return err
+	}
+	return s.storage.Remove(k)
+}
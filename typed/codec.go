@@ -0,0 +1,126 @@
+package typed
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+
+	"github.com/juntaki/transparent/simple"
+	"github.com/pkg/errors"
+)
+
+// Codec converts typed key or value to wire type W, which transparent.Layer accepts.
+type Codec[T, W any] interface {
+	Encode(v T) (W, error)
+	Decode(v W) (T, error)
+}
+
+type anyCodec[T any] struct{}
+
+// Any returns Codec, it passes the value as is.
+// Use it for storage which accepts any value, such as lru.
+func Any[T any]() Codec[T, T] {
+	return anyCodec[T]{}
+}
+
+func (anyCodec[T]) Encode(v T) (T, error) {
+	return v, nil
+}
+
+func (anyCodec[T]) Decode(v T) (T, error) {
+	return v, nil
+}
+
+type stringCodec[T ~string] struct{}
+
+// String returns Codec, it converts the value to string.
+// Use it for the key of filesystem, s3 and transfer.
+func String[T ~string]() Codec[T, string] {
+	return stringCodec[T]{}
+}
+
+func (stringCodec[T]) Encode(v T) (string, error) {
+	return string(v), nil
+}
+
+func (stringCodec[T]) Decode(v string) (T, error) {
+	return T(v), nil
+}
+
+type bytesCodec[T ~[]byte] struct{}
+
+// Bytes returns Codec, it converts the value to []byte.
+// Use it for the value of filesystem, s3 and transfer.
+func Bytes[T ~[]byte]() Codec[T, []byte] {
+	return bytesCodec[T]{}
+}
+
+func (bytesCodec[T]) Encode(v T) ([]byte, error) {
+	return []byte(v), nil
+}
+
+func (bytesCodec[T]) Decode(v []byte) (T, error) {
+	return T(v), nil
+}
+
+type gobCodec[T any] struct{}
+
+// Gob returns Codec, it encodes the value to []byte by encoding/gob.
+// Use it for storing any value to filesystem, s3 and transfer.
+func Gob[T any]() Codec[T, []byte] {
+	return gobCodec[T]{}
+}
+
+func (gobCodec[T]) Encode(v T) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	cause := gob.NewEncoder(buf).Encode(&v)
+	if cause != nil {
+		return nil, errors.Wrap(cause, "failed to encode value")
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec[T]) Decode(v []byte) (T, error) {
+	var decoded T
+	cause := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&decoded)
+	if cause != nil {
+		return decoded, errors.Wrap(cause, "failed to decode value")
+	}
+	return decoded, nil
+}
+
+// codec is Codec of which wire type is hidden,
+// it converts the value from and to interface{} of transparent.Layer.
+type codec[T any] interface {
+	encode(v T) (interface{}, error)
+	decode(v interface{}) (T, error)
+}
+
+type wireCodec[T, W any] struct {
+	Codec[T, W]
+}
+
+func hide[T, W any](c Codec[T, W]) codec[T] {
+	return wireCodec[T, W]{c}
+}
+
+func (c wireCodec[T, W]) encode(v T) (interface{}, error) {
+	return c.Encode(v)
+}
+
+// decode reports the value not of wire type as StorageInvalidValueError
+func (c wireCodec[T, W]) decode(v interface{}) (T, error) {
+	wire, ok := v.(W)
+	if !ok {
+		var decoded T
+		return decoded, invalidValue[W](v)
+	}
+	return c.Decode(wire)
+}
+
+func invalidValue[T any](v interface{}) error {
+	return &simple.StorageInvalidValueError{
+		Valid:   reflect.TypeOf((*T)(nil)).Elem(),
+		Invalid: reflect.TypeOf(v),
+	}
+}
@@ -0,0 +1,289 @@
+// Package typed is type-safe wrapper of transparent.Stack, Layer and BackendStorage.
+// Key and value are converted by Codec between the typed API and
+// interface{} of the underlying transparent package.
+package typed
+
+import (
+	"context"
+	"time"
+
+	"github.com/juntaki/transparent"
+)
+
+// Stack is typed transparent.Stack.
+// KW and VW are wire types of key and value, which the stacked layers store.
+type Stack[K comparable, V, KW, VW any] struct {
+	Layer[K, V]
+	stack *transparent.Stack
+}
+
+// NewStack returns Stack
+// Key and value are encoded by the Codecs before passed to the top layer.
+func NewStack[K comparable, V, KW, VW any](keys Codec[K, KW], values Codec[V, VW]) *Stack[K, V, KW, VW] {
+	s := transparent.NewStack()
+	return &Stack[K, V, KW, VW]{
+		Layer: Layer[K, V]{layer: s, keys: hide(keys), values: hide(values)},
+		stack: s,
+	}
+}
+
+// Stack add the layer to Stack.
+// The layer must store the wire types of the Codecs of Stack.
+func (s *Stack[K, V, KW, VW]) Stack(l Wire[KW, VW]) error {
+	return s.stack.Stack(l.layer)
+}
+
+// Start initialize all stacked layers
+func (s *Stack[K, V, KW, VW]) Start() error {
+	return s.stack.Start()
+}
+
+// Stop clean up all stacked layers
+func (s *Stack[K, V, KW, VW]) Stop() error {
+	return s.stack.Stop()
+}
+
+// Wire is transparent.Layer, which stores key of type KW and value of type VW.
+type Wire[KW, VW any] struct {
+	layer transparent.Layer
+}
+
+// NewWire returns Wire, KW and VW must be the types that the layer accepts.
+// For example, filesystem, s3 and transfer accept string key and []byte value.
+func NewWire[KW, VW any](l transparent.Layer) Wire[KW, VW] {
+	return Wire[KW, VW]{layer: l}
+}
+
+// NewSource returns Wire of source layer, which stores key and value to typed BackendStorage.
+func NewSource[KW, VW any](s BackendStorage[KW, VW]) (Wire[KW, VW], error) {
+	l, err := transparent.NewLayerSource(NewBackendStorage(s, Any[KW](), Any[VW]()))
+	if err != nil {
+		return Wire[KW, VW]{}, err
+	}
+	return NewWire[KW, VW](l), nil
+}
+
+// Layer is typed transparent.Layer
+type Layer[K comparable, V any] struct {
+	layer  transparent.Layer
+	keys   codec[K]
+	values codec[V]
+}
+
+// ScanPage is typed transparent.ScanPage
+type ScanPage[K any] struct {
+	Keys []K
+	Next string
+}
+
+// NewLayer returns Layer, which wraps the transparent.Layer to use it without Stack.
+func NewLayer[K comparable, V, KW, VW any](l Wire[KW, VW], keys Codec[K, KW], values Codec[V, VW]) *Layer[K, V] {
+	return &Layer[K, V]{
+		layer:  l.layer,
+		keys:   hide(keys),
+		values: hide(values),
+	}
+}
+
+// Untyped returns wrapped transparent.Layer
+func (l *Layer[K, V]) Untyped() transparent.Layer {
+	return l.layer
+}
+
+// Set set new value
+func (l *Layer[K, V]) Set(key K, value V) error {
+	return l.SetContext(context.Background(), key, value)
+}
+
+// SetContext set new value
+func (l *Layer[K, V]) SetContext(ctx context.Context, key K, value V) error {
+	k, err := l.keys.encode(key)
+	if err != nil {
+		return err
+	}
+	v, err := l.values.encode(value)
+	if err != nil {
+		return err
+	}
+	return l.layer.SetContext(ctx, k, v)
+}
+
+// SetWithTTL set new value, it expires after ttl
+func (l *Layer[K, V]) SetWithTTL(ctx context.Context, key K, value V, ttl time.Duration) error {
+	k, err := l.keys.encode(key)
+	if err != nil {
+		return err
+	}
+	v, err := l.values.encode(value)
+	if err != nil {
+		return err
+	}
+	return l.layer.SetWithTTL(ctx, k, v, ttl)
+}
+
+// Get value
+func (l *Layer[K, V]) Get(key K) (value V, err error) {
+	return l.GetContext(context.Background(), key)
+}
+
+// GetContext value
+func (l *Layer[K, V]) GetContext(ctx context.Context, key K) (value V, err error) {
+	k, err := l.keys.encode(key)
+	if err != nil {
+		return value, err
+	}
+	v, err := l.layer.GetContext(ctx, k)
+	if err != nil {
+		return value, err
+	}
+	return l.values.decode(v)
+}
+
+// Remove value
+func (l *Layer[K, V]) Remove(key K) error {
+	return l.RemoveContext(context.Background(), key)
+}
+
+// RemoveContext value
+func (l *Layer[K, V]) RemoveContext(ctx context.Context, key K) error {
+	k, err := l.keys.encode(key)
+	if err != nil {
+		return err
+	}
+	return l.layer.RemoveContext(ctx, k)
+}
+
+// Sync current buffered value
+func (l *Layer[K, V]) Sync() error {
+	return l.layer.Sync()
+}
+
+// SyncContext current buffered value
+func (l *Layer[K, V]) SyncContext(ctx context.Context) error {
+	return l.layer.SyncContext(ctx)
+}
+
+// GetMulti values, keys not found are not in the result
+func (l *Layer[K, V]) GetMulti(ctx context.Context, keys []K) (map[K]V, error) {
+	encoded := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		k, err := l.keys.encode(key)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, k)
+	}
+	values, err := l.layer.GetMulti(ctx, encoded)
+	if err != nil {
+		return nil, err
+	}
+	decoded := make(map[K]V, len(values))
+	for k, v := range values {
+		key, err := l.keys.decode(k)
+		if err != nil {
+			return nil, err
+		}
+		value, err := l.values.decode(v)
+		if err != nil {
+			return nil, err
+		}
+		decoded[key] = value
+	}
+	return decoded, nil
+}
+
+// SetMulti set new values
+func (l *Layer[K, V]) SetMulti(ctx context.Context, values map[K]V) error {
+	encoded := make(map[interface{}]interface{}, len(values))
+	for key, value := range values {
+		k, err := l.keys.encode(key)
+		if err != nil {
+			return err
+		}
+		v, err := l.values.encode(value)
+		if err != nil {
+			return err
+		}
+		encoded[k] = v
+	}
+	return l.layer.SetMulti(ctx, encoded)
+}
+
+// RemoveMulti values
+func (l *Layer[K, V]) RemoveMulti(ctx context.Context, keys []K) error {
+	encoded := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		k, err := l.keys.encode(key)
+		if err != nil {
+			return err
+		}
+		encoded = append(encoded, k)
+	}
+	return l.layer.RemoveMulti(ctx, encoded)
+}
+
+// Scan a page of keys in the range, keys are decoded from string by the Codec
+func (l *Layer[K, V]) Scan(ctx context.Context, r transparent.ScanRange) (*ScanPage[K], error) {
+	page, err := l.layer.Scan(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]K, 0, len(page.Keys))
+	for _, k := range page.Keys {
+		key, err := l.keys.decode(k)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return &ScanPage[K]{Keys: keys, Next: page.Next}, nil
+}
+
+// GetVersion value and its version
+func (l *Layer[K, V]) GetVersion(ctx context.Context, key K) (value V, version string, err error) {
+	k, err := l.keys.encode(key)
+	if err != nil {
+		return value, "", err
+	}
+	v, version, err := l.layer.GetVersion(ctx, k)
+	if err != nil {
+		return value, "", err
+	}
+	value, err = l.values.decode(v)
+	return value, version, err
+}
+
+// SetIfAbsent set new value if the key doesn't exist, and returns its version
+func (l *Layer[K, V]) SetIfAbsent(ctx context.Context, key K, value V) (string, error) {
+	k, err := l.keys.encode(key)
+	if err != nil {
+		return "", err
+	}
+	v, err := l.values.encode(value)
+	if err != nil {
+		return "", err
+	}
+	return l.layer.SetIfAbsent(ctx, k, v)
+}
+
+// CompareAndSwap set new value if the version is current, and returns new version
+func (l *Layer[K, V]) CompareAndSwap(ctx context.Context, key K, value V, version string) (string, error) {
+	k, err := l.keys.encode(key)
+	if err != nil {
+		return "", err
+	}
+	v, err := l.values.encode(value)
+	if err != nil {
+		return "", err
+	}
+	return l.layer.CompareAndSwap(ctx, k, v, version)
+}
+
+// RemoveIfVersion value if the version is current
+func (l *Layer[K, V]) RemoveIfVersion(ctx context.Context, key K, version string) error {
+	k, err := l.keys.encode(key)
+	if err != nil {
+		return err
+	}
+	return l.layer.RemoveIfVersion(ctx, k, version)
+}
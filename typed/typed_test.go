@@ -0,0 +1,154 @@
+package typed
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/juntaki/transparent"
+	"github.com/juntaki/transparent/filesystem"
+	"github.com/juntaki/transparent/lru"
+	"github.com/juntaki/transparent/test"
+)
+
+type point struct {
+	X, Y int
+}
+
+func TestTypedStack(t *testing.T) {
+	keys := Any[int]()
+	values := Any[point]()
+	cache, err := lru.NewCache(10, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStack(keys, values)
+	s.Stack(NewWire[int, point](test.NewSource(0)))
+	s.Stack(NewWire[int, point](cache))
+	s.Start()
+	defer s.Stop()
+
+	err = s.Set(1, point{1, 2})
+	if err != nil {
+		t.Error(err)
+	}
+	value, err := s.Get(1)
+	if err != nil || value != (point{1, 2}) {
+		t.Error(err, value)
+	}
+	err = s.Remove(1)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = s.Get(1)
+	if _, ok := err.(*transparent.KeyNotFoundError); !ok {
+		t.Error(err)
+	}
+	err = s.Sync()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTypedFilesystem(t *testing.T) {
+	keys := String[string]()
+	values := Gob[point]()
+	s := NewStack(keys, values)
+	s.Stack(NewWire[string, []byte](filesystem.NewSource("/tmp")))
+
+	err := s.Set("typed", point{3, 4})
+	if err != nil {
+		t.Error(err)
+	}
+	value, err := s.Get("typed")
+	if err != nil || value != (point{3, 4}) {
+		t.Error(err, value)
+	}
+	err = s.Remove("typed")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTypedBackendStorage(t *testing.T) {
+	keys := String[string]()
+	values := Bytes[[]byte]()
+	fs := WrapBackendStorage(filesystem.NewSimpleStorage("/tmp"), keys, values)
+	s := NewBackendStorage(fs, keys, values)
+	test.BasicStorageFunc(t, s)
+	test.SimpleStorageFunc(t, s)
+
+	source, err := NewSource(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLayer(source, keys, values)
+	err = l.Set("typed", []byte("value"))
+	if err != nil {
+		t.Error(err)
+	}
+	value, err := l.Get("typed")
+	if err != nil || string(value) != "value" {
+		t.Error(err, value)
+	}
+	err = l.Remove("typed")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTypedLayer(t *testing.T) {
+	ctx := context.Background()
+	source, err := transparent.NewLayerSource(test.NewStorage(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLayer(NewWire[string, int](source), String[string](), Any[int]())
+
+	err = l.SetMulti(ctx, map[string]int{"a": 1, "b": 2})
+	if err != nil {
+		t.Error(err)
+	}
+	values, err := l.GetMulti(ctx, []string{"a", "b", "c"})
+	if err != nil || !reflect.DeepEqual(values, map[string]int{"a": 1, "b": 2}) {
+		t.Error(err, values)
+	}
+	page, err := l.Scan(ctx, transparent.ScanRange{})
+	if err != nil || len(page.Keys) != 2 {
+		t.Error(err, page)
+	}
+
+	value, version, err := l.GetVersion(ctx, "a")
+	if err != nil || value != 1 {
+		t.Error(err, value)
+	}
+	_, err = l.CompareAndSwap(ctx, "a", 3, version)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = l.CompareAndSwap(ctx, "a", 4, version)
+	if _, ok := err.(*transparent.VersionConflictError); !ok {
+		t.Error(err)
+	}
+	_, err = l.SetIfAbsent(ctx, "a", 5)
+	if _, ok := err.(*transparent.VersionConflictError); !ok {
+		t.Error(err)
+	}
+	_, version, err = l.GetVersion(ctx, "a")
+	if err != nil {
+		t.Error(err)
+	}
+	err = l.RemoveIfVersion(ctx, "a", version)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = l.RemoveMulti(ctx, []string{"a", "b"})
+	if err != nil {
+		t.Error(err)
+	}
+	values, err = l.GetMulti(ctx, []string{"a", "b"})
+	if err != nil || len(values) != 0 {
+		t.Error(err, values)
+	}
+}
@@ -0,0 +1,31 @@
+package transparent
+
+import (
+	"context"
+	"errors"
+)
+
+// BackendStorageVersion is BackendStorage which has version of each value.
+// Version is opaque string like ETag, which is changed by every write.
+// Conditional operations return VersionConflictError if the condition is not met.
+type BackendStorageVersion interface {
+	BackendStorage
+	GetVersion(ctx context.Context, key interface{}) (value interface{}, version string, err error)
+	AddIfAbsent(ctx context.Context, key interface{}, value interface{}) (version string, err error)
+	AddIfVersion(ctx context.Context, key interface{}, value interface{}, version string) (newVersion string, err error)
+	RemoveIfVersion(ctx context.Context, key interface{}, version string) error
+}
+
+// VersionConflictError means the key is changed by another writer
+type VersionConflictError struct {
+	Key interface{}
+}
+
+func (e *VersionConflictError) Error() string { return "version of the key is conflicted" }
+
+func versionStorage(s BackendStorage) (BackendStorageVersion, error) {
+	if sv, ok := s.(BackendStorageVersion); ok {
+		return sv, nil
+	}
+	return nil, errors.New("storage doesn't support version")
+}
@@ -0,0 +1,206 @@
+package transparent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juntaki/transparent/internal/logfile"
+	"github.com/pkg/errors"
+)
+
+// writeAheadLog is append-only file of operations buffered in LayerCache.
+// Each record is gob encoded walRecord in logfile.
+// Commit and discard append markers, and the file is rewritten only to compact it.
+type writeAheadLog struct {
+	lock    sync.Mutex
+	file    *logfile.File
+	seq     uint64
+	size    int          // Number of records in the file
+	pending []*walRecord // Appended, but not committed yet
+}
+
+type walRecord struct {
+	Seq       uint64
+	Key       interface{}
+	Value     interface{}
+	Message   MessageType
+	Expire    time.Time
+	Committed []uint64 // Marker of the records applied to next layer, it has no operation
+	Discarded []uint64 // Marker of the records not queued to flush, it has no operation
+	data      []byte
+}
+
+// walCompaction is the number of records not pending, which triggers rewrite of the file
+const walCompaction = 1024
+
+// openWriteAheadLog opens the file and reads records left by the last process.
+func openWriteAheadLog(filename string) (*writeAheadLog, error) {
+	file, records, err := logfile.Open("write-ahead log", filename)
+	if err != nil {
+		return nil, err
+	}
+	w := &writeAheadLog{file: file, size: len(records)}
+	for _, data := range records {
+		record := &walRecord{data: data}
+		err = logfile.Decode(data, record)
+		if err != nil {
+			file.Close()
+			return nil, errors.Wrapf(err, "failed to decode write-ahead log. filename = %s", filename)
+		}
+		if record.Committed != nil || record.Discarded != nil {
+			w.truncate(record.Committed)
+			w.remove(record.Discarded)
+			continue
+		}
+		w.pending = append(w.pending, record)
+		w.seq = record.Seq
+	}
+	return w, nil
+}
+
+// append writes the operation to the file, and returns its sequence number.
+// Types of key and value must be registered by gob.Register.
+func (w *writeAheadLog) append(key interface{}, m *Message) (uint64, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.seq++
+	record := &walRecord{
+		Seq:     w.seq,
+		Key:     key,
+		Value:   m.Value,
+		Message: m.Message,
+		Expire:  m.Expire,
+	}
+	data, err := logfile.Encode(record)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to encode write-ahead log")
+	}
+	record.data = data
+	err = w.file.Append(data)
+	if err != nil {
+		return 0, err
+	}
+	w.size++
+	w.pending = append(w.pending, record)
+	return record.Seq, nil
+}
+
+// records returns operations not committed yet
+func (w *writeAheadLog) records() []*walRecord {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]*walRecord{}, w.pending...)
+}
+
+// commit truncates the records applied to next layer.
+// Older records of the same key are also truncated, they are overwritten.
+func (w *writeAheadLog) commit(seqs map[uint64]bool) error {
+	if len(seqs) == 0 {
+		return nil
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	committed := make([]uint64, 0, len(seqs))
+	for seq := range seqs {
+		committed = append(committed, seq)
+	}
+	if !w.truncate(committed) {
+		return nil
+	}
+	return w.mark(&walRecord{Committed: committed})
+}
+
+// discard removes the record, which is not queued to flush
+func (w *writeAheadLog) discard(seq uint64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.remove([]uint64{seq})
+	return w.mark(&walRecord{Discarded: []uint64{seq}})
+}
+
+// truncate removes the committed records and older records of the same key from pending.
+// It returns false if nothing is removed.
+func (w *writeAheadLog) truncate(committed []uint64) bool {
+	seqs := make(map[uint64]bool, len(committed))
+	for _, seq := range committed {
+		seqs[seq] = true
+	}
+	latest := make(map[interface{}]uint64)
+	for _, r := range w.pending {
+		if seqs[r.Seq] && latest[r.Key] < r.Seq {
+			latest[r.Key] = r.Seq
+		}
+	}
+	pending := []*walRecord{}
+	for _, r := range w.pending {
+		if r.Seq > latest[r.Key] {
+			pending = append(pending, r)
+		}
+	}
+	removed := len(pending) != len(w.pending)
+	w.pending = pending
+	return removed
+}
+
+// remove removes the records from pending
+func (w *writeAheadLog) remove(discarded []uint64) {
+	pending := []*walRecord{}
+	for _, r := range w.pending {
+		kept := true
+		for _, seq := range discarded {
+			if r.Seq == seq {
+				kept = false
+			}
+		}
+		if kept {
+			pending = append(pending, r)
+		}
+	}
+	w.pending = pending
+}
+
+// mark appends the marker, and compacts the file if most of records are not pending.
+// The file is truncated if nothing is pending.
+func (w *writeAheadLog) mark(marker *walRecord) error {
+	if len(w.pending) == 0 {
+		err := w.file.Truncate()
+		if err != nil {
+			return err
+		}
+		w.size = 0
+		return nil
+	}
+	if w.size-len(w.pending) >= walCompaction && w.size >= 2*len(w.pending) {
+		return w.rewrite()
+	}
+	data, err := logfile.Encode(marker)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode write-ahead log")
+	}
+	err = w.file.Append(data)
+	if err != nil {
+		return err
+	}
+	w.size++
+	return nil
+}
+
+// rewrite replaces the file with pending records
+func (w *writeAheadLog) rewrite() error {
+	records := make([][]byte, 0, len(w.pending))
+	for _, r := range w.pending {
+		records = append(records, r.data)
+	}
+	err := w.file.Rewrite(records)
+	if err != nil {
+		return err
+	}
+	w.size = len(records)
+	return nil
+}
+
+func (w *writeAheadLog) close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.file.Close()
+}
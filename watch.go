@@ -0,0 +1,126 @@
+package transparent
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// Event is change of the key in a layer
+type Event struct {
+	Key     interface{}
+	Value   interface{} // nil for MessageRemove
+	Message MessageType // MessageSet or MessageRemove
+	Layer   Layer       // Origin layer of the change
+}
+
+// watchable is Layer which reports changes to Stack.Watch
+type watchable interface {
+	setHub(h *watchHub)
+}
+
+// watchHub delivers events to watchers
+type watchHub struct {
+	lock     sync.Mutex
+	watchers map[*watcher]bool
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{watchers: make(map[*watcher]bool)}
+}
+
+// notify the change to watchers of the key, it is safe to call with nil hub
+func (h *watchHub) notify(l Layer, m MessageType, key interface{}, value interface{}) {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for w := range h.watchers {
+		if w.match(key) {
+			w.push(&Event{Key: key, Value: value, Message: m, Layer: l})
+		}
+	}
+}
+
+func (h *watchHub) add(w *watcher) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.watchers[w] = true
+}
+
+func (h *watchHub) remove(w *watcher) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.watchers, w)
+}
+
+// watcher queues events without limit, so that layers are not blocked by slow reader
+type watcher struct {
+	prefix string
+	lock   sync.Mutex
+	queue  []*Event
+	signal chan bool
+	out    chan *Event
+}
+
+// match returns true if the key starts with prefix, non-string key matches only empty prefix
+func (w *watcher) match(key interface{}) bool {
+	if w.prefix == "" {
+		return true
+	}
+	s, ok := key.(string)
+	return ok && strings.HasPrefix(s, w.prefix)
+}
+
+func (w *watcher) push(e *Event) {
+	w.lock.Lock()
+	w.queue = append(w.queue, e)
+	w.lock.Unlock()
+	select {
+	case w.signal <- true:
+	default:
+	}
+}
+
+func (w *watcher) pop() []*Event {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	events := w.queue
+	w.queue = nil
+	return events
+}
+
+// run sends queued events to out until ctx is done
+func (w *watcher) run(ctx context.Context, h *watchHub) {
+	defer close(w.out)
+	defer h.remove(w)
+	for {
+		select {
+		case <-w.signal:
+		case <-ctx.Done():
+			return
+		}
+		for _, e := range w.pop() {
+			select {
+			case w.out <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// Watch returns the channel of changes of keys start with keyOrPrefix.
+// Empty keyOrPrefix watches all keys.
+// Each layer reports its change, the channel is closed when ctx is done.
+func (s *Stack) Watch(ctx context.Context, keyOrPrefix string) <-chan *Event {
+	w := &watcher{
+		prefix: keyOrPrefix,
+		signal: make(chan bool, 1),
+		out:    make(chan *Event),
+	}
+	s.hub.add(w)
+	go w.run(ctx, s.hub)
+	return w.out
+}
@@ -0,0 +1,74 @@
+package transparent_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/juntaki/transparent"
+	"github.com/juntaki/transparent/lru"
+	"github.com/juntaki/transparent/test"
+)
+
+// nextEvent receives an event, or fail after 1 second
+func nextEvent(t *testing.T, events <-chan *transparent.Event) *transparent.Event {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	return nil
+}
+
+func TestWatch(t *testing.T) {
+	source := test.NewSource(0)
+	cache, err := transparent.NewLayerCache(10, lru.NewStorage(10),
+		transparent.WithWritePolicy(transparent.WriteThrough))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := transparent.NewStack()
+	s.Stack(source)
+	s.Stack(cache)
+	s.Start()
+	defer s.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := s.Watch(ctx, "config/")
+
+	err = s.Set("other", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Set("config/a", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Remove("config/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Source is changed first by WriteThrough
+	expected := []struct {
+		message transparent.MessageType
+		layer   transparent.Layer
+	}{
+		{transparent.MessageSet, source},
+		{transparent.MessageSet, cache},
+		{transparent.MessageRemove, source},
+		{transparent.MessageRemove, cache},
+	}
+	for _, ex := range expected {
+		e := nextEvent(t, events)
+		if e.Key != "config/a" || e.Message != ex.message || e.Layer != ex.layer {
+			t.Error(e)
+		}
+	}
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Error("channel is not closed")
+	}
+}